@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"ezzy-web-crypto/api/apps/api/internal/apihelper"
+	"ezzy-web-crypto/api/apps/api/internal/config"
+	"ezzy-web-crypto/api/apps/api/internal/jsonutil"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"ezzy-web-crypto/api/apps/api/internal/tenant"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// keyServer serves the endpoints that use keys. Its keystores are opened at
+// startup, or when the server is unsealed, and closed again when it is
+// sealed; requests are refused in between.
+type keyServer struct {
+	cfg  *config.Config
+	opts keystore.Options
+
+	mu  sync.RWMutex
+	svc *keyService
+}
+
+// keyService holds the open keystores and the handlers using them.
+type keyService struct {
+	ks       *keystore.Keystore
+	tenants  *tenant.Registry
+	stop     chan struct{}
+	keys     http.Handler
+	prefixed http.Handler
+	admin    http.Handler
+}
+
+func keysHandler(svc *keyService) http.Handler     { return svc.keys }
+func prefixedHandler(svc *keyService) http.Handler { return svc.prefixed }
+func adminHandler(svc *keyService) http.Handler    { return svc.admin }
+
+// open opens the default keystore and the tenants, with key files protected
+// by masterKey if it is set.
+func (s *keyServer) open(masterKey []byte) error {
+	backend, err := newBackend(s.cfg, masterKey)
+	if err != nil {
+		return err
+	}
+
+	opts := s.opts
+	opts.Backend = backend
+	ks, err := keystore.Open(opts)
+	if err != nil {
+		return err
+	}
+
+	tenants, err := openTenants(s.cfg, s.opts, masterKey)
+	if err != nil {
+		ks.Close()
+		return err
+	}
+
+	pool := keystore.NewPool(ks, s.cfg.KeyPoolSize)
+	svc := &keyService{
+		ks:       ks,
+		tenants:  tenants,
+		stop:     make(chan struct{}),
+		keys:     tenant.HandleScoped(tenants, keyRoutes(ks, pool)),
+		prefixed: tenant.HandlePrefixed(tenants),
+		admin:    fullPath(adminRoutes(ks, pool, tenants)),
+	}
+
+	go maintainKeys("default", ks, pool, time.Minute, svc.stop)
+	go fillPool("default", pool, time.Minute, svc.stop)
+
+	s.mu.Lock()
+	s.svc = svc
+	s.mu.Unlock()
+
+	return nil
+}
+
+// close closes the keystores, zeroing the private keys held in memory.
+func (s *keyServer) close() error {
+	s.mu.Lock()
+	svc := s.svc
+	s.svc = nil
+	s.mu.Unlock()
+
+	if svc == nil {
+		return nil
+	}
+
+	close(svc.stop)
+	err := svc.tenants.Close()
+	if ksErr := svc.ks.Close(); err == nil {
+		err = ksErr
+	}
+
+	return err
+}
+
+// handler returns a handler serving requests with the handler pick selects
+// from the open keystores.
+func (s *keyServer) handler(pick func(svc *keyService) http.Handler) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		svc := s.svc
+		s.mu.RUnlock()
+
+		if svc == nil {
+			jsonutil.MarshalResponse(rw, http.StatusServiceUnavailable, &apihelper.ErrorResponse{
+				ErrorMessage: "error server is sealed",
+			})
+			return
+		}
+
+		pick(svc).ServeHTTP(rw, r)
+	}
+}
+
+// fullPath serves h, a router matching the full request path, without the
+// routing context of the router in front of it.
+func fullPath(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, (*chi.Context)(nil))))
+	})
+}
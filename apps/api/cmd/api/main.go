@@ -1,12 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"ezzy-web-crypto/api/apps/api/internal/aes"
+	"ezzy-web-crypto/api/apps/api/internal/apihelper"
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+	"ezzy-web-crypto/api/apps/api/internal/config"
 	"ezzy-web-crypto/api/apps/api/internal/envelope"
+	"ezzy-web-crypto/api/apps/api/internal/jwks"
 	"ezzy-web-crypto/api/apps/api/internal/keystore"
 	"ezzy-web-crypto/api/apps/api/internal/rsa"
+	"ezzy-web-crypto/api/apps/api/internal/seal"
+	"ezzy-web-crypto/api/apps/api/internal/tenant"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -14,13 +25,62 @@ import (
 )
 
 func main() {
-	err := keystore.NewKeyPair()
+	cfg, err := config.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var usages []keystore.Usage
+	if len(cfg.KeyUsages) > 0 {
+		if usages, err = keystore.ParseUsages(cfg.KeyUsages); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	opts := keystore.Options{
+		Bits:         cfg.KeyBits,
+		GracePeriod:  cfg.KeyGracePeriod,
+		Lifetime:     cfg.KeyLifetime,
+		RotateBefore: cfg.KeyRotateBefore,
+		Usages:       usages,
+	}
+
+	if cfg.AuditLog != "" {
+		auditLog, err := audit.Open(cfg.AuditLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer auditLog.Close()
+		opts.Audit = auditLog
+	} else {
+		log.Print("AUDIT_LOG is not set, key operations are not recorded")
+	}
+
+	keys := &keyServer{cfg: cfg, opts: opts}
+
+	var sl *seal.Seal
+	if cfg.SealFile != "" {
+		sl, err = seal.Open(seal.Options{
+			Path: cfg.SealFile,
+			Unsealed: func(ctx context.Context, masterKey []byte) error {
+				return keys.open(masterKey)
+			},
+			Sealed: func(ctx context.Context) error {
+				return keys.close()
+			},
+			Audit: opts.Audit,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Print("server is sealed, submit master key shares to /seal/unseal")
+	} else if err := keys.open(nil); err != nil {
+		log.Fatal(err)
+	}
+
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
+	r.Use(audit.Middleware)
 
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:4200"},
@@ -36,19 +96,249 @@ func main() {
 	})
 
 	r.Route("/aes", func(r chi.Router) {
+		r.Post("/enc", aes.HandleAesEncryption())
 		r.Post("/dec", aes.HandleAesDecryption())
+		r.Post("/stream/enc", aes.HandleAesStreamEncryption())
+		r.Post("/stream/dec", aes.HandleAesStreamDecryption())
+		r.Post("/siv/enc", aes.HandleAesSIVEncryption())
+		r.Post("/siv/dec", aes.HandleAesSIVDecryption())
+		r.Post("/ff1/enc", aes.HandleAesFF1Encryption())
+		r.Post("/ff1/dec", aes.HandleAesFF1Decryption())
 	})
 
+	// AES-KW takes its key encryption key from the request and works while
+	// the server is sealed.
+	r.Post("/envelope/wrap", envelope.HandleKeyWrap())
+	r.Post("/envelope/unwrap", envelope.HandleKeyUnwrap())
+
+	if sl != nil {
+		r.Route("/seal", func(r chi.Router) {
+			r.Get("/status", seal.HandleGetStatus(sl))
+			r.Post("/unseal", seal.HandleUnseal(sl))
+		})
+	}
+
+	// Key endpoints use the default keystore unless the request carries a
+	// tenant API key, or is prefixed with /t/{tenant}. They are refused while
+	// the server is sealed.
+	r.Handle("/.well-known/jwks.json", keys.handler(keysHandler))
+	r.Handle("/rsa", keys.handler(keysHandler))
+	r.Handle("/rsa/*", keys.handler(keysHandler))
+	r.Handle("/envelope/*", keys.handler(keysHandler))
+	r.Handle("/t/{tenant}/*", keys.handler(prefixedHandler))
+
+	if cfg.AdminToken != "" {
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(apihelper.RequireBearerToken(cfg.AdminToken))
+			r.Use(audit.Identify("admin"))
+			if sl != nil {
+				r.Post("/seal/init", seal.HandleInit(sl))
+				r.Post("/seal", seal.HandleSeal(sl))
+			}
+			r.Handle("/*", keys.handler(adminHandler))
+		})
+	}
+
+	http.ListenAndServe(":3000", r)
+}
+
+// keyRoutes serves the endpoints that use the keys of one keystore.
+func keyRoutes(ks *keystore.Keystore, pool *keystore.Pool) http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/.well-known/jwks.json", jwks.HandleGetJWKS(ks))
+
 	r.Route("/rsa", func(r chi.Router) {
-		r.Post("/", rsa.HandlePostNewKeyPair())
-		r.Get("/pub", rsa.HandleGetPublicKey())
-		r.Post("/dec", rsa.HandleRsaDecryption())
+		r.Post("/", rsa.HandlePostNewKeyPair(pool))
+		r.Get("/jobs/{id}", rsa.HandleGetJob(pool))
+		r.Get("/pub", rsa.HandleGetPublicKey(ks))
+		r.Get("/keys", rsa.HandleListKeys(ks))
+		r.Get("/revoked", rsa.HandleGetRevocationList(ks))
+		r.Post("/dec", rsa.HandleRsaDecryption(ks))
 		r.Post("/enc", rsa.HandleRsaEncryption())
 	})
 
 	r.Route("/envelope", func(r chi.Router) {
-		r.Post("/open", envelope.HandleEnvelopeOpen())
+		r.Post("/open", envelope.HandleEnvelopeOpen(ks))
 	})
 
-	http.ListenAndServe(":3000", r)
+	return r
+}
+
+// adminRoutes serves the /admin endpoints that use the default keystore or the
+// tenant registry. The keys of a tenant are managed below
+// /admin/tenants/{tenant}.
+func adminRoutes(ks *keystore.Keystore, pool *keystore.Pool, tenants *tenant.Registry) http.Handler {
+	r := chi.NewRouter()
+
+	r.Route("/admin", func(r chi.Router) {
+		keyAdminRoutes(r, ks, pool)
+		r.Post("/tenants", tenant.HandleCreateTenant(tenants))
+		r.Get("/tenants", tenant.HandleListTenants(tenants))
+		r.Delete("/tenants/{tenant}", tenant.HandleDeleteTenant(tenants))
+		r.Handle("/tenants/{tenant}/*", tenant.HandleAdmin(tenants))
+	})
+
+	return r
+}
+
+// tenantAdminRoutes serves the admin endpoints of the keys of one tenant.
+func tenantAdminRoutes(ks *keystore.Keystore, pool *keystore.Pool) http.Handler {
+	r := chi.NewRouter()
+	keyAdminRoutes(r, ks, pool)
+
+	return r
+}
+
+// keyAdminRoutes adds the admin endpoints that manage the keys of one keystore
+// to r.
+func keyAdminRoutes(r chi.Router, ks *keystore.Keystore, pool *keystore.Pool) {
+	r.Post("/keys/import", rsa.HandleImportKey(ks))
+	r.Post("/keys/{kid}/revoke", rsa.HandleRevokeKey(ks, pool))
+	r.Delete("/keys/{kid}", rsa.HandleDestroyKey(ks))
+	r.Post("/backup", rsa.HandleBackup(ks))
+	r.Post("/restore", rsa.HandleRestore(ks))
+}
+
+// newBackend returns the backend of the default keystore. Key files are
+// protected by masterKey if the server is sealed, else by the passphrase.
+func newBackend(cfg *config.Config, masterKey []byte) (keystore.Backend, error) {
+	switch cfg.KeystoreBackend {
+	case config.BackendFile:
+		return newFileBackend(cfg, cfg.KeystoreFile, masterKey)
+	case config.BackendPKCS11:
+		return keystore.NewPKCS11Backend(keystore.PKCS11Config{
+			Module:     cfg.PKCS11Module,
+			TokenLabel: cfg.PKCS11TokenLabel,
+			PIN:        cfg.PKCS11PIN,
+		})
+	default:
+		return keystore.NewMemoryBackend(), nil
+	}
+}
+
+func newFileBackend(cfg *config.Config, path string, masterKey []byte) (keystore.Backend, error) {
+	if masterKey != nil {
+		return keystore.NewFileBackendWithKey(path, masterKey, []byte(cfg.KeystorePassphrase))
+	}
+	return keystore.NewFileBackend(path, []byte(cfg.KeystorePassphrase))
+}
+
+// openTenants opens the tenant registry. Tenant keystores use the configured
+// backend with opts; each tenant gets its own key file.
+func openTenants(cfg *config.Config, opts keystore.Options, masterKey []byte) (*tenant.Registry, error) {
+	var path string
+	if cfg.TenantDir != "" {
+		if err := os.MkdirAll(cfg.TenantDir, 0700); err != nil {
+			return nil, err
+		}
+		path = filepath.Join(cfg.TenantDir, "tenants.json")
+	}
+
+	keystorePath := func(id string) string {
+		return filepath.Join(cfg.TenantDir, id+".keystore.json")
+	}
+
+	return tenant.Open(tenant.Options{
+		Path: path,
+		OpenKeystore: func(id string) (*keystore.Keystore, error) {
+			opts := opts
+			opts.Tenant = id
+			switch cfg.KeystoreBackend {
+			case config.BackendFile:
+				backend, err := newFileBackend(cfg, keystorePath(id), masterKey)
+				if err != nil {
+					return nil, err
+				}
+				opts.Backend = backend
+			case config.BackendPKCS11:
+				return nil, errors.New("tenants are not supported with the pkcs11 backend")
+			default:
+				opts.Backend = keystore.NewMemoryBackend()
+			}
+			return keystore.Open(opts)
+		},
+		RemoveKeystore: func(id string) error {
+			if cfg.KeystoreBackend != config.BackendFile {
+				return nil
+			}
+			err := os.Remove(keystorePath(id))
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		},
+		Routes:      keyRoutes,
+		AdminRoutes: tenantAdminRoutes,
+		PoolSize:    cfg.KeyPoolSize,
+		Audit:       opts.Audit,
+		Started: func(t *tenant.Tenant) {
+			go maintainKeys("tenant "+t.ID, t.Keystore, t.Pool, time.Minute, t.Done())
+			go fillPool("tenant "+t.ID, t.Pool, time.Minute, t.Done())
+		},
+	})
+}
+
+// maintainKeys periodically rotates the active key of the keystore named name
+// before it expires and retires rotated keys whose grace period ended, until
+// stop is closed.
+func maintainKeys(name string, ks *keystore.Keystore, pool *keystore.Pool, interval time.Duration, stop <-chan struct{}) {
+	ctx := audit.System("maintenance")
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-stop:
+			return
+		}
+
+		key, job, err := pool.RotateIfDue(ctx, now)
+		switch {
+		case err != nil:
+			log.Printf("%s: error rotating expiring key: %v", name, err)
+		case key != nil:
+			log.Printf("%s: rotated to key %s", name, key.ID)
+		case job != nil:
+			log.Printf("%s: rotating to a new key, job %s", name, job.ID)
+		}
+		if _, err := ks.Current(); errors.Is(err, keystore.ErrKeyExpired) {
+			log.Printf("%s: refusing to hand out keys until the rotation finishes: %v", name, err)
+		}
+
+		n, err := ks.RetireExpired(ctx, now)
+		if err != nil {
+			log.Printf("%s: error retiring keys: %v", name, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("%s: retired %d key(s)", name, n)
+		}
+	}
+}
+
+// fillPool keeps the key pool of the keystore named name filled until stop is
+// closed. It runs whenever a pooled key is taken and at least once per
+// interval, which retries failed generations.
+func fillPool(name string, pool *keystore.Pool, interval time.Duration, stop <-chan struct{}) {
+	ctx := audit.System("pool")
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		if _, err := pool.Fill(ctx); err != nil {
+			log.Printf("%s: error filling key pool: %v", name, err)
+		}
+
+		select {
+		case <-pool.Drained():
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+	}
 }
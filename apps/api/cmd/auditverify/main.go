@@ -0,0 +1,87 @@
+// Command auditverify checks the hash chain of an audit log written by the API
+// server. It prints the number of events and the sequence number and hash of
+// the last event, and exits with status 1 if any event was edited, reordered
+// or deleted.
+//
+// Usage:
+//
+//	auditverify [-from seq:hash] [-expect seq:hash] [audit.log]
+//
+// The log is read from standard input if no file is given. It must start with
+// the first event ever recorded, unless -from gives the sequence number and
+// hash of the event the log continues, as printed by an earlier run. Deleting
+// events from the end of the log breaks no chain; to detect it, -expect gives
+// the last event printed by an earlier run, which the log must still contain.
+package main
+
+import (
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	from := flag.String("from", "", "sequence number and hash `seq:hash` of the event the log continues")
+	expect := flag.String("expect", "", "sequence number and hash `seq:hash` of an event the log must contain")
+	flag.Parse()
+
+	anchor, err := parseAnchor("-from", *from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	head, err := parseAnchor("-expect", *expect)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var in io.Reader = os.Stdin
+	name := "stdin"
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		defer f.Close()
+		in = f
+		name = flag.Arg(0)
+	}
+
+	n, last, err := audit.VerifyRange(in, anchor, head)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v (%d valid events before)\n", name, err, n)
+		os.Exit(1)
+	}
+
+	// An emptied log breaks no chain, so without a point to verify it
+	// against nothing can be said about it.
+	if n == 0 && anchor.Seq == 0 && head.Seq == 0 {
+		fmt.Fprintf(os.Stderr, "%s: warning: no events, cannot tell whether the log was emptied; use -expect seq:hash\n", name)
+		return
+	}
+
+	fmt.Printf("%s: %d events, chain intact, last event %d:%s\n", name, n, anchor.Seq+int64(n), last)
+}
+
+func parseAnchor(flagName, s string) (audit.Anchor, error) {
+	if s == "" {
+		return audit.Anchor{}, nil
+	}
+
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return audit.Anchor{}, fmt.Errorf("%s: want seq:hash", flagName)
+	}
+	seq, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil || seq < 1 {
+		return audit.Anchor{}, fmt.Errorf("%s: invalid sequence number %q", flagName, s[:i])
+	}
+
+	return audit.Anchor{Seq: seq, Hash: s[i+1:]}, nil
+}
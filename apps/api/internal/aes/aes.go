@@ -3,34 +3,136 @@ package aes
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 )
 
-func decrypt(aesBase64 string, encMsgBase64 string) []byte {
-	key, _ := base64.StdEncoding.DecodeString(aesBase64)
-	encMsg, _ := base64.StdEncoding.DecodeString(encMsgBase64)
+// NonceSize is the size of the random nonce prefixed to every ciphertext, as
+// the TS library's encryptWithAes does.
+const NonceSize = 12
 
-	return Decrypt(key, encMsg)
+// tagSize is the size of the GCM authentication tag appended to ciphertexts.
+const tagSize = 16
+
+var (
+	ErrInvalidKey = errors.New("aes: invalid key size, want 16, 24 or 32 bytes")
+	ErrTruncated  = errors.New("aes: ciphertext too short")
+	ErrAuthFailed = errors.New("aes: message authentication failed")
+)
+
+func decrypt(p Params, aesBase64, encMsgBase64, aadBase64 string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(aesBase64)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding AES key: %w", err)
+	}
+	encMsg, err := base64.StdEncoding.DecodeString(encMsgBase64)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding message: %w", err)
+	}
+	aad, err := DecodeAAD(aadBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecryptWith(p, key, encMsg, aad)
 }
 
-func Decrypt(aesKey, encData []byte) []byte {
-	c, err := aes.NewCipher(aesKey)
+func encrypt(p Params, aesBase64, msg, aadBase64 string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(aesBase64)
 	if err != nil {
-		fmt.Println(err)
+		return "", fmt.Errorf("error decoding AES key: %w", err)
+	}
+	aad, err := DecodeAAD(aadBase64)
+	if err != nil {
+		return "", err
 	}
 
-	gcm, err := cipher.NewGCM(c)
+	encData, err := EncryptWith(p, key, []byte(msg), aad)
 	if err != nil {
-		fmt.Println(err)
+		return "", err
 	}
 
+	return base64.StdEncoding.EncodeToString(encData), nil
+}
+
+// DecodeAAD decodes base64 additional authenticated data as sent to the API.
+// An empty string is no additional data.
+func DecodeAAD(aadBase64 string) ([]byte, error) {
+	aad, err := base64.StdEncoding.DecodeString(aadBase64)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding AAD: %w", err)
+	}
+
+	return aad, nil
+}
+
+// Encrypt encrypts data with AES-GCM under a 128, 192 or 256 bit key and a
+// fresh random nonce. It returns nonce || ciphertext || tag, which the TS
+// library's decryptWithAes opens. aad is authenticated but not encrypted,
+// like AesGcmParams.additionalData; it may be nil.
+func Encrypt(aesKey, data, aad []byte) ([]byte, error) {
+	return encryptFrom(rand.Reader, aesKey, data, aad)
+}
+
+// encryptFrom is Encrypt with the nonce read from random, which tests
+// replace to check known answers.
+func encryptFrom(random io.Reader, aesKey, data, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealGCM(gcm, random, data, aad)
+}
+
+// Decrypt opens nonce || ciphertext || tag as produced by Encrypt or the TS
+// library's encryptWithAes. aad must be the additional data the message was
+// encrypted with. It fails with ErrInvalidKey, ErrTruncated or ErrAuthFailed
+// if the key or aad are wrong or the data was tampered with.
+func Decrypt(aesKey, encData, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return openGCM(gcm, encData, aad)
+}
+
+// sealGCM encrypts data with a fresh nonce of the size gcm expects, read from
+// random, and prefixes the nonce.
+func sealGCM(gcm cipher.AEAD, random io.Reader, data, aad []byte) ([]byte, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, aad), nil
+}
+
+// openGCM reverses sealGCM.
+func openGCM(gcm cipher.AEAD, encData, aad []byte) ([]byte, error) {
+	minSize := gcm.NonceSize() + gcm.Overhead()
+	if len(encData) < minSize {
+		return nil, fmt.Errorf("%w: got %d bytes, want at least %d", ErrTruncated, len(encData), minSize)
+	}
 	nonce, cipherdata := encData[:gcm.NonceSize()], encData[gcm.NonceSize():]
 
-	data, err := gcm.Open(nil, nonce, cipherdata, nil)
+	data, err := gcm.Open(nil, nonce, cipherdata, aad)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+
+	return data, nil
+}
+
+func newGCM(aesKey []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(aesKey)
 	if err != nil {
-		fmt.Println(err)
+		return nil, fmt.Errorf("%w: got %d bytes", ErrInvalidKey, len(aesKey))
 	}
 
-	return data
+	return cipher.NewGCM(c)
 }
@@ -0,0 +1,300 @@
+package aes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// webCryptoVectors were produced with the WebCrypto of Node 20 the way the TS
+// library's encryptStringWithAes encrypts: AES-GCM with a 128 bit tag, the
+// UTF-8 encoded message and the 12 byte nonce prefixed to the output. aad is
+// passed as AesGcmParams.additionalData:
+//
+//	const k = await crypto.subtle.importKey("raw", key, "AES-GCM", false, ["encrypt"]);
+//	const ct = await crypto.subtle.encrypt(
+//		{ name: "AES-GCM", iv: nonce, tagLength: 128, additionalData: aad }, // aad omitted if empty
+//		k, new TextEncoder().encode(msg));
+//	const enc = Buffer.concat([nonce, new Uint8Array(ct)]).toString("base64");
+var webCryptoVectors = []struct {
+	name  string
+	key   string
+	nonce string
+	msg   string
+	aad   string
+	enc   string
+}{
+	{
+		name:  "empty message",
+		key:   "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+		nonce: "AAAAAAAAAAAAAAAA",
+		msg:   "",
+		enc:   "AAAAAAAAAAAAAAAA8F12rkq5n+Wm9psxSMI2PQ==",
+	},
+	{
+		name:  "256 bit key",
+		key:   "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+		nonce: "yv66vvrO263eyviI",
+		msg:   "hello world",
+		enc:   "yv66vvrO263eyviI4sbMSsVaOHQ0Zzl4fQBWHBu3quXxk/jGAvSW",
+	},
+	{
+		name:  "128 bit key with unicode",
+		key:   "/v/pkoZlcxxtao+UZzCDCA==",
+		nonce: "yv66vvrO263eyviI",
+		msg:   "Grüße, ezzy-web-crypto! 🔐",
+		enc:   "yv66vvrO263eyviI3MDvWxpsF+3OTlIIUgiFYwcg6w5ARidVOq2+gTcNSy/z85H+AyP0BfO0cemj8Q==",
+	},
+	{
+		name:  "192 bit key",
+		key:   "/v/pkoZlcxxtao+UZzCDCP7/6ZKGZXMc",
+		nonce: "AQIDBAUGBwgJCgsM",
+		msg:   "192 bit key",
+		enc:   "AQIDBAUGBwgJCgsMh5zz3y7vIXZgwMNi41yVQtsugdNWesq4X6UL",
+	},
+	{
+		name:  "additional data",
+		key:   "ZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXp7fH1+f4CBgoM=",
+		nonce: "yMfGxcTDwsHAv769",
+		msg:   "bound to a record",
+		aad:   "dXNlcjo0Mi9yZWNvcmQ6Nw==",
+		enc:   "yMfGxcTDwsHAv769eieW3GZ3F/mpTXv4y4gMZmR66OPWj6WB21mWqg03OZ8L",
+	},
+}
+
+func decodeBase64(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestEncryptWebCryptoVectors(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range webCryptoVectors {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			key := decodeBase64(t, tt.key)
+			aad := decodeBase64(t, tt.aad)
+			got, err := encryptFrom(bytes.NewReader(decodeBase64(t, tt.nonce)), key, []byte(tt.msg), aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enc := base64.StdEncoding.EncodeToString(got); enc != tt.enc {
+				t.Errorf("want: %v got: %v", tt.enc, enc)
+			}
+
+			plaintext, err := Decrypt(key, decodeBase64(t, tt.enc), aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != tt.msg {
+				t.Errorf("decrypted want: %q got: %q", tt.msg, plaintext)
+			}
+		})
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	key := decodeBase64(t, webCryptoVectors[1].key)
+	msg := []byte("round trip")
+
+	first, err := Encrypt(key, msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Encrypt(key, msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first) != NonceSize+len(msg)+16 {
+		t.Errorf("ciphertext length want: %v got: %v", NonceSize+len(msg)+16, len(first))
+	}
+	if bytes.Equal(first[:NonceSize], second[:NonceSize]) {
+		t.Error("nonce reused across encryptions")
+	}
+	plaintext, err := Decrypt(key, first, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, msg) {
+		t.Errorf("want: %q got: %q", msg, plaintext)
+	}
+
+	if _, err := Encrypt([]byte("short key"), msg, nil); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("encrypt with invalid key size want: %v got: %v", ErrInvalidKey, err)
+	}
+}
+
+func TestHandleAesEncryption(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		body string
+		code int
+		aad  string
+	}{
+		{name: "valid", body: `{"aes":"` + webCryptoVectors[1].key + `","message":"hello world"}`, code: http.StatusOK},
+		{name: "with aad", body: `{"aes":"` + webCryptoVectors[1].key + `","message":"hello world","aad":"cmVjb3JkOjc="}`, code: http.StatusOK, aad: "cmVjb3JkOjc="},
+		{name: "key not base64", body: `{"aes":"not base64!","message":"hello"}`, code: http.StatusBadRequest},
+		{name: "invalid key size", body: `{"aes":"c2hvcnQ=","message":"hello"}`, code: http.StatusBadRequest},
+		{name: "aad not base64", body: `{"aes":"` + webCryptoVectors[1].key + `","message":"hello","aad":"record:7"}`, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest("POST", "/aes/enc", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			HandleAesEncryption()(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("wrong response code, want: %v got: %v", tt.code, w.Code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var res aesEncryptionResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			key := decodeBase64(t, webCryptoVectors[1].key)
+			enc := decodeBase64(t, res.EncMessage)
+			if plaintext, err := Decrypt(key, enc, decodeBase64(t, tt.aad)); err != nil || string(plaintext) != "hello world" {
+				t.Errorf("decrypted want: %q got: %q", "hello world", plaintext)
+			}
+			if tt.aad == "" {
+				return
+			}
+			if _, err := Decrypt(key, enc, nil); !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("decrypt without aad want: %v got: %v", ErrAuthFailed, err)
+			}
+		})
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	t.Parallel()
+
+	key := decodeBase64(t, webCryptoVectors[1].key)
+	enc := decodeBase64(t, webCryptoVectors[1].enc)
+	tampered := append([]byte(nil), enc...)
+	tampered[len(tampered)-1] ^= 1
+	bound := webCryptoVectors[4]
+
+	tests := []struct {
+		name    string
+		key     []byte
+		encData []byte
+		aad     []byte
+		err     error
+	}{
+		{name: "key too short", key: key[:15], encData: enc, err: ErrInvalidKey},
+		{name: "empty key", key: nil, encData: enc, err: ErrInvalidKey},
+		{name: "empty ciphertext", key: key, encData: nil, err: ErrTruncated},
+		{name: "nonce only", key: key, encData: enc[:NonceSize], err: ErrTruncated},
+		{name: "missing tag bytes", key: key, encData: enc[:NonceSize+tagSize-1], err: ErrTruncated},
+		{name: "tampered tag", key: key, encData: tampered, err: ErrAuthFailed},
+		{name: "wrong key", key: make([]byte, 32), encData: enc, err: ErrAuthFailed},
+		{name: "truncated message", key: key, encData: enc[:len(enc)-1], err: ErrAuthFailed},
+		{name: "unexpected aad", key: key, encData: enc, aad: []byte("record:7"), err: ErrAuthFailed},
+		{name: "missing aad", key: decodeBase64(t, bound.key), encData: decodeBase64(t, bound.enc), err: ErrAuthFailed},
+		{name: "wrong aad", key: decodeBase64(t, bound.key), encData: decodeBase64(t, bound.enc), aad: []byte("user:42/record:8"), err: ErrAuthFailed},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			plaintext, err := Decrypt(tt.key, tt.encData, tt.aad)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("want: %v got: %v", tt.err, err)
+			}
+			if plaintext != nil {
+				t.Errorf("plaintext want: nil got: %q", plaintext)
+			}
+		})
+	}
+}
+
+func TestHandleAesDecryption(t *testing.T) {
+	t.Parallel()
+
+	vector := webCryptoVectors[1]
+	enc := decodeBase64(t, vector.enc)
+	tampered := append([]byte(nil), enc...)
+	tampered[NonceSize] ^= 1
+	bound := webCryptoVectors[4]
+
+	tests := []struct {
+		name       string
+		key        string
+		encMessage string
+		aad        string
+		code       int
+		msg        string
+	}{
+		{name: "valid", key: vector.key, encMessage: vector.enc, code: http.StatusOK, msg: vector.msg},
+		{name: "valid with aad", key: bound.key, encMessage: bound.enc, aad: bound.aad, code: http.StatusOK, msg: bound.msg},
+		{name: "aad not base64", key: bound.key, encMessage: bound.enc, aad: "user:42/record:7", code: http.StatusBadRequest},
+		{name: "missing aad", key: bound.key, encMessage: bound.enc, code: http.StatusUnprocessableEntity},
+		{name: "swapped aad", key: bound.key, encMessage: bound.enc, aad: "dXNlcjo0Mi9yZWNvcmQ6OA==", code: http.StatusUnprocessableEntity},
+		{name: "key not base64", key: "not base64!", encMessage: vector.enc, code: http.StatusBadRequest},
+		{name: "message not base64", key: vector.key, encMessage: "not base64!", code: http.StatusBadRequest},
+		{name: "invalid key size", key: "c2hvcnQ=", encMessage: vector.enc, code: http.StatusBadRequest},
+		{name: "truncated", key: vector.key, encMessage: base64.StdEncoding.EncodeToString(enc[:NonceSize]), code: http.StatusBadRequest},
+		{name: "tampered", key: vector.key, encMessage: base64.StdEncoding.EncodeToString(tampered), code: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			body, err := json.Marshal(&aesDecryptionRequest{AesKeyBase64: tt.key, EncMessage: tt.encMessage, AAD: tt.aad})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", "/aes/dec", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			HandleAesDecryption()(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("wrong response code, want: %v got: %v (%s)", tt.code, w.Code, w.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var res aesDecryptionResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Message != tt.msg {
+				t.Errorf("message want: %q got: %q", tt.msg, res.Message)
+			}
+		})
+	}
+}
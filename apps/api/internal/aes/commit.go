@@ -0,0 +1,137 @@
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Format is the layout of AES-GCM ciphertexts.
+type Format string
+
+const (
+	// FormatDefault is nonce || ciphertext || tag, the one of the TS library.
+	FormatDefault Format = ""
+	// FormatCommitting commits to the key, see EncryptCommitting.
+	FormatCommitting Format = "committing"
+)
+
+// The committing format is
+//
+//	version (1 byte) || nonce (12 bytes) || commitment (32 bytes) || ciphertext || tag
+//
+// AES-GCM alone is not key-committing: a ciphertext can be crafted to open
+// under many keys, which lets partitioning oracles test a batch of password
+// derived keys per request. Here the message is sealed under a key derived
+// from the caller's key and the nonce, and the commitment is derived from the
+// same two with a different label; the commitment is checked before anything
+// is decrypted. Both derivations include the key length, as HMAC pads short
+// keys with zeros: K, K || 0^8 and K || 0^16 would otherwise commit alike.
+const (
+	commitVersion    = 1
+	commitSize       = sha256.Size
+	commitHeaderSize = 1 + NonceSize + commitSize
+)
+
+var (
+	commitLabel = []byte("ezzy-web-crypto/aes/key-commitment")
+	encKeyLabel = []byte("ezzy-web-crypto/aes/encryption-key")
+)
+
+var ErrUnsupportedFormat = errors.New("aes: unsupported ciphertext format")
+
+// ParseFormat returns the format named name. An empty name selects
+// FormatDefault.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(name); f {
+	case FormatDefault, FormatCommitting:
+		return f, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedFormat, name)
+	}
+}
+
+// EncryptCommitting encrypts data with AES-GCM in the key-committing format,
+// so that it only decrypts under aesKey.
+func EncryptCommitting(aesKey, data, aad []byte) ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	gcm, commitment, err := newCommitting(aesKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, commitHeaderSize+len(data)+tagSize)
+	out = append(out, commitVersion)
+	out = append(out, nonce...)
+	out = append(out, commitment...)
+
+	return gcm.Seal(out, nonce, data, commitAAD(aad)), nil
+}
+
+// DecryptCommitting opens data produced by EncryptCommitting. It fails with
+// ErrAuthFailed if the commitment does not match aesKey, before decrypting.
+func DecryptCommitting(aesKey, encData, aad []byte) ([]byte, error) {
+	if len(encData) < commitHeaderSize+tagSize {
+		return nil, fmt.Errorf("%w: got %d bytes, want at least %d", ErrTruncated, len(encData), commitHeaderSize+tagSize)
+	}
+	if encData[0] != commitVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupportedFormat, encData[0])
+	}
+	nonce := encData[1 : 1+NonceSize]
+
+	gcm, commitment, err := newCommitting(aesKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(commitment, encData[1+NonceSize:commitHeaderSize]) {
+		return nil, ErrAuthFailed
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, encData[commitHeaderSize:], commitAAD(aad))
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+
+	return plaintext, nil
+}
+
+// newCommitting returns the AES-GCM AEAD under the key derived from aesKey and
+// nonce, and the commitment to both.
+func newCommitting(aesKey, nonce []byte) (cipher.AEAD, []byte, error) {
+	if _, err := aes.NewCipher(aesKey); err != nil {
+		return nil, nil, fmt.Errorf("%w: got %d bytes", ErrInvalidKey, len(aesKey))
+	}
+
+	encKey := deriveCommitting(aesKey, encKeyLabel, nonce)[:len(aesKey)]
+	defer zero(encKey)
+	gcm, err := newGCM(encKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return gcm, deriveCommitting(aesKey, commitLabel, nonce), nil
+}
+
+// deriveCommitting is HMAC-SHA256(aesKey, len(aesKey) || label || nonce) with
+// the key length in one byte.
+func deriveCommitting(aesKey, label, nonce []byte) []byte {
+	h := hmac.New(sha256.New, aesKey)
+	h.Write([]byte{byte(len(aesKey))})
+	h.Write(label)
+	h.Write(nonce)
+
+	return h.Sum(nil)
+}
+
+// commitAAD authenticates the format version along with aad.
+func commitAAD(aad []byte) []byte {
+	return append([]byte{commitVersion}, aad...)
+}
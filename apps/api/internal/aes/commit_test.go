@@ -0,0 +1,140 @@
+package aes
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCommittingRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{16, 24, 32} {
+		key := randomBytes(t, size)
+		enc, err := EncryptCommitting(key, []byte("hello world"), []byte("user:42"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := commitHeaderSize + len("hello world") + tagSize; len(enc) != want {
+			t.Errorf("length want: %v got: %v", want, len(enc))
+		}
+		if enc[0] != commitVersion {
+			t.Errorf("version want: %v got: %v", commitVersion, enc[0])
+		}
+
+		got, err := DecryptWith(Params{Alg: AlgGCM, Format: FormatCommitting}, key, enc, []byte("user:42"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "hello world" {
+			t.Errorf("want: %q got: %q", "hello world", got)
+		}
+	}
+}
+
+func TestCommittingErrors(t *testing.T) {
+	t.Parallel()
+
+	key := randomBytes(t, 32)
+	enc, err := EncryptWith(Params{Alg: AlgGCM, Format: FormatCommitting}, key, []byte("hello world"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badVersion := append([]byte(nil), enc...)
+	badVersion[0] = 2
+	badCommitment := append([]byte(nil), enc...)
+	badCommitment[1+NonceSize] ^= 1
+	tampered := append([]byte(nil), enc...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name string
+		p    Params
+		key  []byte
+		data []byte
+		err  error
+	}{
+		{name: "valid", key: key, data: enc},
+		{name: "wrong key", key: randomBytes(t, 32), data: enc, err: ErrAuthFailed},
+		{name: "key of another size", key: key[:16], data: enc, err: ErrAuthFailed},
+		{name: "commitment tampered", key: key, data: badCommitment, err: ErrAuthFailed},
+		{name: "ciphertext tampered", key: key, data: tampered, err: ErrAuthFailed},
+		{name: "unsupported version", key: key, data: badVersion, err: ErrUnsupportedFormat},
+		{name: "truncated", key: key, data: enc[:commitHeaderSize+tagSize-1], err: ErrTruncated},
+		{name: "invalid key size", key: key[:10], data: enc, err: ErrInvalidKey},
+		{name: "cbc", p: Params{Alg: AlgCBC, MACKey: key, Format: FormatCommitting}, key: key, data: enc, err: ErrUnsupportedFormat},
+		{name: "short tag", p: Params{Alg: AlgGCM, TagLength: 96, Format: FormatCommitting}, key: key, data: enc, err: ErrInvalidGCMParams},
+		{name: "unknown format", p: Params{Alg: AlgGCM, Format: "v2"}, key: key, data: enc, err: ErrUnsupportedFormat},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := tt.p
+			if p.Alg == "" {
+				p = Params{Alg: AlgGCM, Format: FormatCommitting}
+			}
+			got, err := DecryptWith(p, tt.key, tt.data, nil)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("want: %v got: %v", tt.err, err)
+			}
+			if err == nil && !bytes.Equal(got, []byte("hello world")) {
+				t.Errorf("want: %q got: %q", "hello world", got)
+			}
+		})
+	}
+}
+
+func TestCommittingBindsKeySize(t *testing.T) {
+	t.Parallel()
+
+	// HMAC pads its key with zeros, so these keys share the HMAC key.
+	key := randomBytes(t, 16)
+	keys := [][]byte{key, append(append([]byte(nil), key...), make([]byte, 8)...), append(append([]byte(nil), key...), make([]byte, 16)...)}
+	nonce := randomBytes(t, NonceSize)
+
+	commitments := make([][]byte, len(keys))
+	for i, k := range keys {
+		_, commitment, err := newCommitting(k, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitments[i] = commitment
+		for j := 0; j < i; j++ {
+			if bytes.Equal(commitments[j], commitment) {
+				t.Errorf("keys of %d and %d bytes give the same commitment", len(keys[j]), len(k))
+			}
+		}
+	}
+
+	for _, k := range keys {
+		enc, err := EncryptCommitting(k, []byte("hello world"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, other := range keys {
+			if len(other) == len(k) {
+				continue
+			}
+			if _, err := DecryptCommitting(other, enc, nil); !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("%d byte key opens %d byte key ciphertext, want: %v got: %v", len(other), len(k), ErrAuthFailed, err)
+			}
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	t.Parallel()
+
+	for name, want := range map[string]Format{"": FormatDefault, "committing": FormatCommitting} {
+		got, err := ParseFormat(name)
+		if err != nil || got != want {
+			t.Errorf("%q: want: %v got: %v (%v)", name, want, got, err)
+		}
+	}
+	if _, err := ParseFormat("COMMITTING"); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("want: %v got: %v", ErrUnsupportedFormat, err)
+	}
+}
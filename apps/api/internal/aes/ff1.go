@@ -0,0 +1,232 @@
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"unicode/utf8"
+)
+
+// FF1 is the format-preserving encryption mode of NIST SP 800-38G: it
+// encrypts a string over an alphabet into a string of the same length over
+// the same alphabet, e.g. a 16 digit card number into another 16 digit
+// number. Like SIV it is deterministic for a given tweak, and it is not
+// authenticated; use it where the format has to be kept only.
+
+const (
+	// ff1Rounds is the number of Feistel rounds, section 5.1.
+	ff1Rounds = 10
+	// minFF1Domain is the smallest number of values radix^len strings may
+	// take, as required by revision 1 of SP 800-38G.
+	minFF1Domain = 1000000
+	// maxFF1Radix is the largest radix, section 5.1.
+	maxFF1Radix = 1 << 16
+)
+
+// DefaultAlphabet is the alphabet of radix 2 to 36 when none is given: the
+// digits followed by the lower case letters, as in the NIST samples.
+const DefaultAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+var (
+	ErrInvalidAlphabet = errors.New("aes: invalid FF1 alphabet, want 2 to 65536 distinct characters")
+	ErrInvalidNumeral  = errors.New("aes: character not in the FF1 alphabet")
+	ErrFF1Length       = errors.New("aes: invalid FF1 input length")
+)
+
+// FF1 encrypts strings over one alphabet under one AES key.
+type FF1 struct {
+	block    cipher.Block
+	alphabet []rune
+	index    map[rune]int
+	minLen   int
+}
+
+// NewFF1 returns FF1 under aesKey for strings over alphabet, whose length is
+// the radix.
+func NewFF1(aesKey []byte, alphabet string) (*FF1, error) {
+	runes := []rune(alphabet)
+	if !utf8.ValidString(alphabet) || len(runes) < 2 || len(runes) > maxFF1Radix {
+		return nil, fmt.Errorf("%w: got %d characters", ErrInvalidAlphabet, len(runes))
+	}
+	index := make(map[rune]int, len(runes))
+	for i, r := range runes {
+		if _, ok := index[r]; ok {
+			return nil, fmt.Errorf("%w: %q repeats", ErrInvalidAlphabet, r)
+		}
+		index[r] = i
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: got %d bytes", ErrInvalidKey, len(aesKey))
+	}
+
+	minLen := 1
+	for domain := len(runes); domain < minFF1Domain; domain *= len(runes) {
+		minLen++
+	}
+
+	return &FF1{block: block, alphabet: runes, index: index, minLen: minLen}, nil
+}
+
+// Encrypt encrypts s with the tweak, which may be empty. Different tweaks,
+// e.g. a record or column ID, give unrelated ciphertexts for the same s.
+func (f *FF1) Encrypt(s string, tweak []byte) (string, error) {
+	return f.crypt(s, tweak, false)
+}
+
+// Decrypt reverses Encrypt with the same tweak.
+func (f *FF1) Decrypt(s string, tweak []byte) (string, error) {
+	return f.crypt(s, tweak, true)
+}
+
+func (f *FF1) crypt(s string, tweak []byte, decrypt bool) (string, error) {
+	x := make([]int, 0, len(s))
+	for _, r := range s {
+		i, ok := f.index[r]
+		if !ok {
+			return "", fmt.Errorf("%w: %q", ErrInvalidNumeral, r)
+		}
+		x = append(x, i)
+	}
+	if len(x) < f.minLen || uint64(len(x)) > 1<<32-1 {
+		return "", fmt.Errorf("%w: got %d characters, want at least %d", ErrFF1Length, len(x), f.minLen)
+	}
+	if uint64(len(tweak)) > 1<<32-1 {
+		return "", fmt.Errorf("%w: tweak of %d bytes", ErrFF1Length, len(tweak))
+	}
+
+	y := f.feistel(x, tweak, decrypt)
+	out := make([]rune, len(y))
+	for i, n := range y {
+		out[i] = f.alphabet[n]
+	}
+
+	return string(out), nil
+}
+
+// feistel is algorithm 7 of SP 800-38G, FF1.Encrypt, or algorithm 8,
+// FF1.Decrypt, over the numeral string x.
+func (f *FF1) feistel(x []int, tweak []byte, decrypt bool) []int {
+	radix := len(f.alphabet)
+	n, t := len(x), len(tweak)
+	u := n / 2
+	v := n - u
+
+	bigRadix := big.NewInt(int64(radix))
+	modU := new(big.Int).Exp(bigRadix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(bigRadix, big.NewInt(int64(v)), nil)
+	// Steps 3 and 4: b is the byte length of radix^v - 1, d the byte length
+	// of the round values.
+	b := (new(big.Int).Sub(modV, big.NewInt(1)).BitLen() + 7) / 8
+	d := 4*((b+3)/4) + 4
+
+	// Step 5.
+	p := []byte{1, 2, 1, byte(radix >> 16), byte(radix >> 8), byte(radix), 10, byte(u),
+		byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n),
+		byte(t >> 24), byte(t >> 16), byte(t >> 8), byte(t)}
+	f.block.Encrypt(p, p)
+
+	// Step 6.i: Q is T, zero padding, the round number and b bytes of the
+	// numeral.
+	q := make([]byte, t+(16-(t+b+1)%16)%16+1+b)
+	copy(q, tweak)
+	roundIndex := len(q) - b - 1
+
+	a, c := num(x[:u], bigRadix), num(x[u:], bigRadix)
+	y := new(big.Int)
+	s := make([]byte, (d+15)/16*16)
+	for j := 0; j < ff1Rounds; j++ {
+		i, src := j, c
+		if decrypt {
+			i, src = ff1Rounds-1-j, a
+		}
+		q[roundIndex] = byte(i)
+		src.FillBytes(q[roundIndex+1:])
+
+		// Steps 6.ii to 6.iv: R = PRF(P || Q), extended to d bytes.
+		r := s[:16]
+		copy(r, p)
+		for k := 0; k < len(q); k += 16 {
+			xorBlock(r, q[k:k+16])
+			f.block.Encrypt(r, r)
+		}
+		for k := 1; k < len(s)/16; k++ {
+			block := s[16*k : 16*k+16]
+			copy(block, r)
+			for m := 0; m < 4; m++ {
+				block[15-m] ^= byte(k >> (8 * m))
+			}
+			f.block.Encrypt(block, block)
+		}
+		y.SetBytes(s[:d])
+
+		// Steps 6.v to 6.ix.
+		mod := modU
+		if i%2 == 1 {
+			mod = modV
+		}
+		if decrypt {
+			next := new(big.Int).Sub(c, y)
+			a, c = next.Mod(next, mod), a
+		} else {
+			next := new(big.Int).Add(a, y)
+			a, c = c, next.Mod(next, mod)
+		}
+	}
+
+	return append(str(a, bigRadix, u), str(c, bigRadix, v)...)
+}
+
+// num is NUM_radix of x, section 4.5.
+func num(x []int, radix *big.Int) *big.Int {
+	n := new(big.Int)
+	digit := new(big.Int)
+	for _, v := range x {
+		n.Mul(n, radix)
+		n.Add(n, digit.SetInt64(int64(v)))
+	}
+
+	return n
+}
+
+// str is STR^m_radix of n, section 4.5.
+func str(n, radix *big.Int, m int) []int {
+	x := make([]int, m)
+	n = new(big.Int).Set(n)
+	digit := new(big.Int)
+	for i := m - 1; i >= 0; i-- {
+		n.DivMod(n, radix, digit)
+		x[i] = int(digit.Int64())
+	}
+
+	return x
+}
+
+// newFF1 returns the FF1 of an API call. An empty alphabet selects the prefix
+// of DefaultAlphabet of length radix, or the decimal digits without a radix
+// either.
+func newFF1(aesBase64 string, radix int, alphabet string) (*FF1, error) {
+	key, err := base64.StdEncoding.DecodeString(aesBase64)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding AES key: %w", err)
+	}
+
+	switch {
+	case alphabet != "":
+		if radix != 0 && radix != utf8.RuneCountInString(alphabet) {
+			return nil, fmt.Errorf("%w: radix %d with %d characters", ErrInvalidAlphabet, radix, utf8.RuneCountInString(alphabet))
+		}
+	case radix == 0:
+		alphabet = DefaultAlphabet[:10]
+	case radix >= 2 && radix <= len(DefaultAlphabet):
+		alphabet = DefaultAlphabet[:radix]
+	default:
+		return nil, fmt.Errorf("%w: radix %d needs an alphabet", ErrInvalidAlphabet, radix)
+	}
+
+	return NewFF1(key, alphabet)
+}
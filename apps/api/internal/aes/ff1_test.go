@@ -0,0 +1,237 @@
+package aes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	ff1Key128 = "2B7E151628AED2A6ABF7158809CF4F3C"
+	ff1Key192 = "2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F"
+	ff1Key256 = "2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F7F036D6F04FC6A94"
+)
+
+func TestFF1NISTSamples(t *testing.T) {
+	t.Parallel()
+
+	// NIST FF1 samples of SP 800-38G.
+	tests := []struct {
+		name       string
+		key        string
+		radix      int
+		tweak      string
+		plaintext  string
+		ciphertext string
+	}{
+		{name: "sample 1", key: ff1Key128, radix: 10, plaintext: "0123456789", ciphertext: "2433477484"},
+		{name: "sample 2", key: ff1Key128, radix: 10, tweak: "39383736353433323130", plaintext: "0123456789", ciphertext: "6124200773"},
+		{name: "sample 3", key: ff1Key128, radix: 36, tweak: "3737373770717273373737", plaintext: "0123456789abcdefghi", ciphertext: "a9tv40mll9kdu509eum"},
+		{name: "sample 4", key: ff1Key192, radix: 10, plaintext: "0123456789", ciphertext: "2830668132"},
+		{name: "sample 5", key: ff1Key192, radix: 10, tweak: "39383736353433323130", plaintext: "0123456789", ciphertext: "2496655549"},
+		{name: "sample 6", key: ff1Key192, radix: 36, tweak: "3737373770717273373737", plaintext: "0123456789abcdefghi", ciphertext: "xbj3kv35jrawxv32ysr"},
+		{name: "sample 7", key: ff1Key256, radix: 10, plaintext: "0123456789", ciphertext: "6657667009"},
+		{name: "sample 8", key: ff1Key256, radix: 10, tweak: "39383736353433323130", plaintext: "0123456789", ciphertext: "1001623463"},
+		{name: "sample 9", key: ff1Key256, radix: 36, tweak: "3737373770717273373737", plaintext: "0123456789abcdefghi", ciphertext: "xs8a0azh2avyalyzuwd"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ff1, err := NewFF1(decodeHex(t, tt.key), DefaultAlphabet[:tt.radix])
+			if err != nil {
+				t.Fatal(err)
+			}
+			tweak := decodeHex(t, tt.tweak)
+
+			got, err := ff1.Encrypt(tt.plaintext, tweak)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.ciphertext {
+				t.Errorf("want: %v got: %v", tt.ciphertext, got)
+			}
+
+			plaintext, err := ff1.Decrypt(tt.ciphertext, tweak)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plaintext != tt.plaintext {
+				t.Errorf("decrypted want: %v got: %v", tt.plaintext, plaintext)
+			}
+		})
+	}
+}
+
+func TestFF1RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	key := decodeHex(t, ff1Key128)
+	tests := []struct {
+		name     string
+		alphabet string
+		msg      string
+	}{
+		{name: "card number", alphabet: DefaultAlphabet[:10], msg: "4111111111111111"},
+		{name: "binary", alphabet: "01", msg: "10110011100011110000"},
+		{name: "odd length hex", alphabet: "0123456789ABCDEF", msg: "DEADBEEF1"},
+		{name: "non ascii alphabet", alphabet: "αβγδεζηθικλμνξοπρστυφχψω", msg: "αβγδεζηθ"},
+		{name: "long", alphabet: DefaultAlphabet, msg: "thequickbrownfoxjumpsoverthelazydog0123456789thequickbrownfoxjumpsoverthelazydog"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ff1, err := NewFF1(key, tt.alphabet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			enc, err := ff1.Encrypt(tt.msg, []byte("customers.card"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len([]rune(enc)) != len([]rune(tt.msg)) || enc == tt.msg {
+				t.Errorf("ciphertext %q of %q", enc, tt.msg)
+			}
+			for _, r := range enc {
+				if _, ok := ff1.index[r]; !ok {
+					t.Errorf("ciphertext %q leaves the alphabet", enc)
+				}
+			}
+
+			other, err := ff1.Encrypt(tt.msg, []byte("customers.phone"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other == enc {
+				t.Errorf("same ciphertext %q under different tweaks", enc)
+			}
+
+			got, err := ff1.Decrypt(enc, []byte("customers.card"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.msg {
+				t.Errorf("want: %v got: %v", tt.msg, got)
+			}
+		})
+	}
+}
+
+func TestFF1Errors(t *testing.T) {
+	t.Parallel()
+
+	key := decodeHex(t, ff1Key128)
+	digits, err := NewFF1(key, DefaultAlphabet[:10])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		fn   func() error
+		err  error
+	}{
+		{name: "one character alphabet", fn: func() error { _, err := NewFF1(key, "0"); return err }, err: ErrInvalidAlphabet},
+		{name: "repeated character", fn: func() error { _, err := NewFF1(key, "0120"); return err }, err: ErrInvalidAlphabet},
+		{name: "invalid key size", fn: func() error { _, err := NewFF1(key[:10], "01"); return err }, err: ErrInvalidKey},
+		{name: "character outside the alphabet", fn: func() error { _, err := digits.Encrypt("01234a6789", nil); return err }, err: ErrInvalidNumeral},
+		// radix^len must be at least a million.
+		{name: "domain too small", fn: func() error { _, err := digits.Encrypt("12345", nil); return err }, err: ErrFF1Length},
+		{name: "smallest domain", fn: func() error { _, err := digits.Encrypt("123456", nil); return err }},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := tt.fn(); !errors.Is(err, tt.err) {
+				t.Errorf("want: %v got: %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestHandleAesFF1(t *testing.T) {
+	t.Parallel()
+
+	key := base64.StdEncoding.EncodeToString(decodeHex(t, ff1Key128))
+	sampleTweak := base64.StdEncoding.EncodeToString(decodeHex(t, "3737373770717273373737"))
+
+	tests := []struct {
+		name string
+		msg  string
+		ff1  ff1Request
+		enc  string
+		code int
+	}{
+		{name: "digits by default", msg: "0123456789", enc: "2433477484", code: http.StatusOK},
+		{name: "radix", msg: "0123456789abcdefghi", ff1: ff1Request{Radix: 36, Tweak: sampleTweak}, enc: "a9tv40mll9kdu509eum", code: http.StatusOK},
+		{name: "alphabet", msg: "0123456789abcdefghi", ff1: ff1Request{Alphabet: DefaultAlphabet, Tweak: sampleTweak}, enc: "a9tv40mll9kdu509eum", code: http.StatusOK},
+		{name: "custom alphabet", msg: "ACGTTGCAACGT", ff1: ff1Request{Alphabet: "ACGT"}, code: http.StatusOK},
+		{name: "radix and alphabet disagree", msg: "0123456789", ff1: ff1Request{Radix: 16, Alphabet: DefaultAlphabet[:10]}, code: http.StatusBadRequest},
+		{name: "radix above 36 without alphabet", msg: "0123456789", ff1: ff1Request{Radix: 62}, code: http.StatusBadRequest},
+		{name: "tweak not base64", msg: "0123456789", ff1: ff1Request{Tweak: "not base64!"}, code: http.StatusBadRequest},
+		{name: "outside the alphabet", msg: "4111-1111", code: http.StatusBadRequest},
+		{name: "too short", msg: "41111", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			body, err := json.Marshal(&ff1EncryptionRequest{Message: tt.msg, AesKeyBase64: key, ff1Request: tt.ff1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", "/aes/ff1/enc", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			HandleAesFF1Encryption()(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("encrypt: wrong response code, want: %v got: %v (%s)", tt.code, w.Code, w.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var enc aesEncryptionResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &enc); err != nil {
+				t.Fatal(err)
+			}
+			if tt.enc != "" && enc.EncMessage != tt.enc {
+				t.Errorf("want: %v got: %v", tt.enc, enc.EncMessage)
+			}
+
+			body, err = json.Marshal(&ff1DecryptionRequest{EncMessage: enc.EncMessage, AesKeyBase64: key, ff1Request: tt.ff1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = httptest.NewRequest("POST", "/aes/ff1/dec", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w = httptest.NewRecorder()
+			HandleAesFF1Decryption()(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("decrypt: wrong response code, want: %v got: %v (%s)", http.StatusOK, w.Code, w.Body)
+			}
+			var res aesDecryptionResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Message != tt.msg {
+				t.Errorf("message want: %q got: %q", tt.msg, res.Message)
+			}
+		})
+	}
+}
@@ -1,21 +1,101 @@
 package aes
 
 import (
+	"encoding/base64"
+	"errors"
 	"ezzy-web-crypto/api/apps/api/internal/apihelper"
 	"ezzy-web-crypto/api/apps/api/internal/jsonutil"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 )
 
 type aesDecryptionRequest struct {
 	EncMessage   string `json:"enc_message"`
 	AesKeyBase64 string `json:"aes"`
+	// AAD is the base64 encoded additional data the message was encrypted
+	// with, if any.
+	AAD string `json:"aad,omitempty"`
+	modeRequest
 }
 
 type aesDecryptionResponse struct {
 	Message string `json:"message"`
 }
 
+type aesEncryptionRequest struct {
+	Message      string `json:"message"`
+	AesKeyBase64 string `json:"aes"`
+	// AAD is base64 encoded additional data, e.g. a user or record ID, that
+	// is authenticated along with the message. Optional.
+	AAD string `json:"aad,omitempty"`
+	modeRequest
+}
+
+type aesEncryptionResponse struct {
+	EncMessage string `json:"enc_message"`
+}
+
+// modeRequest selects the AES mode of an API call. It defaults to AES-GCM.
+type modeRequest struct {
+	Alg string `json:"alg,omitempty"`
+	// MACKey is the base64 encoded HMAC-SHA256 key, mandatory for AES-CBC and
+	// AES-CTR.
+	MACKey string `json:"hmac,omitempty"`
+	// Length is the AES-CTR counter length in bits.
+	Length int `json:"length,omitempty"`
+	// TagLength is the AES-GCM tag length in bits and IVSize the AES-GCM IV
+	// size in bytes; 128 and 12 by default.
+	TagLength int `json:"tag_length,omitempty"`
+	IVSize    int `json:"iv_size,omitempty"`
+	// Format is the AES-GCM ciphertext format: empty for the one of the TS
+	// library or "committing" for the key-committing one.
+	Format string `json:"format,omitempty"`
+}
+
+func (m modeRequest) params() (Params, error) {
+	return parseParams(m.Alg, m.MACKey, m.Length, m.TagLength, m.IVSize, m.Format)
+}
+
+// HandleAesEncryption encrypts a message the way the TS library's
+// encryptStringWithAes does, so decryptStringWithAes can open it.
+func HandleAesEncryption() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var request aesEncryptionRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &request)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		params, err := request.params()
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		encMessage, err := encrypt(params, request.AesKeyBase64, request.Message, request.AAD)
+		if err != nil {
+			message := fmt.Sprintf("error encrypting message: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &aesEncryptionResponse{
+			EncMessage: encMessage,
+		})
+	}
+}
+
 func HandleAesDecryption() http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		var request aesDecryptionRequest
@@ -29,10 +109,349 @@ func HandleAesDecryption() http.HandlerFunc {
 			return
 		}
 
-		plaintext := decrypt(request.AesKeyBase64, request.EncMessage)
+		params, err := request.params()
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		plaintext, err := decrypt(params, request.AesKeyBase64, request.EncMessage, request.AAD)
+		if errors.Is(err, ErrAuthFailed) {
+			jsonutil.MarshalResponse(rw, http.StatusUnprocessableEntity, &apihelper.ErrorResponse{
+				ErrorMessage: "error decrypting message: wrong key or AAD, or tampered message",
+			})
+			return
+		}
+		if err != nil {
+			// Malformed base64, key size, mode parameters, truncated
+			// ciphertexts and padding.
+			message := fmt.Sprintf("error decrypting message: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
 
 		jsonutil.MarshalResponse(rw, http.StatusOK, &aesDecryptionResponse{
 			Message: string(plaintext),
 		})
 	}
 }
+
+type sivEncryptionRequest struct {
+	Message string `json:"message"`
+	// SIVKeyBase64 is the base64 encoded AES-SIV key of 32, 48 or 64 bytes.
+	SIVKeyBase64 string `json:"aes"`
+	AAD          string `json:"aad,omitempty"`
+}
+
+type sivDecryptionRequest struct {
+	EncMessage   string `json:"enc_message"`
+	SIVKeyBase64 string `json:"aes"`
+	AAD          string `json:"aad,omitempty"`
+}
+
+// HandleAesSIVEncryption deterministically encrypts a message with AES-SIV,
+// so that equal messages under the same key and AAD can be looked up by
+// their ciphertext. It is kept apart from HandleAesEncryption on purpose:
+// deterministic encryption reveals equal messages.
+func HandleAesSIVEncryption() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var request sivEncryptionRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &request)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		encMessage, err := encryptSIV(request.SIVKeyBase64, request.Message, request.AAD)
+		if err != nil {
+			message := fmt.Sprintf("error encrypting message: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &aesEncryptionResponse{
+			EncMessage: encMessage,
+		})
+	}
+}
+
+func HandleAesSIVDecryption() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var request sivDecryptionRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &request)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		plaintext, err := decryptSIV(request.SIVKeyBase64, request.EncMessage, request.AAD)
+		if errors.Is(err, ErrAuthFailed) {
+			jsonutil.MarshalResponse(rw, http.StatusUnprocessableEntity, &apihelper.ErrorResponse{
+				ErrorMessage: "error decrypting message: wrong key or AAD, or tampered message",
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error decrypting message: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &aesDecryptionResponse{
+			Message: string(plaintext),
+		})
+	}
+}
+
+type ff1EncryptionRequest struct {
+	Message      string `json:"message"`
+	AesKeyBase64 string `json:"aes"`
+	ff1Request
+}
+
+type ff1DecryptionRequest struct {
+	EncMessage   string `json:"enc_message"`
+	AesKeyBase64 string `json:"aes"`
+	ff1Request
+}
+
+// ff1Request configures FF1. Messages are strings over Alphabet, or over
+// the first Radix characters of DefaultAlphabet; decimal digits by default.
+type ff1Request struct {
+	Radix    int    `json:"radix,omitempty"`
+	Alphabet string `json:"alphabet,omitempty"`
+	// Tweak is base64 encoded and optional.
+	Tweak string `json:"tweak,omitempty"`
+}
+
+func (f ff1Request) ff1(aesBase64 string) (*FF1, []byte, error) {
+	ff1, err := newFF1(aesBase64, f.Radix, f.Alphabet)
+	if err != nil {
+		return nil, nil, err
+	}
+	tweak, err := base64.StdEncoding.DecodeString(f.Tweak)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding tweak: %w", err)
+	}
+
+	return ff1, tweak, nil
+}
+
+// HandleAesFF1Encryption encrypts a message with format-preserving FF1, so
+// that e.g. a card number stays a number of the same length.
+func HandleAesFF1Encryption() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var request ff1EncryptionRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &request)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		ff1, tweak, err := request.ff1(request.AesKeyBase64)
+		var encMessage string
+		if err == nil {
+			encMessage, err = ff1.Encrypt(request.Message, tweak)
+		}
+		if err != nil {
+			message := fmt.Sprintf("error encrypting message: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &aesEncryptionResponse{
+			EncMessage: encMessage,
+		})
+	}
+}
+
+// HandleAesFF1Decryption decrypts a message encrypted with FF1. FF1 is not
+// authenticated: a wrong key or tweak gives a wrong message, not an error.
+func HandleAesFF1Decryption() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var request ff1DecryptionRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &request)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		ff1, tweak, err := request.ff1(request.AesKeyBase64)
+		var plaintext string
+		if err == nil {
+			plaintext, err = ff1.Decrypt(request.EncMessage, tweak)
+		}
+		if err != nil {
+			message := fmt.Sprintf("error decrypting message: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &aesDecryptionResponse{
+			Message: plaintext,
+		})
+	}
+}
+
+// Headers carrying the key and additional data of the streaming endpoints,
+// whose bodies are the raw payload.
+const (
+	streamKeyHeader = "X-Aes-Key" // base64
+	streamAADHeader = "X-Aes-Aad" // base64, optional
+)
+
+// HandleAesStreamEncryption encrypts an application/octet-stream body of any
+// size into the streaming format, one segment at a time. Errors before the
+// first segment is out get a JSON error response; later ones, e.g. a client
+// that stops sending, abort the response like HandleAesStreamDecryption.
+func HandleAesStreamEncryption() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		key, aad, code, err := streamRequest(r)
+		if err != nil {
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		out := newStreamResponse(rw)
+		sw, err := NewStreamWriter(out, key, aad)
+		if err != nil {
+			message := fmt.Sprintf("error encrypting stream: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		_, err = io.Copy(sw, r.Body)
+		if err == nil {
+			err = sw.Close()
+		}
+		if err != nil {
+			out.fail(http.StatusBadRequest, fmt.Sprintf("error encrypting stream: %v", err))
+		}
+	}
+}
+
+// HandleAesStreamDecryption decrypts an application/octet-stream body in the
+// streaming format. Plaintext is sent as segments are authenticated; if a
+// later segment fails, the response is aborted so that clients do not take
+// the partial plaintext for the whole.
+//
+// Aborting panics with http.ErrAbortHandler once the 200 status and some of
+// the body are out: net/http then resets the HTTP/2 stream or closes the
+// HTTP/1 connection without the terminating chunk, and does not log the
+// panic. Clients see a read error, never a clean end of the body, and must
+// discard what they read. Middleware around these handlers must let the
+// panic through rather than recover it into a response.
+func HandleAesStreamDecryption() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		key, aad, code, err := streamRequest(r)
+		if err != nil {
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		out := newStreamResponse(rw)
+		sr, err := NewStreamReader(r.Body, key, aad)
+		if err == nil {
+			_, err = io.Copy(out, sr)
+		}
+		if errors.Is(err, ErrAuthFailed) {
+			out.fail(http.StatusUnprocessableEntity, "error decrypting stream: wrong key or AAD, or tampered stream")
+			return
+		}
+		if err != nil {
+			// Key size, malformed headers and truncated streams.
+			out.fail(http.StatusBadRequest, fmt.Sprintf("error decrypting stream: %v", err))
+		}
+	}
+}
+
+// streamRequest checks the content type of a streaming request and returns its
+// key and additional data, or the status code to fail with.
+func streamRequest(r *http.Request) (key, aad []byte, code int, err error) {
+	if t := r.Header.Get("content-type"); !strings.HasPrefix(t, "application/octet-stream") {
+		return nil, nil, http.StatusUnsupportedMediaType, errors.New("content-type is not application/octet-stream")
+	}
+
+	key, err = base64.StdEncoding.DecodeString(r.Header.Get(streamKeyHeader))
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("error decoding AES key: %w", err)
+	}
+	aad, err = DecodeAAD(r.Header.Get(streamAADHeader))
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+
+	return key, aad, http.StatusOK, nil
+}
+
+// streamResponse writes a streamed octet-stream response.
+type streamResponse struct {
+	rw      http.ResponseWriter
+	started bool
+}
+
+func newStreamResponse(rw http.ResponseWriter) *streamResponse {
+	// HTTP/1 servers discard the unread request body once the response is
+	// written to, but the payload is read while the response streams. HTTP/2
+	// is full duplex anyway and reports ErrNotSupported. EnableFullDuplex
+	// needs Go 1.21, hence the go directive of go.mod.
+	http.NewResponseController(rw).EnableFullDuplex()
+
+	return &streamResponse{rw: rw}
+}
+
+func (s *streamResponse) Write(p []byte) (int, error) {
+	if !s.started {
+		s.rw.Header().Set("content-type", "application/octet-stream")
+		s.started = true
+	}
+
+	return s.rw.Write(p)
+}
+
+// fail sends an error response if nothing was written yet. Otherwise the
+// status is out and the response is aborted by panicking with
+// http.ErrAbortHandler, see HandleAesStreamDecryption.
+func (s *streamResponse) fail(code int, message string) {
+	if s.started {
+		panic(http.ErrAbortHandler)
+	}
+
+	jsonutil.MarshalResponse(s.rw, code, &apihelper.ErrorResponse{
+		ErrorMessage: message,
+	})
+}
@@ -0,0 +1,373 @@
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Alg names an AES mode as WebCrypto does.
+type Alg string
+
+const (
+	AlgGCM Alg = "AES-GCM"
+	AlgCBC Alg = "AES-CBC"
+	AlgCTR Alg = "AES-CTR"
+)
+
+const (
+	// macSize is the size of the HMAC-SHA256 tag appended to AES-CBC and
+	// AES-CTR ciphertexts.
+	macSize = sha256.Size
+	// minMACKeySize is the smallest HMAC key accepted.
+	minMACKeySize = 16
+)
+
+var (
+	ErrUnsupportedAlg       = errors.New("aes: unsupported algorithm, want AES-GCM, AES-CBC or AES-CTR")
+	ErrMACKeyRequired       = errors.New("aes: AES-CBC and AES-CTR need an HMAC key of at least 16 bytes")
+	ErrInvalidCounterLength = errors.New("aes: invalid counter length, want 1 to 128 bits")
+	ErrCounterExhausted     = errors.New("aes: message too long for the counter length")
+	ErrInvalidPadding       = errors.New("aes: invalid padding")
+	ErrInvalidGCMParams     = errors.New("aes: invalid AES-GCM parameters")
+)
+
+const (
+	// minIVSize and maxIVSize bound the AES-GCM IV sizes accepted. Shorter IVs
+	// make random IVs collide too soon; longer ones are hashed down to 12
+	// bytes anyway.
+	minIVSize = 12
+	maxIVSize = 128
+)
+
+// ParseAlg returns the mode named name. An empty name selects AES-GCM.
+func ParseAlg(name string) (Alg, error) {
+	switch alg := Alg(name); alg {
+	case "":
+		return AlgGCM, nil
+	case AlgGCM, AlgCBC, AlgCTR:
+		return alg, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedAlg, name)
+	}
+}
+
+// Params select the mode of EncryptWith and DecryptWith.
+type Params struct {
+	Alg Alg
+	// MACKey authenticates AES-CBC and AES-CTR ciphertexts with HMAC-SHA256.
+	// It is mandatory for them and unused with AES-GCM.
+	MACKey []byte
+	// Length is the number of rightmost bits of the AES-CTR counter block
+	// that are incremented, as in AesCtrParams.length. The remaining bits
+	// stay fixed.
+	Length int
+	// TagLength is the AES-GCM tag length in bits, as in
+	// AesGcmParams.tagLength: 96, 104, 112, 120 or 128, the default.
+	TagLength int
+	// IVSize is the AES-GCM IV size in bytes, 12 by default. IVs of other
+	// sizes require the full 128 bit tag.
+	IVSize int
+	// Format is the AES-GCM ciphertext format. FormatCommitting takes the
+	// default tag length and IV size only.
+	Format Format
+}
+
+// parseParams returns the Params of an API call with the base64 encoded HMAC
+// key macKeyBase64.
+func parseParams(alg, macKeyBase64 string, length, tagLength, ivSize int, format string) (Params, error) {
+	a, err := ParseAlg(alg)
+	if err != nil {
+		return Params{}, err
+	}
+	f, err := ParseFormat(format)
+	if err != nil {
+		return Params{}, err
+	}
+	macKey, err := base64.StdEncoding.DecodeString(macKeyBase64)
+	if err != nil {
+		return Params{}, fmt.Errorf("error decoding HMAC key: %w", err)
+	}
+
+	return Params{Alg: a, MACKey: macKey, Length: length, TagLength: tagLength, IVSize: ivSize, Format: f}, nil
+}
+
+// EncryptWith encrypts data in the mode p selects. AES-GCM output is the one
+// of Encrypt. AES-CBC output is iv || ciphertext || mac with PKCS#7 padding,
+// AES-CTR output counter || ciphertext || mac; the ciphertexts are the ones
+// WebCrypto produces for the same iv or counter. mac is HMAC-SHA256 under
+// p.MACKey of aad || iv || ciphertext || bit length of aad as a 64 bit big
+// endian integer, as RFC 7518 authenticates AES-CBC.
+func EncryptWith(p Params, aesKey, data, aad []byte) ([]byte, error) {
+	if p.Format != FormatDefault {
+		if err := checkCommitting(p); err != nil {
+			return nil, err
+		}
+		return EncryptCommitting(aesKey, data, aad)
+	}
+	if p.Alg == AlgGCM {
+		gcm, err := newGCMWith(p, aesKey)
+		if err != nil {
+			return nil, err
+		}
+		return sealGCM(gcm, rand.Reader, data, aad)
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	return encryptWithIV(p, aesKey, iv, data, aad)
+}
+
+func encryptWithIV(p Params, aesKey, iv, data, aad []byte) ([]byte, error) {
+	block, err := newUnauthenticated(p, aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var ciphertext []byte
+	switch p.Alg {
+	case AlgCBC:
+		ciphertext = pad(data)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+	case AlgCTR:
+		ciphertext = make([]byte, len(data))
+		if err := ctrXOR(block, iv, p.Length, ciphertext, data); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]byte, 0, len(iv)+len(ciphertext)+macSize)
+	out = append(out, iv...)
+	out = append(out, ciphertext...)
+
+	return append(out, mac(p.MACKey, aad, iv, ciphertext)...), nil
+}
+
+// DecryptWith opens data produced by EncryptWith with the same p and aad. The
+// HMAC of AES-CBC and AES-CTR ciphertexts is verified before decrypting; it
+// fails with ErrAuthFailed like a wrong AES-GCM tag.
+func DecryptWith(p Params, aesKey, encData, aad []byte) ([]byte, error) {
+	if p.Format != FormatDefault {
+		if err := checkCommitting(p); err != nil {
+			return nil, err
+		}
+		return DecryptCommitting(aesKey, encData, aad)
+	}
+	if p.Alg == AlgGCM {
+		gcm, err := newGCMWith(p, aesKey)
+		if err != nil {
+			return nil, err
+		}
+		return openGCM(gcm, encData, aad)
+	}
+
+	block, err := newUnauthenticated(p, aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	minSize := aes.BlockSize + macSize
+	if p.Alg == AlgCBC {
+		minSize += aes.BlockSize
+	}
+	if len(encData) < minSize {
+		return nil, fmt.Errorf("%w: got %d bytes, want at least %d", ErrTruncated, len(encData), minSize)
+	}
+	iv := encData[:aes.BlockSize]
+	ciphertext := encData[aes.BlockSize : len(encData)-macSize]
+	tag := encData[len(encData)-macSize:]
+
+	if !hmac.Equal(tag, mac(p.MACKey, aad, iv, ciphertext)) {
+		return nil, ErrAuthFailed
+	}
+
+	switch p.Alg {
+	case AlgCBC:
+		if len(ciphertext)%aes.BlockSize != 0 {
+			return nil, fmt.Errorf("%w: ciphertext is not a multiple of the block size", ErrInvalidPadding)
+		}
+		data := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, ciphertext)
+		return unpad(data)
+	default:
+		data := make([]byte, len(ciphertext))
+		if err := ctrXOR(block, iv, p.Length, data, ciphertext); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+}
+
+// checkCommitting checks p for the committing format.
+func checkCommitting(p Params) error {
+	switch {
+	case p.Format != FormatCommitting:
+		return fmt.Errorf("%w: %q", ErrUnsupportedFormat, p.Format)
+	case p.Alg != AlgGCM:
+		return fmt.Errorf("%w: %s has no committing format", ErrUnsupportedFormat, p.Alg)
+	case p.TagLength != 0 && p.TagLength != 8*tagSize, p.IVSize != 0 && p.IVSize != NonceSize:
+		return fmt.Errorf("%w: the committing format takes a 128 bit tag and a %d byte IV", ErrInvalidGCMParams, NonceSize)
+	}
+
+	return nil
+}
+
+// newGCMWith checks the AES-GCM tag length and IV size of p and returns the
+// AEAD for aesKey. The standard library does not combine a short tag with a
+// non-standard IV size, and neither is it needed by WebCrypto clients.
+func newGCMWith(p Params, aesKey []byte) (cipher.AEAD, error) {
+	tagLength, ivSize := p.TagLength, p.IVSize
+	if tagLength == 0 {
+		tagLength = 8 * tagSize
+	}
+	if ivSize == 0 {
+		ivSize = NonceSize
+	}
+
+	switch tagLength {
+	case 96, 104, 112, 120, 128:
+	default:
+		return nil, fmt.Errorf("%w: tag length of %d bits, want 96, 104, 112, 120 or 128", ErrInvalidGCMParams, tagLength)
+	}
+	if ivSize < minIVSize || ivSize > maxIVSize {
+		return nil, fmt.Errorf("%w: IV of %d bytes, want %d to %d", ErrInvalidGCMParams, ivSize, minIVSize, maxIVSize)
+	}
+	if ivSize != NonceSize && tagLength != 8*tagSize {
+		return nil, fmt.Errorf("%w: tags shorter than 128 bits need a %d byte IV", ErrInvalidGCMParams, NonceSize)
+	}
+
+	c, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: got %d bytes", ErrInvalidKey, len(aesKey))
+	}
+	if ivSize != NonceSize {
+		return cipher.NewGCMWithNonceSize(c, ivSize)
+	}
+
+	return cipher.NewGCMWithTagSize(c, tagLength/8)
+}
+
+// newUnauthenticated checks p for AES-CBC or AES-CTR and returns the block
+// cipher for aesKey.
+func newUnauthenticated(p Params, aesKey []byte) (cipher.Block, error) {
+	if p.TagLength != 0 || p.IVSize != 0 {
+		return nil, fmt.Errorf("%w: tag length and IV size apply to AES-GCM only", ErrInvalidGCMParams)
+	}
+
+	switch p.Alg {
+	case AlgCBC:
+	case AlgCTR:
+		if p.Length < 1 || p.Length > 128 {
+			return nil, fmt.Errorf("%w: got %d", ErrInvalidCounterLength, p.Length)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlg, p.Alg)
+	}
+	if len(p.MACKey) < minMACKeySize {
+		return nil, ErrMACKeyRequired
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: got %d bytes", ErrInvalidKey, len(aesKey))
+	}
+
+	return block, nil
+}
+
+func mac(macKey, aad, iv, ciphertext []byte) []byte {
+	m := hmac.New(sha256.New, macKey)
+	m.Write(aad)
+	m.Write(iv)
+	m.Write(ciphertext)
+	var aadBits [8]byte
+	binary.BigEndian.PutUint64(aadBits[:], uint64(len(aad))*8)
+	m.Write(aadBits[:])
+
+	return m.Sum(nil)
+}
+
+// ctrXOR XORs src with the AES-CTR key stream starting at counter into dst.
+// Only the rightmost length bits of the counter block are incremented and
+// wrap around; a message that would reuse a counter value is refused, as
+// WebCrypto does.
+func ctrXOR(block cipher.Block, counter []byte, length int, dst, src []byte) error {
+	blocks := (len(src) + aes.BlockSize - 1) / aes.BlockSize
+	if length < 64 && uint64(blocks) > uint64(1)<<uint(length) {
+		return fmt.Errorf("%w: %d blocks with a %d bit counter", ErrCounterExhausted, blocks, length)
+	}
+
+	ctr := append([]byte(nil), counter...)
+	stream := make([]byte, aes.BlockSize)
+	for i := 0; i < len(src); i += aes.BlockSize {
+		block.Encrypt(stream, ctr)
+		end := i + aes.BlockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		for j := i; j < end; j++ {
+			dst[j] = src[j] ^ stream[j-i]
+		}
+		incrementCounter(ctr, length)
+	}
+
+	return nil
+}
+
+// incrementCounter adds one to the rightmost length bits of ctr modulo
+// 2^length.
+func incrementCounter(ctr []byte, length int) {
+	for i := len(ctr) - 1; i >= 0 && length > 0; i-- {
+		bits := 8
+		if length < bits {
+			bits = length
+		}
+		mask := byte(1<<uint(bits) - 1)
+		next := (ctr[i]&mask + 1) & mask
+		ctr[i] = ctr[i]&^mask | next
+		if next != 0 {
+			return
+		}
+		length -= bits
+	}
+}
+
+// pad appends PKCS#7 padding to a copy of data.
+func pad(data []byte) []byte {
+	n := aes.BlockSize - len(data)%aes.BlockSize
+	padded := make([]byte, len(data)+n)
+	copy(padded, data)
+	for i := len(data); i < len(padded); i++ {
+		padded[i] = byte(n)
+	}
+
+	return padded
+}
+
+// unpad removes PKCS#7 padding. It only runs on authenticated ciphertexts, so
+// it need not hide where the padding is wrong.
+func unpad(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrInvalidPadding
+	}
+	n := int(data[len(data)-1])
+	if n == 0 || n > aes.BlockSize || n > len(data) {
+		return nil, ErrInvalidPadding
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, ErrInvalidPadding
+		}
+	}
+
+	return data[:len(data)-n], nil
+}
@@ -0,0 +1,357 @@
+package aes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const macKeyBase64 = "VVRXVlFQU1JdXF9eWVhbWkVER0ZBQENCTUxPTklIS0o="
+
+// modeVectors were produced with WebCrypto's AES-CBC and AES-CTR for the
+// ciphertext; the HMAC-SHA256 tag under macKeyBase64 was appended with Node.
+var modeVectors = []struct {
+	name   string
+	alg    Alg
+	key    string
+	iv     string
+	length int
+	msg    string
+	aad    string
+	enc    string
+}{
+	{
+		name: "cbc 256 bit key",
+		alg:  AlgCBC,
+		key:  "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+		iv:   "oKGio6SlpqeoqaqrrK2urw==",
+		msg:  "hello world",
+		enc:  "oKGio6SlpqeoqaqrrK2ur9vmFYiMuoNpvHHUm5y2TZLhaMj8l8ehhU7xJT3vtYmi+ErUHvzOmbhRWAqEzkR8xg==",
+	},
+	{
+		name: "cbc full block padding",
+		alg:  AlgCBC,
+		key:  "8O/u7ezr6uno5+bl5OPi4Q==",
+		iv:   "AAMGCQwPEhUYGx4hJCcqLQ==",
+		msg:  "sixteen byte msg",
+		aad:  "cmVjb3JkOjc=",
+		enc:  "AAMGCQwPEhUYGx4hJCcqLQagIUYHEDet16blS4iL9IHzmQ9WodNMxa6JoE6ZNlT9UqfPyTVJPmokP2wmJ3wnnFRj2tRQvl907wmZZqdWwr0=",
+	},
+	{
+		name:   "ctr 64 bit counter",
+		alg:    AlgCTR,
+		key:    "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+		iv:     "EBESExQVFhcYGRobHB0eHw==",
+		length: 64,
+		msg:    "counter mode across more than two blocks of input",
+		enc:    "EBESExQVFhcYGRobHB0eH4qsmuTGUSHGnRv4sxaGy/yWsji6lvu2hJaG+CIzC0SkSTgeflinhAzFcxDSRVOjcBNYshJocYXHrAEAG6BvXyTi0uyCG4VxGUpY9q/Gj361fA==",
+	},
+	{
+		name:   "ctr counter wraps in 4 bits",
+		alg:    AlgCTR,
+		key:    "AAIEBggKDA4QEhQWGBocHiAiJCYoKiwu",
+		iv:     "zMzMzMzMzMzMzMzMzMzM/g==",
+		length: 4,
+		msg:    "the low nibble wraps from 15 to 0 here",
+		aad:    "dXNlcjo0Mg==",
+		enc:    "zMzMzMzMzMzMzMzMzMzM/lOgaOo2XiYYk5DJ+dZjkjKwW5u699LzJ2EQp+mf+H9IYD9iUuipeju4t1FUFXE2YCk6RDZlsKECWMm5A6xvkv18xklypKA=",
+	},
+}
+
+func TestModeWebCryptoVectors(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range modeVectors {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := Params{Alg: tt.alg, MACKey: decodeBase64(t, macKeyBase64), Length: tt.length}
+			key := decodeBase64(t, tt.key)
+			aad := decodeBase64(t, tt.aad)
+
+			got, err := encryptWithIV(p, key, decodeBase64(t, tt.iv), []byte(tt.msg), aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enc := base64.StdEncoding.EncodeToString(got); enc != tt.enc {
+				t.Errorf("want: %v got: %v", tt.enc, enc)
+			}
+
+			plaintext, err := DecryptWith(p, key, decodeBase64(t, tt.enc), aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != tt.msg {
+				t.Errorf("decrypted want: %q got: %q", tt.msg, plaintext)
+			}
+		})
+	}
+}
+
+// gcmVectors were produced with WebCrypto's AES-GCM and the given tagLength
+// and IV size.
+var gcmVectors = []struct {
+	name      string
+	key       string
+	iv        string
+	tagLength int
+	msg       string
+	aad       string
+	enc       string
+}{
+	{
+		name:      "96 bit tag",
+		key:       "AQgPFh0kKzI5QEdOVVxjanF4f4aNlJuiqbC3vsXM09o=",
+		iv:        "//z59vPw7ern5OHe",
+		tagLength: 96,
+		msg:       "partner message",
+		enc:       "//z59vPw7ern5OHeWN5+14hZ/hdImaAtasG4XA3kpSuiCikyS/JX",
+	},
+	{
+		name:      "104 bit tag",
+		key:       "AQgPFh0kKzI5QEdOVVxjag==",
+		iv:        "//z59vPw7ern5OHe",
+		tagLength: 104,
+		msg:       "hello world",
+		enc:       "//z59vPw7ern5OHekDQ5IDzZAaioQ5dV4kB5IfIvQgSnCm0j",
+	},
+	{
+		name:      "120 bit tag with aad",
+		key:       "AQgPFh0kKzI5QEdOVVxjanF4f4aNlJui",
+		iv:        "//z59vPw7ern5OHe",
+		tagLength: 120,
+		msg:       "hello world",
+		aad:       "cmVjb3JkOjc=",
+		enc:       "//z59vPw7ern5OHe2rwC4fHz8RTRhAMVbseszbM0HM20JZuJEos=",
+	},
+	{
+		name:      "16 byte iv",
+		key:       "AQgPFh0kKzI5QEdOVVxjanF4f4aNlJuiqbC3vsXM09o=",
+		iv:        "//z59vPw7ern5OHe29jV0g==",
+		tagLength: 128,
+		msg:       "cbc sized iv",
+		enc:       "//z59vPw7ern5OHe29jV0hKE4p4u8QF/lzY/WHOZq2bJGctY/3uYyw8kYik=",
+	},
+	{
+		name: "64 byte iv",
+		key:  "AQgPFh0kKzI5QEdOVVxjag==",
+		iv:   "//z59vPw7ern5OHe29jV0s/MycbDwL26t7SxrquopaKfnJmWk5CNioeEgX57eHVyb2xpZmNgXVpXVFFOS0hFQg==",
+		msg:  "long iv",
+		aad:  "dXNlcjo0Mg==",
+		enc:  "//z59vPw7ern5OHe29jV0s/MycbDwL26t7SxrquopaKfnJmWk5CNioeEgX57eHVyb2xpZmNgXVpXVFFOS0hFQgF8X3qcvvZ/Ui1eNNygpe7CC059LQnV",
+	},
+}
+
+func TestGCMWebCryptoVectors(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range gcmVectors {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			iv := decodeBase64(t, tt.iv)
+			p := Params{Alg: AlgGCM, TagLength: tt.tagLength}
+			if len(iv) != NonceSize {
+				p.IVSize = len(iv)
+			}
+			key := decodeBase64(t, tt.key)
+			aad := decodeBase64(t, tt.aad)
+
+			gcm, err := newGCMWith(p, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := gcm.Seal(iv, iv, []byte(tt.msg), aad)
+			if enc := base64.StdEncoding.EncodeToString(got); enc != tt.enc {
+				t.Errorf("want: %v got: %v", tt.enc, enc)
+			}
+
+			plaintext, err := DecryptWith(p, key, decodeBase64(t, tt.enc), aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != tt.msg {
+				t.Errorf("decrypted want: %q got: %q", tt.msg, plaintext)
+			}
+
+			roundTrip, err := EncryptWith(p, key, []byte(tt.msg), aad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := len(got); len(roundTrip) != want {
+				t.Errorf("encrypted length want: %v got: %v", want, len(roundTrip))
+			}
+		})
+	}
+}
+
+func TestIncrementCounter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		ctr    []byte
+		length int
+		want   []byte
+	}{
+		{name: "no carry", ctr: []byte{0xff, 0x01}, length: 16, want: []byte{0xff, 0x02}},
+		{name: "carry", ctr: []byte{0x00, 0xff}, length: 16, want: []byte{0x01, 0x00}},
+		{name: "wraps at length", ctr: []byte{0x00, 0xff}, length: 8, want: []byte{0x00, 0x00}},
+		{name: "partial byte", ctr: []byte{0xab, 0xcf}, length: 4, want: []byte{0xab, 0xc0}},
+		{name: "partial byte carry", ctr: []byte{0xab, 0xff}, length: 12, want: []byte{0xac, 0x00}},
+		{name: "partial byte wraps", ctr: []byte{0xaf, 0xff}, length: 12, want: []byte{0xa0, 0x00}},
+		{name: "whole block wraps", ctr: []byte{0xff, 0xff}, length: 128, want: []byte{0x00, 0x00}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			incrementCounter(tt.ctr, tt.length)
+			if !bytes.Equal(tt.ctr, tt.want) {
+				t.Errorf("want: %x got: %x", tt.want, tt.ctr)
+			}
+		})
+	}
+}
+
+func TestModeErrors(t *testing.T) {
+	t.Parallel()
+
+	key := decodeBase64(t, modeVectors[0].key)
+	macKey := decodeBase64(t, macKeyBase64)
+	cbc := decodeBase64(t, modeVectors[0].enc)
+	tampered := append([]byte(nil), cbc...)
+	tampered[len(tampered)-macSize-1] ^= 1
+
+	// A valid MAC over a ciphertext with broken padding.
+	iv := make([]byte, 16)
+	bad := append(append([]byte(nil), iv...), make([]byte, 16)...)
+	bad = append(bad, mac(macKey, nil, iv, bad[16:])...)
+
+	tests := []struct {
+		name    string
+		p       Params
+		encrypt bool
+		data    []byte
+		err     error
+	}{
+		{name: "unsupported alg", p: Params{Alg: "AES-ECB", MACKey: macKey}, data: cbc, err: ErrUnsupportedAlg},
+		{name: "cbc without hmac key", p: Params{Alg: AlgCBC}, data: cbc, err: ErrMACKeyRequired},
+		{name: "ctr with short hmac key", p: Params{Alg: AlgCTR, MACKey: macKey[:15], Length: 64}, data: cbc, err: ErrMACKeyRequired},
+		{name: "ctr without length", p: Params{Alg: AlgCTR, MACKey: macKey}, data: cbc, err: ErrInvalidCounterLength},
+		{name: "ctr length too large", p: Params{Alg: AlgCTR, MACKey: macKey, Length: 129}, data: cbc, err: ErrInvalidCounterLength},
+		{name: "truncated", p: Params{Alg: AlgCBC, MACKey: macKey}, data: cbc[:16+macSize], err: ErrTruncated},
+		{name: "tampered", p: Params{Alg: AlgCBC, MACKey: macKey}, data: tampered, err: ErrAuthFailed},
+		{name: "wrong hmac key", p: Params{Alg: AlgCBC, MACKey: key}, data: cbc, err: ErrAuthFailed},
+		{name: "ciphertext as ctr", p: Params{Alg: AlgCTR, MACKey: macKey, Length: 64}, data: cbc[:len(cbc)-1], err: ErrAuthFailed},
+		{name: "bad padding", p: Params{Alg: AlgCBC, MACKey: macKey}, data: bad, err: ErrInvalidPadding},
+		{name: "gcm tag too short", p: Params{Alg: AlgGCM, TagLength: 64}, data: cbc, err: ErrInvalidGCMParams},
+		{name: "gcm tag not whole bytes", p: Params{Alg: AlgGCM, TagLength: 100}, data: cbc, err: ErrInvalidGCMParams},
+		{name: "gcm iv too short", p: Params{Alg: AlgGCM, IVSize: 8}, data: cbc, err: ErrInvalidGCMParams},
+		{name: "gcm iv too long", p: Params{Alg: AlgGCM, IVSize: 129}, data: cbc, err: ErrInvalidGCMParams},
+		{name: "gcm short tag with long iv", p: Params{Alg: AlgGCM, TagLength: 96, IVSize: 16}, data: cbc, err: ErrInvalidGCMParams},
+		{name: "gcm truncated with long iv", p: Params{Alg: AlgGCM, IVSize: 64}, data: make([]byte, 64+tagSize-1), err: ErrTruncated},
+		{name: "gcm wrong tag length", p: Params{Alg: AlgGCM, TagLength: 96}, data: cbc, err: ErrAuthFailed},
+		{name: "cbc with tag length", p: Params{Alg: AlgCBC, MACKey: macKey, TagLength: 96}, data: cbc, err: ErrInvalidGCMParams},
+		{name: "counter exhausted", p: Params{Alg: AlgCTR, MACKey: macKey, Length: 1}, encrypt: true, data: make([]byte, 33), err: ErrCounterExhausted},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var err error
+			if tt.encrypt {
+				_, err = EncryptWith(tt.p, key, tt.data, nil)
+			} else {
+				_, err = DecryptWith(tt.p, key, tt.data, nil)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("want: %v got: %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestHandleAesModes(t *testing.T) {
+	t.Parallel()
+
+	key := modeVectors[0].key
+
+	tests := []struct {
+		name string
+		mode modeRequest
+		code int
+	}{
+		{name: "gcm by default", code: http.StatusOK},
+		{name: "cbc", mode: modeRequest{Alg: "AES-CBC", MACKey: macKeyBase64}, code: http.StatusOK},
+		{name: "ctr", mode: modeRequest{Alg: "AES-CTR", MACKey: macKeyBase64, Length: 32}, code: http.StatusOK},
+		{name: "unsupported alg", mode: modeRequest{Alg: "AES-KW"}, code: http.StatusBadRequest},
+		{name: "cbc without hmac key", mode: modeRequest{Alg: "AES-CBC"}, code: http.StatusBadRequest},
+		{name: "hmac key not base64", mode: modeRequest{Alg: "AES-CBC", MACKey: "not base64!"}, code: http.StatusBadRequest},
+		{name: "ctr without length", mode: modeRequest{Alg: "AES-CTR", MACKey: macKeyBase64}, code: http.StatusBadRequest},
+		{name: "gcm 96 bit tag", mode: modeRequest{TagLength: 96}, code: http.StatusOK},
+		{name: "gcm 16 byte iv", mode: modeRequest{Alg: "AES-GCM", IVSize: 16}, code: http.StatusOK},
+		{name: "gcm 32 bit tag", mode: modeRequest{TagLength: 32}, code: http.StatusBadRequest},
+		{name: "gcm short tag with long iv", mode: modeRequest{TagLength: 112, IVSize: 16}, code: http.StatusBadRequest},
+		{name: "committing", mode: modeRequest{Format: "committing"}, code: http.StatusOK},
+		{name: "unknown format", mode: modeRequest{Format: "v2"}, code: http.StatusBadRequest},
+		{name: "committing cbc", mode: modeRequest{Alg: "AES-CBC", MACKey: macKeyBase64, Format: "committing"}, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			body, err := json.Marshal(&aesEncryptionRequest{AesKeyBase64: key, Message: "hello world", modeRequest: tt.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", "/aes/enc", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			HandleAesEncryption()(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("encrypt: wrong response code, want: %v got: %v (%s)", tt.code, w.Code, w.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var enc aesEncryptionResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &enc); err != nil {
+				t.Fatal(err)
+			}
+
+			body, err = json.Marshal(&aesDecryptionRequest{AesKeyBase64: key, EncMessage: enc.EncMessage, modeRequest: tt.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = httptest.NewRequest("POST", "/aes/dec", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w = httptest.NewRecorder()
+			HandleAesDecryption()(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("decrypt: wrong response code, want: %v got: %v (%s)", http.StatusOK, w.Code, w.Body)
+			}
+			var res aesDecryptionResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Message != "hello world" {
+				t.Errorf("message want: %q got: %q", "hello world", res.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// AES-SIV (RFC 5297) is deterministic: the same key, plaintext and additional
+// data always give the same ciphertext. That lets encrypted fields be looked
+// up by equality, at the price of revealing which records are equal. Use it
+// for such fields only; Encrypt is the default for everything else.
+//
+// A ciphertext is the 16 byte synthetic IV followed by the AES-CTR encrypted
+// plaintext, as in the RFC.
+
+// maxSIVAD is the number of additional data components S2V can take next to
+// the plaintext, section 7.
+const maxSIVAD = 126
+
+var (
+	ErrInvalidSIVKey = errors.New("aes: invalid AES-SIV key size, want 32, 48 or 64 bytes")
+	ErrTooManyAD     = errors.New("aes: too many additional data components")
+)
+
+// EncryptSIV deterministically encrypts data under the double length key
+// sivKey with AES-SIV. Every element of ad is a separate component of
+// additional data, in order, e.g. a table and a column name.
+func EncryptSIV(sivKey, data []byte, ad ...[]byte) ([]byte, error) {
+	macBlock, ctrBlock, err := newSIV(sivKey, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, aes.BlockSize+len(data))
+	v := s2v(macBlock, ad, data)
+	copy(out, v)
+	sivCTR(ctrBlock, v, out[aes.BlockSize:], data)
+
+	return out, nil
+}
+
+// DecryptSIV reverses EncryptSIV with the same key and additional data. It
+// fails with ErrAuthFailed if either is wrong or encData was tampered with.
+func DecryptSIV(sivKey, encData []byte, ad ...[]byte) ([]byte, error) {
+	macBlock, ctrBlock, err := newSIV(sivKey, ad)
+	if err != nil {
+		return nil, err
+	}
+	if len(encData) < aes.BlockSize {
+		return nil, fmt.Errorf("%w: got %d bytes, want at least %d", ErrTruncated, len(encData), aes.BlockSize)
+	}
+
+	v := encData[:aes.BlockSize]
+	plaintext := make([]byte, len(encData)-aes.BlockSize)
+	sivCTR(ctrBlock, v, plaintext, encData[aes.BlockSize:])
+
+	if subtle.ConstantTimeCompare(s2v(macBlock, ad, plaintext), v) != 1 {
+		zero(plaintext)
+		return nil, ErrAuthFailed
+	}
+
+	return plaintext, nil
+}
+
+// newSIV splits sivKey into the CMAC key K1 and the AES-CTR key K2, section
+// 2.6.
+func newSIV(sivKey []byte, ad [][]byte) (macBlock, ctrBlock cipher.Block, err error) {
+	switch len(sivKey) {
+	case 32, 48, 64:
+	default:
+		return nil, nil, fmt.Errorf("%w: got %d bytes", ErrInvalidSIVKey, len(sivKey))
+	}
+	if len(ad) > maxSIVAD {
+		return nil, nil, fmt.Errorf("%w: got %d, want at most %d", ErrTooManyAD, len(ad), maxSIVAD)
+	}
+
+	half := len(sivKey) / 2
+	if macBlock, err = aes.NewCipher(sivKey[:half]); err != nil {
+		return nil, nil, err
+	}
+	if ctrBlock, err = aes.NewCipher(sivKey[half:]); err != nil {
+		return nil, nil, err
+	}
+
+	return macBlock, ctrBlock, nil
+}
+
+// s2v is the S2V construction of section 2.4 over the additional data
+// components and the plaintext.
+func s2v(block cipher.Block, ad [][]byte, plaintext []byte) []byte {
+	d := cmac(block, make([]byte, aes.BlockSize))
+	for _, s := range ad {
+		dbl(d)
+		xorBlock(d, cmac(block, s))
+	}
+
+	if len(plaintext) >= aes.BlockSize {
+		// xorend: the last block of the plaintext is XORed with D.
+		t := append([]byte(nil), plaintext...)
+		xorBlock(t[len(t)-aes.BlockSize:], d)
+		return cmac(block, t)
+	}
+
+	dbl(d)
+	t := make([]byte, aes.BlockSize)
+	copy(t, plaintext)
+	t[len(plaintext)] = 0x80
+	xorBlock(d, t)
+
+	return cmac(block, d)
+}
+
+// sivCTR encrypts src into dst with AES-CTR from the synthetic IV v, whose
+// 31st and 63rd bits are cleared, section 2.6.
+func sivCTR(block cipher.Block, v, dst, src []byte) {
+	q := append([]byte(nil), v...)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	cipher.NewCTR(block, q).XORKeyStream(dst, src)
+}
+
+// cmac is AES-CMAC as defined by RFC 4493.
+func cmac(block cipher.Block, msg []byte) []byte {
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+	dbl(k1)
+
+	n := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+	last := make([]byte, aes.BlockSize)
+	if n > 0 && len(msg)%aes.BlockSize == 0 {
+		copy(last, msg[(n-1)*aes.BlockSize:])
+		xorBlock(last, k1)
+	} else {
+		// An incomplete or empty last block is padded and XORed with K2.
+		if n == 0 {
+			n = 1
+		}
+		rest := msg[(n-1)*aes.BlockSize:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		dbl(k1)
+		xorBlock(last, k1)
+	}
+
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < n-1; i++ {
+		xorBlock(x, msg[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		block.Encrypt(x, x)
+	}
+	xorBlock(x, last)
+	block.Encrypt(x, x)
+
+	return x
+}
+
+// dbl multiplies b by x in GF(2^128), in place.
+func dbl(b []byte) {
+	carry := b[0] >> 7
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] = b[len(b)-1]<<1 ^ carry*0x87
+}
+
+func xorBlock(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// sivAD returns the additional data of an API call as S2V components. No AAD
+// is no component rather than an empty one, which S2V tells apart.
+func sivAD(aadBase64 string) ([][]byte, error) {
+	if aadBase64 == "" {
+		return nil, nil
+	}
+	aad, err := DecodeAAD(aadBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]byte{aad}, nil
+}
+
+func encryptSIV(sivBase64, msg, aadBase64 string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(sivBase64)
+	if err != nil {
+		return "", fmt.Errorf("error decoding AES-SIV key: %w", err)
+	}
+	ad, err := sivAD(aadBase64)
+	if err != nil {
+		return "", err
+	}
+
+	encData, err := EncryptSIV(key, []byte(msg), ad...)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(encData), nil
+}
+
+func decryptSIV(sivBase64, encMsgBase64, aadBase64 string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(sivBase64)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding AES-SIV key: %w", err)
+	}
+	encMsg, err := base64.StdEncoding.DecodeString(encMsgBase64)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding message: %w", err)
+	}
+	ad, err := sivAD(aadBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecryptSIV(key, encMsg, ad...)
+}
@@ -0,0 +1,248 @@
+package aes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestCMACRFC4493(t *testing.T) {
+	t.Parallel()
+
+	// RFC 4493, section 4.
+	msg := "6bc1bee22e409f96e93d7e117393172a ae2d8a571e03ac9c9eb76fac45af8e51 30c81c46a35ce411e5fbc1191a0a52ef f69f2445df4f9b17ad2b417be66c3710"
+	tests := []struct {
+		name string
+		size int
+		mac  string
+	}{
+		{name: "example 1 empty", size: 0, mac: "bb1d6929e95937287fa37d129b756746"},
+		{name: "example 2 one block", size: 16, mac: "070a16b46b4d4144f79bdd9dd04a287c"},
+		{name: "example 3 partial block", size: 40, mac: "dfa66747de9ae63030ca32611497c827"},
+		{name: "example 4 four blocks", size: 64, mac: "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+
+	block, err := aes.NewCipher(decodeHex(t, "2b7e151628aed2a6abf7158809cf4f3c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := cmac(block, decodeHex(t, msg)[:tt.size]), decodeHex(t, tt.mac); !bytes.Equal(got, want) {
+				t.Errorf("want: %x got: %x", want, got)
+			}
+		})
+	}
+}
+
+func TestSIVRFC5297(t *testing.T) {
+	t.Parallel()
+
+	// RFC 5297, appendix A.
+	tests := []struct {
+		name      string
+		key       string
+		ad        []string
+		plaintext string
+		output    string
+	}{
+		{
+			name:      "A.1 deterministic authenticated encryption",
+			key:       "fffefdfc fbfaf9f8 f7f6f5f4 f3f2f1f0 f0f1f2f3 f4f5f6f7 f8f9fafb fcfdfeff",
+			ad:        []string{"10111213 14151617 18191a1b 1c1d1e1f 20212223 24252627"},
+			plaintext: "11223344 55667788 99aabbcc ddee",
+			output:    "85632d07 c6e8f37f 950acd32 0a2ecc93 40c02b96 90c4dc04 daef7f6a fe5c",
+		},
+		{
+			name: "A.2 nonce based authenticated encryption",
+			key:  "7f7e7d7c 7b7a7978 77767574 73727170 40414243 44454647 48494a4b 4c4d4e4f",
+			ad: []string{
+				"00112233 44556677 8899aabb ccddeeff deaddada deaddada ffeeddcc bbaa9988 77665544 33221100",
+				"10203040 50607080 90a0",
+				"09f91102 9d74e35b d84156c5 635688c0",
+			},
+			plaintext: "74686973 20697320 736f6d65 20706c61 696e7465 78742074 6f20656e 63727970 74207573 696e6720 5349562d 414553",
+			output:    "7bdb6e3b 432667eb 06f4d14b ff2fbd0f cb900f2f ddbe4043 26601965 c889bf17 dba77ceb 094fa663 b7a3f748 ba8af829 ea64ad54 4a272e9c 485b62a3 fd5c0d",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			key, plaintext, want := decodeHex(t, tt.key), decodeHex(t, tt.plaintext), decodeHex(t, tt.output)
+			var ad [][]byte
+			for _, s := range tt.ad {
+				ad = append(ad, decodeHex(t, s))
+			}
+
+			got, err := EncryptSIV(key, plaintext, ad...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("want: %x got: %x", want, got)
+			}
+
+			decrypted, err := DecryptSIV(key, want, ad...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("decrypted want: %x got: %x", plaintext, decrypted)
+			}
+		})
+	}
+}
+
+func TestSIVErrors(t *testing.T) {
+	t.Parallel()
+
+	key := bytes.Repeat([]byte{7}, 32)
+	enc, err := EncryptSIV(key, []byte("alice@example.com"), []byte("users.email"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), enc...)
+	tampered[len(tampered)-1] ^= 1
+	empty, err := EncryptSIV(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  []byte
+		enc  []byte
+		ad   [][]byte
+		err  error
+	}{
+		{name: "valid", key: key, enc: enc, ad: [][]byte{[]byte("users.email")}},
+		{name: "valid empty plaintext", key: key, enc: empty},
+		{name: "aes-128 key", key: key[:16], enc: enc, ad: [][]byte{[]byte("users.email")}, err: ErrInvalidSIVKey},
+		{name: "truncated", key: key, enc: enc[:15], ad: [][]byte{[]byte("users.email")}, err: ErrTruncated},
+		{name: "tampered", key: key, enc: tampered, ad: [][]byte{[]byte("users.email")}, err: ErrAuthFailed},
+		{name: "wrong key", key: bytes.Repeat([]byte{8}, 32), enc: enc, ad: [][]byte{[]byte("users.email")}, err: ErrAuthFailed},
+		{name: "wrong ad", key: key, enc: enc, ad: [][]byte{[]byte("users.phone")}, err: ErrAuthFailed},
+		{name: "missing ad", key: key, enc: enc, err: ErrAuthFailed},
+		{name: "empty ad is not no ad", key: key, enc: empty, ad: [][]byte{nil}, err: ErrAuthFailed},
+		{name: "too many ad", key: key, enc: enc, ad: make([][]byte, maxSIVAD+1), err: ErrTooManyAD},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			plaintext, err := DecryptSIV(tt.key, tt.enc, tt.ad...)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("want: %v got: %v", tt.err, err)
+			}
+			if err != nil && plaintext != nil {
+				t.Errorf("plaintext want: nil got: %x", plaintext)
+			}
+		})
+	}
+}
+
+func TestHandleAesSIV(t *testing.T) {
+	t.Parallel()
+
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 64))
+	email := base64.StdEncoding.EncodeToString([]byte("users.email"))
+
+	encrypt := func(t *testing.T, req sivEncryptionRequest) (int, string) {
+		body, err := json.Marshal(&req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/aes/siv/enc", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		HandleAesSIVEncryption()(w, r)
+
+		var res aesEncryptionResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, res.EncMessage
+	}
+
+	code, first := encrypt(t, sivEncryptionRequest{Message: "alice@example.com", SIVKeyBase64: key, AAD: email})
+	if code != http.StatusOK {
+		t.Fatalf("wrong response code, want: %v got: %v", http.StatusOK, code)
+	}
+	if _, second := encrypt(t, sivEncryptionRequest{Message: "alice@example.com", SIVKeyBase64: key, AAD: email}); second != first {
+		t.Errorf("not deterministic, want: %v got: %v", first, second)
+	}
+	if code, _ := encrypt(t, sivEncryptionRequest{Message: "alice@example.com", SIVKeyBase64: "c2hvcnQ="}); code != http.StatusBadRequest {
+		t.Errorf("invalid key: wrong response code, want: %v got: %v", http.StatusBadRequest, code)
+	}
+
+	tests := []struct {
+		name       string
+		encMessage string
+		aad        string
+		code       int
+	}{
+		{name: "valid", encMessage: first, aad: email, code: http.StatusOK},
+		{name: "wrong aad", encMessage: first, aad: base64.StdEncoding.EncodeToString([]byte("users.phone")), code: http.StatusUnprocessableEntity},
+		{name: "missing aad", encMessage: first, code: http.StatusUnprocessableEntity},
+		{name: "aad not base64", encMessage: first, aad: "users.email", code: http.StatusBadRequest},
+		{name: "truncated", encMessage: base64.StdEncoding.EncodeToString([]byte("short")), aad: email, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			body, err := json.Marshal(&sivDecryptionRequest{EncMessage: tt.encMessage, SIVKeyBase64: key, AAD: tt.aad})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", "/aes/siv/dec", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			HandleAesSIVDecryption()(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("wrong response code, want: %v got: %v (%s)", tt.code, w.Code, w.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var res aesDecryptionResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Message != "alice@example.com" {
+				t.Errorf("message want: %q got: %q", "alice@example.com", res.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package aes
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The streaming format seals a payload of any length in segments that can be
+// encrypted and decrypted without holding more than one segment in memory,
+// following the STREAM construction of Hoang, Reyhanitabar, Rogaway and
+// Vizár. A stream is
+//
+//	header || segment_0 || ... || segment_n
+//
+// where header is the version byte followed by a random nonce prefix, and
+// every segment is StreamChunkSize bytes of plaintext sealed with AES-GCM
+// except the last one, which may be shorter or empty. The nonce of segment i
+// is
+//
+//	prefix (7 bytes) || i (4 bytes, big endian) || last (1 byte)
+//
+// with last set to 1 for the final segment only, so dropping, reordering or
+// truncating segments fails authentication. Every segment authenticates the
+// header and the additional data of the stream.
+const (
+	// StreamChunkSize is the plaintext size of all but the last segment.
+	StreamChunkSize = 64 * 1024
+
+	streamVersion    = 1
+	streamPrefixSize = 7
+	streamHeaderSize = 1 + streamPrefixSize
+	// maxStreamSegments is the number of segments the 32 bit counter allows.
+	maxStreamSegments = 1<<32 - 1
+)
+
+var (
+	ErrStreamHeader  = errors.New("aes: malformed stream header")
+	ErrStreamTooLong = errors.New("aes: stream exceeds the segment counter")
+)
+
+type streamCipher struct {
+	gcm    cipher.AEAD
+	header []byte
+	aad    []byte
+	nonce  []byte
+	seq    uint64
+}
+
+func newStreamCipher(aesKey, header, aad []byte) (*streamCipher, error) {
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ad := make([]byte, 0, len(header)+len(aad))
+	ad = append(ad, header...)
+	ad = append(ad, aad...)
+
+	nonce := make([]byte, NonceSize)
+	copy(nonce, header[1:])
+
+	return &streamCipher{gcm: gcm, header: header, aad: ad, nonce: nonce}, nil
+}
+
+// next returns the nonce of the next segment.
+func (s *streamCipher) next(last bool) ([]byte, error) {
+	if s.seq >= maxStreamSegments {
+		return nil, ErrStreamTooLong
+	}
+	binary.BigEndian.PutUint32(s.nonce[streamPrefixSize:], uint32(s.seq))
+	s.nonce[NonceSize-1] = 0
+	if last {
+		s.nonce[NonceSize-1] = 1
+	}
+	s.seq++
+
+	return s.nonce, nil
+}
+
+// StreamWriter encrypts everything written to it into the streaming format.
+// Close must be called to write the final segment.
+type StreamWriter struct {
+	w      io.Writer
+	s      *streamCipher
+	buf    []byte
+	out    []byte
+	err    error
+	closed bool
+}
+
+// NewStreamWriter returns a StreamWriter that writes the stream encrypted
+// under aesKey with the additional data aad to w. The header is written on
+// the first Write or Close.
+func NewStreamWriter(w io.Writer, aesKey, aad []byte) (*StreamWriter, error) {
+	header := make([]byte, streamHeaderSize)
+	header[0] = streamVersion
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, err
+	}
+
+	s, err := newStreamCipher(aesKey, header, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamWriter{
+		w:   w,
+		s:   s,
+		buf: make([]byte, 0, StreamChunkSize),
+		out: make([]byte, 0, StreamChunkSize+tagSize),
+	}, nil
+}
+
+// Write buffers p and writes every segment known not to be the last one.
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errors.New("aes: write to closed stream")
+	}
+	if sw.err != nil {
+		return 0, sw.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// A full segment is sealed only once more data follows, as the final
+		// segment is marked as such.
+		if len(sw.buf) == StreamChunkSize {
+			if sw.err = sw.seal(false); sw.err != nil {
+				return n, sw.err
+			}
+		}
+		m := copy(sw.buf[len(sw.buf):StreamChunkSize], p)
+		sw.buf = sw.buf[:len(sw.buf)+m]
+		p = p[m:]
+		n += m
+	}
+
+	return n, nil
+}
+
+// Close writes the final segment. It does not close the underlying writer.
+func (sw *StreamWriter) Close() error {
+	if sw.closed {
+		return sw.err
+	}
+	sw.closed = true
+	if sw.err != nil {
+		return sw.err
+	}
+
+	sw.err = sw.seal(true)
+	zero(sw.buf[:cap(sw.buf)])
+
+	return sw.err
+}
+
+func (sw *StreamWriter) seal(last bool) error {
+	if sw.s.seq == 0 {
+		if _, err := sw.w.Write(sw.s.header); err != nil {
+			return err
+		}
+	}
+
+	nonce, err := sw.s.next(last)
+	if err != nil {
+		return err
+	}
+	sw.out = sw.s.gcm.Seal(sw.out[:0], nonce, sw.buf, sw.s.aad)
+	sw.buf = sw.buf[:0]
+
+	_, err = sw.w.Write(sw.out)
+	return err
+}
+
+// StreamReader decrypts a stream written by StreamWriter. Read only returns
+// plaintext of segments that were authenticated; it fails with ErrAuthFailed
+// if a segment was tampered with, reordered or the key or additional data are
+// wrong, and with ErrTruncated if the stream ends before its final segment.
+type StreamReader struct {
+	r     *bufio.Reader
+	s     *streamCipher
+	in    []byte
+	plain []byte
+	done  bool
+	err   error
+}
+
+// NewStreamReader reads the stream header from r and returns a StreamReader
+// that decrypts the stream with aesKey and the additional data aad.
+func NewStreamReader(r io.Reader, aesKey, aad []byte) (*StreamReader, error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: stream header", ErrTruncated)
+		}
+		return nil, err
+	}
+	if header[0] != streamVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrStreamHeader, header[0])
+	}
+
+	s, err := newStreamCipher(aesKey, header, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamReader{
+		r:  bufio.NewReaderSize(r, StreamChunkSize+tagSize+1),
+		s:  s,
+		in: make([]byte, StreamChunkSize+tagSize),
+	}, nil
+}
+
+// Read reads decrypted plaintext into p.
+func (sr *StreamReader) Read(p []byte) (int, error) {
+	for len(sr.plain) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		if sr.done {
+			return 0, io.EOF
+		}
+		sr.err = sr.open()
+	}
+
+	n := copy(p, sr.plain)
+	sr.plain = sr.plain[n:]
+
+	return n, nil
+}
+
+// open reads and opens the next segment. A segment is the last one if the
+// stream ends after it.
+func (sr *StreamReader) open() error {
+	n, err := io.ReadFull(sr.r, sr.in)
+	switch {
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("%w: missing final segment", ErrTruncated)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		sr.done = true
+	case err != nil:
+		return err
+	default:
+		if _, err := sr.r.Peek(1); errors.Is(err, io.EOF) {
+			sr.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < tagSize {
+		return fmt.Errorf("%w: segment of %d bytes", ErrTruncated, n)
+	}
+
+	nonce, err := sr.s.next(sr.done)
+	if err != nil {
+		return err
+	}
+	plain, err := sr.s.gcm.Open(sr.in[:0], nonce, sr.in[:n], sr.s.aad)
+	if err != nil {
+		return ErrAuthFailed
+	}
+	sr.plain = plain
+
+	return nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,240 @@
+package aes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func encryptStream(t *testing.T, key, aad, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	sw, err := NewStreamWriter(&buf, key, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd sized writes cross segment boundaries.
+	if _, err := io.CopyBuffer(sw, bytes.NewReader(data), make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func decryptStream(key, aad, stream []byte) ([]byte, error) {
+	sr, err := NewStreamReader(iotest.HalfReader(bytes.NewReader(stream)), key, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(sr)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	key := randomBytes(t, 32)
+
+	tests := []struct {
+		name     string
+		size     int
+		segments int
+	}{
+		{name: "empty", size: 0, segments: 1},
+		{name: "one byte", size: 1, segments: 1},
+		{name: "one short of a segment", size: StreamChunkSize - 1, segments: 1},
+		{name: "one segment", size: StreamChunkSize, segments: 1},
+		{name: "one byte over a segment", size: StreamChunkSize + 1, segments: 2},
+		{name: "several segments", size: 3*StreamChunkSize + 5, segments: 4},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			data := randomBytes(t, tt.size)
+			stream := encryptStream(t, key, []byte("file:1"), data)
+
+			if want := streamHeaderSize + tt.size + tt.segments*tagSize; len(stream) != want {
+				t.Errorf("stream length want: %v got: %v", want, len(stream))
+			}
+
+			got, err := decryptStream(key, []byte("file:1"), stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decrypted %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	t.Parallel()
+
+	key := randomBytes(t, 16)
+	data := randomBytes(t, 2*StreamChunkSize+10)
+	stream := encryptStream(t, key, nil, data)
+	segment := StreamChunkSize + tagSize
+	first := stream[streamHeaderSize : streamHeaderSize+segment]
+	second := stream[streamHeaderSize+segment : streamHeaderSize+2*segment]
+
+	tampered := append([]byte(nil), stream...)
+	tampered[streamHeaderSize+segment+100] ^= 1
+	reordered := append(append(append([]byte(nil), stream[:streamHeaderSize]...), second...), first...)
+	reordered = append(reordered, stream[streamHeaderSize+2*segment:]...)
+	badVersion := append([]byte(nil), stream...)
+	badVersion[0] = 2
+	otherPrefix := append([]byte(nil), stream...)
+	otherPrefix[1] ^= 1
+
+	tests := []struct {
+		name   string
+		key    []byte
+		aad    []byte
+		stream []byte
+		err    error
+	}{
+		{name: "invalid key size", key: key[:10], stream: stream, err: ErrInvalidKey},
+		{name: "wrong key", key: randomBytes(t, 16), stream: stream, err: ErrAuthFailed},
+		{name: "unexpected aad", key: key, aad: []byte("file:2"), stream: stream, err: ErrAuthFailed},
+		{name: "tampered segment", key: key, stream: tampered, err: ErrAuthFailed},
+		{name: "reordered segments", key: key, stream: reordered, err: ErrAuthFailed},
+		{name: "final segment dropped", key: key, stream: stream[:streamHeaderSize+2*segment], err: ErrAuthFailed},
+		{name: "truncated within a segment", key: key, stream: stream[:streamHeaderSize+segment+100], err: ErrAuthFailed},
+		{name: "truncated tag", key: key, stream: stream[:len(stream)-(10+tagSize)+5], err: ErrTruncated},
+		{name: "header only", key: key, stream: stream[:streamHeaderSize], err: ErrTruncated},
+		{name: "truncated header", key: key, stream: stream[:3], err: ErrTruncated},
+		{name: "unsupported version", key: key, stream: badVersion, err: ErrStreamHeader},
+		{name: "header tampered", key: key, stream: otherPrefix, err: ErrAuthFailed},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := decryptStream(tt.key, tt.aad, tt.stream)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("want: %v got: %v", tt.err, err)
+			}
+			// Only authenticated segments are released.
+			if len(got)%StreamChunkSize != 0 || !bytes.Equal(got, data[:len(got)]) {
+				t.Errorf("released %d bytes of unauthenticated plaintext", len(got))
+			}
+		})
+	}
+}
+
+func TestHandleAesStream(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.Handle("/aes/stream/enc", HandleAesStreamEncryption())
+	mux.Handle("/aes/stream/dec", HandleAesStreamDecryption())
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	key := "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	post := func(t *testing.T, path, key string, body io.Reader) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest("POST", srv.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set(streamKeyHeader, key)
+		req.Header.Set(streamAADHeader, "ZmlsZTox")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Far beyond the 64 KB limit of JSON bodies, streamed without a
+	// Content-Length.
+	data := randomBytes(t, 1<<20+123)
+	res := post(t, "/aes/stream/enc", key, ioutil.NopCloser(bytes.NewReader(data)))
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("encrypt: wrong response code, want: %v got: %v", http.StatusOK, res.StatusCode)
+	}
+	stream, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res = post(t, "/aes/stream/dec", key, bytes.NewReader(stream))
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("decrypt: wrong response code, want: %v got: %v", http.StatusOK, res.StatusCode)
+	}
+	if got, err := ioutil.ReadAll(res.Body); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decrypted %d bytes want: %d (%v)", len(got), len(data), err)
+	}
+
+	t.Run("tampered first segment", func(t *testing.T) {
+		tampered := append([]byte(nil), stream...)
+		tampered[streamHeaderSize] ^= 1
+		res := post(t, "/aes/stream/dec", key, bytes.NewReader(tampered))
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("wrong response code, want: %v got: %v", http.StatusUnprocessableEntity, res.StatusCode)
+		}
+	})
+
+	t.Run("truncated stream aborts the response", func(t *testing.T) {
+		res := post(t, "/aes/stream/dec", key, bytes.NewReader(stream[:len(stream)-1]))
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("wrong response code, want: %v got: %v", http.StatusOK, res.StatusCode)
+		}
+		if got, err := ioutil.ReadAll(res.Body); err == nil {
+			t.Errorf("read %d bytes of an aborted response without error", len(got))
+		}
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		res := post(t, "/aes/stream/enc", "c2hvcnQ=", strings.NewReader("data"))
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("wrong response code, want: %v got: %v", http.StatusBadRequest, res.StatusCode)
+		}
+	})
+
+	t.Run("json content type", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/aes/stream/enc", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		HandleAesStreamEncryption()(w, req)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("wrong response code, want: %v got: %v", http.StatusUnsupportedMediaType, w.Code)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package apihelper
+
+import (
+	"crypto/subtle"
+	"ezzy-web-crypto/api/apps/api/internal/jsonutil"
+	"net/http"
+	"strings"
+)
+
+// RequireBearerToken rejects requests that do not present token in an
+// "Authorization: Bearer" header.
+func RequireBearerToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			got, ok := BearerToken(r)
+			if token == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				jsonutil.MarshalResponse(rw, http.StatusUnauthorized, &ErrorResponse{
+					ErrorMessage: "error missing or invalid bearer token",
+				})
+				return
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header.
+func BearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth {
+		return "", false
+	}
+
+	return token, true
+}
@@ -0,0 +1,27 @@
+package apihelper
+
+import (
+	"context"
+	"net/http"
+)
+
+type pathPrefixKey struct{}
+
+// WithPathPrefix records that the handlers of a request are mounted below
+// prefix, which was stripped from the request path.
+func WithPathPrefix(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, pathPrefixKey{}, PathPrefixFrom(ctx)+prefix)
+}
+
+// PathPrefixFrom returns the prefix recorded by WithPathPrefix, or "" for
+// handlers mounted at the root.
+func PathPrefixFrom(ctx context.Context) string {
+	prefix, _ := ctx.Value(pathPrefixKey{}).(string)
+	return prefix
+}
+
+// URLPath returns path, absolute from the root of the handlers of r, as a
+// path a client can request, e.g. for a Location header.
+func URLPath(r *http.Request, path string) string {
+	return PathPrefixFrom(r.Context()) + path
+}
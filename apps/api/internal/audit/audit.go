@@ -0,0 +1,321 @@
+// Package audit writes a tamper-evident log of key operations. Every event is
+// a JSON line holding the SHA-256 hash of the previous event, so editing,
+// reordering or deleting an event breaks the chain, which Verify detects. The
+// first event has sequence number 1 and no previous hash, so deleting events
+// from the start is detected too.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Operations recorded in the log.
+const (
+	OpKeyGenerate  = "key.generate"
+	OpKeyActivate  = "key.activate"
+	OpKeyRotate    = "key.rotate"
+	OpKeyImport    = "key.import"
+	OpKeyExport    = "key.export"
+	OpKeyRestore   = "key.restore"
+	OpKeyRetire    = "key.retire"
+	OpKeyRevoke    = "key.revoke"
+	OpKeyDestroy   = "key.destroy"
+	OpKeyDecrypt   = "key.decrypt"
+	OpKeyUnwrap    = "key.unwrap"
+	OpTenantCreate = "tenant.create"
+	OpTenantDelete = "tenant.delete"
+	OpSealInit     = "seal.init"
+	OpUnseal       = "seal.unseal"
+	OpSeal         = "seal.seal"
+	// OpAuditRecover records that Open dropped an event torn by a crash.
+	OpAuditRecover = "audit.recover"
+)
+
+// Outcomes of an operation.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Event is an entry of the audit log.
+type Event struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Kid     string    `json:"kid,omitempty"`
+	Caller  string    `json:"caller"`
+	Remote  string    `json:"remote,omitempty"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+	// Detail adds operation specific information, e.g. a revocation reason.
+	Detail string `json:"detail,omitempty"`
+	// Prev is the hash of the previous event, empty for the first one.
+	Prev string `json:"prev"`
+	// Hash is the hex encoded SHA-256 hash of the event without Hash.
+	Hash string `json:"hash"`
+}
+
+// Recorder records events. Implementations fill in the chain fields and the
+// caller stored in ctx.
+type Recorder interface {
+	Record(ctx context.Context, ev Event) error
+}
+
+// Caller identifies who triggered an operation.
+type Caller struct {
+	// ID is e.g. "admin", "tenant:acme" or "anonymous".
+	ID string
+	// Remote is the network address of the client, if any.
+	Remote string
+}
+
+type callerKey struct{}
+
+// WithCaller returns a context carrying caller.
+func WithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFrom returns the caller stored in ctx. Its ID is "unknown" if there is
+// none.
+func CallerFrom(ctx context.Context) Caller {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	if !ok || caller.ID == "" {
+		caller.ID = "unknown"
+	}
+
+	return caller
+}
+
+// WithCallerID returns a context whose caller has the given ID and the remote
+// address of the caller in ctx.
+func WithCallerID(ctx context.Context, id string) context.Context {
+	caller, _ := ctx.Value(callerKey{}).(Caller)
+	caller.ID = id
+
+	return WithCaller(ctx, caller)
+}
+
+// Middleware stores an anonymous caller with the remote address of the
+// request in the request context. Later handlers identify the caller with
+// WithCallerID or Identify.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx := WithCaller(r.Context(), Caller{ID: "anonymous", Remote: r.RemoteAddr})
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// Identify returns a middleware identifying the caller as id, e.g. after
+// authentication.
+func Identify(id string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(rw, r.WithContext(WithCallerID(r.Context(), id)))
+		})
+	}
+}
+
+// System returns a context for operations the server starts by itself, such
+// as scheduled rotations.
+func System(name string) context.Context {
+	return WithCaller(context.Background(), Caller{ID: "system:" + name})
+}
+
+// Log appends events to a file. It is safe for concurrent use.
+type Log struct {
+	now func() time.Time
+
+	mu   sync.Mutex
+	f    *os.File
+	seq  int64
+	prev string
+}
+
+// Open opens the audit log at path for appending, creating it if needed. The
+// chain continues from the last event in the file.
+//
+// A crash while an event is written can leave a partial last line. Open
+// truncates it and records an OpAuditRecover event in its place, so the
+// server starts and the loss shows in the log. Malformed lines anywhere else
+// are not the work of a crash and make Open fail.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{now: time.Now, f: f}
+
+	tail, err := readTail(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit: error reading %s: %w", path, err)
+	}
+	if tail.last != nil {
+		l.seq = tail.last.Seq
+		l.prev = tail.last.Hash
+	}
+
+	switch {
+	case tail.torn > 0:
+		if err := f.Truncate(tail.end); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("audit: error truncating torn event of %s: %w", path, err)
+		}
+		err := l.Record(System("audit"), Event{
+			Op:      OpAuditRecover,
+			Outcome: OutcomeFailure,
+			Detail:  fmt.Sprintf("dropped %d bytes of an event torn after seq %d", tail.torn, l.seq),
+		})
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	case tail.unterminated:
+		// The last event is whole but its newline did not make it.
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("audit: error reading %s: %w", path, err)
+		}
+	}
+
+	return l, nil
+}
+
+// Record appends ev with the caller of ctx and the chain fields filled in.
+func (l *Log) Record(ctx context.Context, ev Event) error {
+	caller := CallerFrom(ctx)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ev.Seq = l.seq + 1
+	ev.Time = l.now().UTC()
+	ev.Caller = caller.ID
+	ev.Remote = caller.Remote
+	ev.Prev = l.prev
+	if ev.Outcome == "" {
+		ev.Outcome = OutcomeSuccess
+	}
+
+	hash, err := eventHash(&ev)
+	if err != nil {
+		return err
+	}
+	ev.Hash = hash
+
+	line, err := json.Marshal(&ev)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("audit: error writing event: %w", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("audit: error writing event: %w", err)
+	}
+
+	l.seq = ev.Seq
+	l.prev = ev.Hash
+
+	return nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
+
+// eventHash returns the hash of ev without its Hash field.
+func eventHash(ev *Event) (string, error) {
+	unhashed := *ev
+	unhashed.Hash = ""
+
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// logTail describes the end of a log file.
+type logTail struct {
+	// last is the last whole event, nil if there is none.
+	last *Event
+	// end is the offset after last.
+	end int64
+	// torn is the size of a partial event after last.
+	torn int64
+	// unterminated is set if last is not followed by a newline.
+	unterminated bool
+}
+
+// readTail reads the log r to its end. The chain is not verified. Only the
+// last line may be partial, as Record writes whole lines.
+func readTail(r io.Reader) (logTail, error) {
+	var tail logTail
+
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := readLine(br)
+		if err == io.EOF && len(data) == 0 {
+			return tail, nil
+		}
+		if err != nil && err != io.EOF {
+			return tail, err
+		}
+
+		var ev Event
+		if jsonErr := json.Unmarshal(bytes.TrimSuffix(data, []byte{'\n'}), &ev); jsonErr != nil {
+			if err == io.EOF {
+				tail.torn = int64(len(data))
+				return tail, nil
+			}
+			return tail, fmt.Errorf("malformed event at line %d", line)
+		}
+		tail.last = &ev
+		tail.end += int64(len(data))
+		if err == io.EOF {
+			tail.unterminated = true
+			return tail, nil
+		}
+	}
+}
+
+// readLine reads a line including its newline, which is missing at the end of
+// r. It returns io.EOF with the partial last line, if any.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLineBytes {
+			return nil, errors.New("event too long")
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// maxLineBytes bounds the size of a single event.
+const maxLineBytes = 1 << 20
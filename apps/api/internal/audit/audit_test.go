@@ -0,0 +1,253 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestLog(t *testing.T, path string, n int) {
+	t.Helper()
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx := WithCaller(context.Background(), Caller{ID: "tenant:acme", Remote: "192.0.2.1:1234"})
+	for i := 0; i < n; i++ {
+		if err := l.Record(ctx, Event{Op: OpKeyDecrypt, Kid: "kid"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestLogChain(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestLog(t, path, 2)
+	// Reopening continues the chain.
+	writeTestLog(t, path, 1)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, last, err := Verify(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("events want: %v got: %v", 3, n)
+	}
+
+	tail, err := readTail(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := tail.last
+	if ev.Hash != last || ev.Seq != 3 {
+		t.Errorf("last event want: seq 3 hash %v got: seq %v hash %v", last, ev.Seq, ev.Hash)
+	}
+	if ev.Caller != "tenant:acme" || ev.Remote != "192.0.2.1:1234" || ev.Outcome != OutcomeSuccess {
+		t.Errorf("event want: caller tenant:acme, remote 192.0.2.1:1234, outcome success got: %+v", ev)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestLog(t, path, 3)
+	lines := readLines(t, path)
+
+	tests := []struct {
+		name  string
+		lines []string
+		line  int
+	}{
+		{"edited", []string{lines[0], strings.Replace(lines[1], `"kid":"kid"`, `"kid":"other"`, 1), lines[2]}, 2},
+		{"deleted", []string{lines[0], lines[2]}, 2},
+		{"reordered", []string{lines[0], lines[2], lines[1]}, 2},
+		{"malformed", []string{lines[0], "{\n"}, 2},
+		{"first deleted", []string{lines[1], lines[2]}, 1},
+		{"start cut off", []string{lines[2]}, 1},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, _, err := Verify(strings.NewReader(strings.Join(tt.lines, "")))
+
+			var verr *VerifyError
+			if !errors.As(err, &verr) {
+				t.Fatalf("verify want: %T got: %v", verr, err)
+			}
+			if verr.Line != tt.line {
+				t.Errorf("broken line want: %v got: %v", tt.line, verr.Line)
+			}
+		})
+	}
+}
+
+func TestVerifyFrom(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestLog(t, path, 3)
+	lines := readLines(t, path)
+
+	_, hash, err := Verify(strings.NewReader(lines[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := VerifyFrom(strings.NewReader(lines[1]+lines[2]), Anchor{Seq: 1, Hash: hash})
+	if err != nil || n != 2 {
+		t.Errorf("verify from anchor want: 2 events got: %v, %v", n, err)
+	}
+
+	var verr *VerifyError
+	if _, _, err := VerifyFrom(strings.NewReader(lines[2]), Anchor{Seq: 1, Hash: hash}); !errors.As(err, &verr) {
+		t.Errorf("verify with events after the anchor cut off want: %T got: %v", verr, err)
+	}
+}
+
+func TestVerifyRange(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestLog(t, path, 3)
+	lines := readLines(t, path)
+
+	_, first, err := Verify(strings.NewReader(lines[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, head, err := Verify(strings.NewReader(lines[0] + lines[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := strings.Join(lines, "")
+	broken := func(err error) bool {
+		var verr *VerifyError
+		return errors.As(err, &verr)
+	}
+
+	tests := []struct {
+		name  string
+		log   string
+		at    Anchor
+		to    Anchor
+		check func(err error) bool
+	}{
+		{"grown", all, Anchor{}, Anchor{Seq: 2, Hash: head}, func(err error) bool { return err == nil }},
+		{"from anchor", lines[1] + lines[2], Anchor{Seq: 1, Hash: first}, Anchor{Seq: 2, Hash: head}, func(err error) bool { return err == nil }},
+		{"end deleted", lines[0], Anchor{}, Anchor{Seq: 2, Hash: head}, func(err error) bool { return errors.Is(err, ErrTruncated) }},
+		{"emptied", "", Anchor{}, Anchor{Seq: 2, Hash: head}, func(err error) bool { return errors.Is(err, ErrTruncated) }},
+		{"other head", all, Anchor{}, Anchor{Seq: 2, Hash: first}, broken},
+		{"head before start", lines[2], Anchor{Seq: 2, Hash: head}, Anchor{Seq: 1, Hash: first}, func(err error) bool { return err != nil }},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, _, err := VerifyRange(strings.NewReader(tt.log), tt.at, tt.to); !tt.check(err) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenTornTail(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		tail func(line string) string
+		// recovered is set if the third event is replaced by a recovery
+		// event.
+		recovered bool
+	}{
+		{name: "torn event", tail: func(line string) string { return line[:len(line)/2] }, recovered: true},
+		{name: "missing newline", tail: func(line string) string { return strings.TrimSuffix(line, "\n") }},
+		{name: "intact", tail: func(line string) string { return line }},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "audit.log")
+			writeTestLog(t, path, 3)
+			lines := readLines(t, path)
+			data := strings.Join(lines[:2], "") + tt.tail(lines[2])
+			if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			writeTestLog(t, path, 1)
+
+			lines = readLines(t, path)
+			n, _, err := Verify(strings.NewReader(strings.Join(lines, "")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 4 {
+				t.Errorf("events want: %v got: %v", 4, n)
+			}
+			if recovered := strings.Contains(lines[2], OpAuditRecover); recovered != tt.recovered {
+				t.Errorf("event 3 recovered want: %v got: %v", tt.recovered, lines[2])
+			}
+		})
+	}
+}
+
+func TestOpenMalformed(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestLog(t, path, 2)
+	lines := readLines(t, path)
+	if err := ioutil.WriteFile(path, []byte("{\n"+lines[1]), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path); err == nil {
+		t.Errorf("open with a malformed event before the last want: error got: nil")
+	}
+}
+
+func TestCallerFrom(t *testing.T) {
+	t.Parallel()
+
+	if got := CallerFrom(context.Background()).ID; got != "unknown" {
+		t.Errorf("caller without context want: %v got: %v", "unknown", got)
+	}
+
+	ctx := WithCaller(context.Background(), Caller{ID: "anonymous", Remote: "192.0.2.1:1234"})
+	got := CallerFrom(WithCallerID(ctx, "admin"))
+	if want := (Caller{ID: "admin", Remote: "192.0.2.1:1234"}); got != want {
+		t.Errorf("caller want: %+v got: %+v", want, got)
+	}
+}
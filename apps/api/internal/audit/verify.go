@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrTruncated reports a log that ends before the event it must reach.
+var ErrTruncated = errors.New("audit: log ends before the expected event")
+
+// VerifyError reports the first event that breaks the chain.
+type VerifyError struct {
+	// Line is the 1-based line number of the event.
+	Line   int
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("audit: chain broken at line %d: %s", e.Line, e.Reason)
+}
+
+// Anchor is a point of the chain, the sequence number and hash of an event,
+// that a log is verified against. The zero Anchor is the start of the chain.
+type Anchor struct {
+	Seq  int64
+	Hash string
+}
+
+// Verify checks the hash chain of the audit log read from r, which must start
+// with the first event ever recorded, so that events cut off the start are
+// detected as well. It returns the number of events and the hash of the last
+// one, which operators can record elsewhere to also detect truncation of the
+// end of the log.
+func Verify(r io.Reader) (int, string, error) {
+	return VerifyFrom(r, Anchor{})
+}
+
+// VerifyFrom is Verify for a log whose first event follows the event at, e.g.
+// the part of a log recorded after an earlier run of Verify returned the
+// hash of the event at.Seq.
+func VerifyFrom(r io.Reader, at Anchor) (int, string, error) {
+	return VerifyRange(r, at, Anchor{})
+}
+
+// VerifyRange is VerifyFrom for a log that must also contain the event to,
+// e.g. the last event reported by an earlier run, so that events deleted from
+// the end of the log are detected. The zero Anchor expects no event.
+func VerifyRange(r io.Reader, at, to Anchor) (int, string, error) {
+	if to.Seq != 0 && to.Seq < at.Seq {
+		return 0, at.Hash, fmt.Errorf("audit: expected event %d precedes the start at %d", to.Seq, at.Seq)
+	}
+	if to.Seq != 0 && to.Seq == at.Seq && to.Hash != at.Hash {
+		return 0, at.Hash, fmt.Errorf("audit: expected event %d does not match the start", to.Seq)
+	}
+
+	var (
+		n    int
+		prev = at.Hash
+		seq  = at.Seq
+	)
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+	for s.Scan() {
+		n++
+
+		var ev Event
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+			return n - 1, prev, &VerifyError{Line: n, Reason: "malformed event"}
+		}
+		if ev.Seq != seq+1 {
+			return n - 1, prev, &VerifyError{Line: n, Reason: fmt.Sprintf("sequence %d follows %d", ev.Seq, seq)}
+		}
+		if ev.Prev != prev {
+			return n - 1, prev, &VerifyError{Line: n, Reason: "previous hash does not match"}
+		}
+
+		hash, err := eventHash(&ev)
+		if err != nil {
+			return n - 1, prev, err
+		}
+		if hash != ev.Hash {
+			return n - 1, prev, &VerifyError{Line: n, Reason: "event hash does not match"}
+		}
+		if ev.Seq == to.Seq && ev.Hash != to.Hash {
+			return n - 1, prev, &VerifyError{Line: n, Reason: "event hash differs from the expected one"}
+		}
+
+		seq = ev.Seq
+		prev = ev.Hash
+	}
+	if err := s.Err(); err != nil {
+		return n, prev, err
+	}
+	if seq < to.Seq {
+		return n, prev, fmt.Errorf("%w: last event %d, want %d", ErrTruncated, seq, to.Seq)
+	}
+
+	return n, prev, nil
+}
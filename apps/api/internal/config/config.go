@@ -0,0 +1,186 @@
+// Package config reads the API server configuration from the environment.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keystore backends selectable with KEYSTORE_BACKEND.
+const (
+	BackendMemory = "memory"
+	BackendFile   = "file"
+	BackendPKCS11 = "pkcs11"
+)
+
+type Config struct {
+	// KeystoreBackend selects where private keys live. Defaults to "file" if
+	// KeystoreFile is set and to "memory" otherwise, in which case keys are
+	// lost on restart.
+	KeystoreBackend string
+	// KeystoreFile is the path of the encrypted keystore file.
+	KeystoreFile string
+	// KeystorePassphrase protects the keystore file at rest unless the server
+	// is sealed. With SealFile set it is only needed to migrate key files
+	// protected by passphrase.
+	KeystorePassphrase string
+	// SealFile enables the seal: key files are protected by a master key
+	// split into shares, and the server starts sealed until enough shares
+	// are submitted. The file records the seal configuration.
+	SealFile string
+	// TenantDir holds the tenant registry and the keystore files of tenants.
+	// Defaults to the directory "tenants" next to KeystoreFile for the file
+	// backend; tenants only live in memory with the memory backend.
+	TenantDir string
+	// PKCS11Module is the path of the PKCS#11 library.
+	PKCS11Module string
+	// PKCS11TokenLabel selects the PKCS#11 token.
+	PKCS11TokenLabel string
+	// PKCS11PIN is the user PIN of the PKCS#11 token.
+	PKCS11PIN string
+	// AdminToken is the bearer token for the /admin endpoints. They are
+	// disabled if it is empty.
+	AdminToken string
+	// KeyGracePeriod is how long a rotated key keeps decrypting before it is
+	// retired.
+	KeyGracePeriod time.Duration
+	// KeyLifetime is how long a key stays active before it is rotated
+	// automatically. Keys do not expire if it is zero.
+	KeyLifetime time.Duration
+	// KeyRotateBefore is how long before its expiry a key is rotated.
+	KeyRotateBefore time.Duration
+	// KeyUsages are the WebCrypto key usages of generated keys, e.g.
+	// "wrapKey,unwrapKey" for keys that may only wrap data keys. Empty for the
+	// keystore default.
+	KeyUsages []string
+	// KeyBits is the modulus size of generated keys: 2048, 3072 or 4096.
+	KeyBits int
+	// KeyPoolSize is the number of keys generated ahead of time.
+	KeyPoolSize int
+	// AuditLog is the path of the audit log of key operations. Defaults to
+	// "audit.log" next to KeystoreFile for the file backend; nothing is
+	// recorded if it is empty.
+	AuditLog string
+}
+
+// Load reads the configuration from environment variables.
+func Load() (*Config, error) {
+	cfg := &Config{
+		KeystoreBackend:    os.Getenv("KEYSTORE_BACKEND"),
+		KeystoreFile:       os.Getenv("KEYSTORE_FILE"),
+		KeystorePassphrase: os.Getenv("KEYSTORE_PASSPHRASE"),
+		SealFile:           os.Getenv("SEAL_FILE"),
+		TenantDir:          os.Getenv("TENANT_DIR"),
+		PKCS11Module:       os.Getenv("PKCS11_MODULE"),
+		PKCS11TokenLabel:   os.Getenv("PKCS11_TOKEN_LABEL"),
+		PKCS11PIN:          os.Getenv("PKCS11_PIN"),
+		AdminToken:         os.Getenv("ADMIN_TOKEN"),
+		AuditLog:           os.Getenv("AUDIT_LOG"),
+	}
+
+	grace, err := durationEnv("KEY_GRACE_PERIOD", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cfg.KeyGracePeriod = grace
+
+	if cfg.KeyLifetime, err = durationEnv("KEY_LIFETIME", 0); err != nil {
+		return nil, err
+	}
+	if cfg.KeyRotateBefore, err = durationEnv("KEY_ROTATE_BEFORE", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.KeyLifetime != 0 && cfg.KeyRotateBefore >= cfg.KeyLifetime {
+		return nil, errors.New("KEY_ROTATE_BEFORE must be shorter than KEY_LIFETIME")
+	}
+
+	if v := os.Getenv("KEY_USAGES"); v != "" {
+		for _, u := range strings.Split(v, ",") {
+			cfg.KeyUsages = append(cfg.KeyUsages, strings.TrimSpace(u))
+		}
+	}
+
+	if cfg.KeyBits, err = intEnv("KEY_BITS", 4096); err != nil {
+		return nil, err
+	}
+	switch cfg.KeyBits {
+	case 2048, 3072, 4096:
+	default:
+		return nil, fmt.Errorf("KEY_BITS must be 2048, 3072 or 4096, got %d", cfg.KeyBits)
+	}
+
+	if cfg.KeyPoolSize, err = intEnv("KEY_POOL_SIZE", 2); err != nil {
+		return nil, err
+	}
+
+	if cfg.KeystoreBackend == "" {
+		cfg.KeystoreBackend = BackendMemory
+		if cfg.KeystoreFile != "" {
+			cfg.KeystoreBackend = BackendFile
+		}
+	}
+
+	switch cfg.KeystoreBackend {
+	case BackendMemory:
+	case BackendFile:
+		if cfg.KeystoreFile == "" || cfg.KeystorePassphrase == "" && cfg.SealFile == "" {
+			return nil, errors.New("KEYSTORE_FILE and KEYSTORE_PASSPHRASE or SEAL_FILE must be set for the file backend")
+		}
+		if cfg.TenantDir == "" {
+			cfg.TenantDir = filepath.Join(filepath.Dir(cfg.KeystoreFile), "tenants")
+		}
+		if cfg.AuditLog == "" {
+			cfg.AuditLog = filepath.Join(filepath.Dir(cfg.KeystoreFile), "audit.log")
+		}
+	case BackendPKCS11:
+		if cfg.PKCS11Module == "" || cfg.PKCS11TokenLabel == "" {
+			return nil, errors.New("PKCS11_MODULE and PKCS11_TOKEN_LABEL must be set for the pkcs11 backend")
+		}
+	default:
+		return nil, fmt.Errorf("unknown KEYSTORE_BACKEND %q", cfg.KeystoreBackend)
+	}
+
+	if cfg.SealFile != "" {
+		if cfg.KeystoreBackend != BackendFile {
+			return nil, errors.New("SEAL_FILE requires the file backend")
+		}
+		if cfg.AdminToken == "" {
+			return nil, errors.New("SEAL_FILE requires ADMIN_TOKEN to initialize and seal the server")
+		}
+	}
+
+	return cfg, nil
+}
+
+func durationEnv(name string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative duration, got %q", name, v)
+	}
+
+	return d, nil
+}
+
+func intEnv(name string, fallback int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer, got %q", name, v)
+	}
+
+	return n, nil
+}
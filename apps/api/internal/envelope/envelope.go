@@ -1,12 +1,11 @@
 package envelope
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
+	"context"
 	"encoding/base64"
-	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/aes"
 	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"fmt"
 )
 
 type Envelope []byte
@@ -22,17 +21,31 @@ func envelopeFromString(envelopeBase64 string) (*Envelope, error) {
 	return &envelope, nil
 }
 
-func (e *Envelope) Open() ([]byte, error) {
-	priv := keystore.PrivateKey()
-	if priv == nil {
-		return nil, errors.New("no private key available")
+// splitKey returns the AES key and HMAC key for alg from the key material of
+// an envelope. AES-CBC and AES-CTR envelopes wrap the AES key followed by an
+// HMAC key of the same size; AES-GCM envelopes wrap the AES key only.
+func splitKey(alg aes.Alg, key []byte) (aesKey, macKey []byte, err error) {
+	if alg == aes.AlgGCM {
+		return key, nil, nil
 	}
 
-	hash := sha256.New()
-	aesKey, err := rsa.DecryptOAEP(hash, rand.Reader, priv, *e, nil)
-	if err != nil {
-		return nil, err
+	switch len(key) {
+	case 32, 48, 64:
+	default:
+		return nil, nil, fmt.Errorf("%s key material is %d bytes, want a 16, 24 or 32 byte AES key followed by an HMAC key of the same size", alg, len(key))
 	}
 
-	return aesKey, nil
+	return key[:len(key)/2], key[len(key)/2:], nil
+}
+
+// Open unwraps the AES key with the keystore key identified by kid, which must
+// allow unwrapKey. An empty kid selects the active key.
+func (e *Envelope) Open(ctx context.Context, ks *keystore.Keystore, kid string) ([]byte, error) {
+	return ks.Decrypt(ctx, kid, keystore.UsageUnwrapKey, *e)
+}
+
+// OpenWithKEK unwraps the AES key with AES-KW under kek, e.g. a key derived
+// from a password, as WebCrypto's wrapKey with AES-KW does.
+func (e *Envelope) OpenWithKEK(kek []byte) ([]byte, error) {
+	return UnwrapKey(kek, *e)
 }
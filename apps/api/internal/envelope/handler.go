@@ -2,23 +2,44 @@ package envelope
 
 import (
 	"encoding/base64"
+	"errors"
 	"ezzy-web-crypto/api/apps/api/internal/aes"
 	"ezzy-web-crypto/api/apps/api/internal/apihelper"
 	"ezzy-web-crypto/api/apps/api/internal/jsonutil"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
 	"fmt"
 	"net/http"
 )
 
 type envelopeOpenRequest struct {
+	Kid string `json:"kid"`
+	// KEK is the base64 encoded AES key encryption key of an envelope
+	// wrapped with AES-KW. It replaces Kid.
+	KEK        string `json:"kek,omitempty"`
 	Envelope   string `json:"envelope"`
 	EncMessage string `json:"enc_message"`
+	// AAD is the base64 encoded additional data the message was encrypted
+	// with, if any.
+	AAD string `json:"aad,omitempty"`
+	// Alg is the AES mode of the message, AES-GCM by default. AES-CBC and
+	// AES-CTR envelopes wrap an HMAC key after the AES key.
+	Alg string `json:"alg,omitempty"`
+	// Length is the AES-CTR counter length in bits.
+	Length int `json:"length,omitempty"`
+	// TagLength is the AES-GCM tag length in bits and IVSize the AES-GCM IV
+	// size in bytes; 128 and 12 by default.
+	TagLength int `json:"tag_length,omitempty"`
+	IVSize    int `json:"iv_size,omitempty"`
+	// Format is the AES-GCM ciphertext format, "committing" for the
+	// key-committing one.
+	Format string `json:"format,omitempty"`
 }
 
 type envelopeOpenResponse struct {
 	Message string `json:"message"`
 }
 
-func HandleEnvelopeOpen() http.HandlerFunc {
+func HandleEnvelopeOpen(ks *keystore.Keystore) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		var req envelopeOpenRequest
 
@@ -31,6 +52,21 @@ func HandleEnvelopeOpen() http.HandlerFunc {
 			return
 		}
 
+		alg, err := aes.ParseAlg(req.Alg)
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		format, err := aes.ParseFormat(req.Format)
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
 		env, err := envelopeFromString(req.Envelope)
 		if err != nil {
 			message := fmt.Sprintf("error unwraping envelope: %v", err)
@@ -40,7 +76,61 @@ func HandleEnvelopeOpen() http.HandlerFunc {
 			return
 		}
 
-		key, err := env.Open()
+		var key []byte
+		if req.KEK != "" {
+			if req.Kid != "" {
+				jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+					ErrorMessage: "error envelope is opened with either kid or kek",
+				})
+				return
+			}
+			var kek []byte
+			kek, err = base64.StdEncoding.DecodeString(req.KEK)
+			if err != nil {
+				message := fmt.Sprintf("error base64-decoding KEK: %v", err)
+				jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+					ErrorMessage: message,
+				})
+				return
+			}
+			key, err = env.OpenWithKEK(kek)
+		} else {
+			key, err = env.Open(r.Context(), ks, req.Kid)
+		}
+		if errors.Is(err, ErrUnwrapFailed) {
+			jsonutil.MarshalResponse(rw, http.StatusUnprocessableEntity, &apihelper.ErrorResponse{
+				ErrorMessage: "error opening envelope: wrong key encryption key or tampered envelope",
+			})
+			return
+		}
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			message := fmt.Sprintf("error unknown kid %q", req.Kid)
+			jsonutil.MarshalResponse(rw, http.StatusNotFound, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if errors.Is(err, keystore.ErrKeyRetired) {
+			message := fmt.Sprintf("error key %q is retired", req.Kid)
+			jsonutil.MarshalResponse(rw, http.StatusGone, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if errors.Is(err, keystore.ErrKeyRevoked) {
+			message := fmt.Sprintf("error key %q is revoked", req.Kid)
+			jsonutil.MarshalResponse(rw, http.StatusGone, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if errors.Is(err, keystore.ErrUsageNotAllowed) {
+			message := fmt.Sprintf("error key %q does not allow unwrapping keys", req.Kid)
+			jsonutil.MarshalResponse(rw, http.StatusForbidden, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
 		if err != nil {
 			message := fmt.Sprintf("error opening envelope: %v", err)
 			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
@@ -58,10 +148,172 @@ func HandleEnvelopeOpen() http.HandlerFunc {
 			return
 		}
 
-		message := aes.Decrypt(key, encData)
+		aad, err := aes.DecodeAAD(req.AAD)
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		aesKey, macKey, err := splitKey(alg, key)
+		if err != nil {
+			message := fmt.Sprintf("error opening envelope: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		params := aes.Params{
+			Alg:       alg,
+			MACKey:    macKey,
+			Length:    req.Length,
+			TagLength: req.TagLength,
+			IVSize:    req.IVSize,
+			Format:    format,
+		}
+		message, err := aes.DecryptWith(params, aesKey, encData, aad)
+		if errors.Is(err, aes.ErrAuthFailed) {
+			jsonutil.MarshalResponse(rw, http.StatusUnprocessableEntity, &apihelper.ErrorResponse{
+				ErrorMessage: "error decrypting message: wrong key or AAD, or tampered message",
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error decrypting message: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
 
 		jsonutil.MarshalResponse(rw, http.StatusOK, &envelopeOpenResponse{
 			Message: string(message),
 		})
 	}
 }
+
+type keyWrapRequest struct {
+	KEK string `json:"kek"` // base64
+	Key string `json:"key"` // base64
+	// Padding selects AES-KW with padding of RFC 5649, which wraps keys of
+	// any length.
+	Padding bool `json:"padding,omitempty"`
+}
+
+type keyWrapResponse struct {
+	Envelope string `json:"envelope"`
+}
+
+type keyUnwrapRequest struct {
+	KEK      string `json:"kek"` // base64
+	Envelope string `json:"envelope"`
+	Padding  bool   `json:"padding,omitempty"`
+}
+
+type keyUnwrapResponse struct {
+	Key string `json:"key"`
+}
+
+// HandleKeyWrap wraps a key under a key encryption key with AES-KW.
+func HandleKeyWrap() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req keyWrapRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &req)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		kek, key, err := decodeKeyPair(req.KEK, req.Key)
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		wrap := WrapKey
+		if req.Padding {
+			wrap = WrapKeyWithPadding
+		}
+		wrapped, err := wrap(kek, key)
+		if err != nil {
+			message := fmt.Sprintf("error wrapping key: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &keyWrapResponse{
+			Envelope: base64.StdEncoding.EncodeToString(wrapped),
+		})
+	}
+}
+
+// HandleKeyUnwrap unwraps a key wrapped with AES-KW.
+func HandleKeyUnwrap() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req keyUnwrapRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &req)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		kek, wrapped, err := decodeKeyPair(req.KEK, req.Envelope)
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		unwrap := UnwrapKey
+		if req.Padding {
+			unwrap = UnwrapKeyWithPadding
+		}
+		key, err := unwrap(kek, wrapped)
+		if errors.Is(err, ErrUnwrapFailed) {
+			jsonutil.MarshalResponse(rw, http.StatusUnprocessableEntity, &apihelper.ErrorResponse{
+				ErrorMessage: "error unwrapping key: wrong key encryption key or tampered envelope",
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error unwrapping key: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &keyUnwrapResponse{
+			Key: base64.StdEncoding.EncodeToString(key),
+		})
+	}
+}
+
+// decodeKeyPair decodes the base64 key encryption key and the key or envelope
+// of a key wrap API call.
+func decodeKeyPair(kekBase64, keyBase64 string) (kek, key []byte, err error) {
+	kek, err = base64.StdEncoding.DecodeString(kekBase64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error base64-decoding KEK: %v", err)
+	}
+	key, err = base64.StdEncoding.DecodeString(keyBase64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error base64-decoding key: %v", err)
+	}
+
+	return kek, key, nil
+}
@@ -0,0 +1,167 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"ezzy-web-crypto/api/apps/api/internal/aes"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleEnvelopeOpen(t *testing.T) {
+	t.Parallel()
+
+	ks := keystore.New(keystore.Options{Bits: 2048})
+	key, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrap := func(t *testing.T, aesKey []byte) string {
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.PublicKey(), aesKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(wrapped)
+	}
+
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := aes.Encrypt(aesKey, []byte("hello world"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record7 := base64.StdEncoding.EncodeToString([]byte("record:7"))
+	bound, err := aes.Encrypt(aesKey, []byte("hello world"), []byte("record:7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	macKey := make([]byte, 32)
+	if _, err := rand.Read(macKey); err != nil {
+		t.Fatal(err)
+	}
+	composite := append(append([]byte(nil), aesKey...), macKey...)
+	cbc, err := aes.EncryptWith(aes.Params{Alg: aes.AlgCBC, MACKey: macKey}, aesKey, []byte("hello world"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctr, err := aes.EncryptWith(aes.Params{Alg: aes.AlgCTR, MACKey: macKey, Length: 64}, aesKey, []byte("hello world"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortTag, err := aes.EncryptWith(aes.Params{Alg: aes.AlgGCM, TagLength: 96}, aesKey, []byte("hello world"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committing, err := aes.EncryptCommitting(aesKey, []byte("hello world"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), enc...)
+	tampered[len(tampered)-1] ^= 1
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+	kekBase64 := base64.StdEncoding.EncodeToString(kek)
+	kw, err := WrapKey(kek, aesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kwEnvelope := base64.StdEncoding.EncodeToString(kw)
+
+	tests := []struct {
+		name       string
+		kid        string
+		kek        string
+		envelope   string
+		encMessage []byte
+		aad        string
+		alg        string
+		tagLength  int
+		format     string
+		code       int
+	}{
+		{name: "valid", envelope: wrap(t, aesKey), encMessage: enc, code: http.StatusOK},
+		{name: "valid with kek", kek: kekBase64, envelope: kwEnvelope, encMessage: enc, code: http.StatusOK},
+		{name: "wrong kek", kek: base64.StdEncoding.EncodeToString(make([]byte, 32)), envelope: kwEnvelope, encMessage: enc, code: http.StatusUnprocessableEntity},
+		{name: "invalid kek size", kek: "c2hvcnQ=", envelope: kwEnvelope, encMessage: enc, code: http.StatusBadRequest},
+		{name: "kid and kek", kid: key.ID, kek: kekBase64, envelope: kwEnvelope, encMessage: enc, code: http.StatusBadRequest},
+		{name: "invalid key size", envelope: wrap(t, aesKey[:10]), encMessage: enc, code: http.StatusBadRequest},
+		{name: "truncated", envelope: wrap(t, aesKey), encMessage: enc[:aes.NonceSize], code: http.StatusBadRequest},
+		{name: "tampered", envelope: wrap(t, aesKey), encMessage: tampered, code: http.StatusUnprocessableEntity},
+		{name: "wrong key", envelope: wrap(t, make([]byte, 32)), encMessage: enc, code: http.StatusUnprocessableEntity},
+		{name: "valid with aad", envelope: wrap(t, aesKey), encMessage: bound, aad: record7, code: http.StatusOK},
+		{name: "aad not base64", envelope: wrap(t, aesKey), encMessage: bound, aad: "record:7", code: http.StatusBadRequest},
+		{name: "missing aad", envelope: wrap(t, aesKey), encMessage: bound, code: http.StatusUnprocessableEntity},
+		{name: "valid cbc", envelope: wrap(t, composite), encMessage: cbc, alg: "AES-CBC", code: http.StatusOK},
+		{name: "cbc with aes key only", envelope: wrap(t, aesKey), encMessage: cbc, alg: "AES-CBC", code: http.StatusUnprocessableEntity},
+		{name: "cbc with short key", envelope: wrap(t, aesKey[:16]), encMessage: cbc, alg: "AES-CBC", code: http.StatusBadRequest},
+		{name: "cbc with 33 byte key", envelope: wrap(t, composite[:33]), encMessage: cbc, alg: "AES-CBC", code: http.StatusBadRequest},
+		{name: "cbc with 40 byte key", envelope: wrap(t, composite[:40]), encMessage: cbc, alg: "AES-CBC", code: http.StatusBadRequest},
+		{name: "ctr with 33 byte key", envelope: wrap(t, composite[:33]), encMessage: ctr, alg: "AES-CTR", code: http.StatusBadRequest},
+		{name: "ctr with 40 byte key", envelope: wrap(t, composite[:40]), encMessage: ctr, alg: "AES-CTR", code: http.StatusBadRequest},
+		{name: "cbc as gcm", envelope: wrap(t, composite), encMessage: cbc, code: http.StatusBadRequest},
+		{name: "unsupported alg", envelope: wrap(t, aesKey), encMessage: enc, alg: "AES-ECB", code: http.StatusBadRequest},
+		{name: "valid 96 bit tag", envelope: wrap(t, aesKey), encMessage: shortTag, tagLength: 96, code: http.StatusOK},
+		{name: "96 bit tag as 128 bit", envelope: wrap(t, aesKey), encMessage: shortTag, code: http.StatusUnprocessableEntity},
+		{name: "invalid tag length", envelope: wrap(t, aesKey), encMessage: enc, tagLength: 64, code: http.StatusBadRequest},
+		{name: "valid committing", envelope: wrap(t, aesKey), encMessage: committing, format: "committing", code: http.StatusOK},
+		{name: "committing with wrong key", envelope: wrap(t, make([]byte, 32)), encMessage: committing, format: "committing", code: http.StatusUnprocessableEntity},
+		{name: "unknown format", envelope: wrap(t, aesKey), encMessage: enc, format: "v2", code: http.StatusBadRequest},
+		{name: "swapped record", envelope: wrap(t, aesKey), encMessage: bound, aad: base64.StdEncoding.EncodeToString([]byte("record:8")), code: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			kid := tt.kid
+			if tt.kek == "" {
+				kid = key.ID
+			}
+			body, err := json.Marshal(&envelopeOpenRequest{
+				Kid:        kid,
+				KEK:        tt.kek,
+				Envelope:   tt.envelope,
+				EncMessage: base64.StdEncoding.EncodeToString(tt.encMessage),
+				AAD:        tt.aad,
+				Alg:        tt.alg,
+				TagLength:  tt.tagLength,
+				Format:     tt.format,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", "/envelope/open", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			HandleEnvelopeOpen(ks)(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("wrong response code, want: %v got: %v (%s)", tt.code, w.Code, w.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var res envelopeOpenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Message != "hello world" {
+				t.Errorf("message want: %q got: %q", "hello world", res.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// kwIV is the default initial value of RFC 3394, section 2.2.3.1.
+var kwIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// kwpIV is the constant half of the alternative initial value of RFC 5649,
+// section 3. The other half is the length of the key data.
+var kwpIV = []byte{0xa6, 0x59, 0x59, 0xa6}
+
+// maxKWPKeyData is the longest key data RFC 5649 wraps, as its length must
+// fit the 32 bit half of the alternative initial value.
+const maxKWPKeyData = 1<<32 - 1
+
+var (
+	ErrInvalidKEK     = errors.New("envelope: invalid key encryption key size, want 16, 24 or 32 bytes")
+	ErrInvalidKeyData = errors.New("envelope: invalid key data length")
+	ErrUnwrapFailed   = errors.New("envelope: key unwrap integrity check failed")
+)
+
+// WrapKey wraps key under the AES key encryption key kek with AES-KW as
+// defined by RFC 3394 and implemented by WebCrypto's wrapKey. key must be at
+// least 16 bytes long and a multiple of 8 bytes.
+func WrapKey(kek, key []byte) ([]byte, error) {
+	block, err := newKEK(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, fmt.Errorf("%w: got %d bytes, want a multiple of 8 of at least 16", ErrInvalidKeyData, len(key))
+	}
+
+	return wrap(block, kwIV, key), nil
+}
+
+// UnwrapKey reverses WrapKey. It fails with ErrUnwrapFailed if kek is wrong or
+// wrapped was tampered with.
+func UnwrapKey(kek, wrapped []byte) ([]byte, error) {
+	block, err := newKEK(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, fmt.Errorf("%w: got %d wrapped bytes, want a multiple of 8 of at least 24", ErrInvalidKeyData, len(wrapped))
+	}
+
+	iv, key := unwrap(block, wrapped)
+	if subtle.ConstantTimeCompare(iv, kwIV) != 1 {
+		zero(key)
+		return nil, ErrUnwrapFailed
+	}
+
+	return key, nil
+}
+
+// WrapKeyWithPadding wraps key of any length from 1 byte under kek with AES-KW
+// with padding as defined by RFC 5649.
+func WrapKeyWithPadding(kek, key []byte) ([]byte, error) {
+	block, err := newKEK(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 || uint64(len(key)) > maxKWPKeyData {
+		return nil, fmt.Errorf("%w: got %d bytes", ErrInvalidKeyData, len(key))
+	}
+
+	iv := make([]byte, 8)
+	copy(iv, kwpIV)
+	binary.BigEndian.PutUint32(iv[4:], uint32(len(key)))
+
+	padded := make([]byte, (len(key)+7)/8*8)
+	copy(padded, key)
+	defer zero(padded)
+
+	if len(padded) == 8 {
+		// A single block is encrypted with AES in ECB mode, section 4.1.
+		out := make([]byte, 16)
+		copy(out, iv)
+		copy(out[8:], padded)
+		block.Encrypt(out, out)
+		return out, nil
+	}
+
+	return wrap(block, iv, padded), nil
+}
+
+// UnwrapKeyWithPadding reverses WrapKeyWithPadding. It fails with
+// ErrUnwrapFailed if kek is wrong or wrapped was tampered with.
+func UnwrapKeyWithPadding(kek, wrapped []byte) ([]byte, error) {
+	block, err := newKEK(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < 16 || len(wrapped)%8 != 0 {
+		return nil, fmt.Errorf("%w: got %d wrapped bytes, want a multiple of 8 of at least 16", ErrInvalidKeyData, len(wrapped))
+	}
+
+	var iv, padded []byte
+	if len(wrapped) == 16 {
+		out := make([]byte, 16)
+		block.Decrypt(out, wrapped)
+		iv, padded = out[:8], out[8:]
+	} else {
+		iv, padded = unwrap(block, wrapped)
+	}
+
+	// Section 3: the constant, the length and the zero padding must check out.
+	// Any bit flipped in wrapped scrambles all of them, so they need not be
+	// told apart in constant time.
+	n := int(binary.BigEndian.Uint32(iv[4:]))
+	if subtle.ConstantTimeCompare(iv[:4], kwpIV) != 1 || n <= len(padded)-8 || n > len(padded) || !zeroes(padded[n:]) {
+		zero(padded)
+		return nil, ErrUnwrapFailed
+	}
+
+	key := append([]byte(nil), padded[:n]...)
+	zero(padded)
+
+	return key, nil
+}
+
+func newKEK(kek []byte) (cipher.Block, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("%w: got %d bytes", ErrInvalidKEK, len(kek))
+	}
+
+	return block, nil
+}
+
+// wrap is the wrapping process of RFC 3394, section 2.2.1, in its index
+// based form, with the initial value iv.
+func wrap(block cipher.Block, iv, key []byte) []byte {
+	n := len(key) / 8
+	out := make([]byte, 8+len(key))
+	copy(out, iv)
+	copy(out[8:], key)
+
+	b := make([]byte, 16)
+	a := out[:8]
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			r := out[i*8 : i*8+8]
+			copy(b, a)
+			copy(b[8:], r)
+			block.Encrypt(b, b)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^t)
+			copy(r, b[8:])
+		}
+	}
+	zero(b)
+
+	return out
+}
+
+// unwrap is the unwrapping process of RFC 3394, section 2.2.2. It returns
+// the recovered initial value and key data; the caller checks the former.
+func unwrap(block cipher.Block, wrapped []byte) (iv, key []byte) {
+	n := len(wrapped)/8 - 1
+	a := append([]byte(nil), wrapped[:8]...)
+	key = append([]byte(nil), wrapped[8:]...)
+
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			r := key[(i-1)*8 : i*8]
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(a)^t)
+			copy(b[8:], r)
+			block.Decrypt(b, b)
+			copy(a, b[:8])
+			copy(r, b[8:])
+		}
+	}
+	zero(b)
+
+	return a, key
+}
+
+func zeroes(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,280 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	kek128 = "000102030405060708090A0B0C0D0E0F"
+	kek192 = "000102030405060708090A0B0C0D0E0F1011121314151617"
+	kek256 = "000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F"
+	key128 = "00112233445566778899AABBCCDDEEFF"
+	key192 = "00112233445566778899AABBCCDDEEFF0001020304050607"
+	key256 = "00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestKeyWrapRFC3394(t *testing.T) {
+	t.Parallel()
+
+	// RFC 3394, section 4.
+	tests := []struct {
+		name    string
+		kek     string
+		key     string
+		wrapped string
+	}{
+		{name: "4.1 128 bit key with 128 bit kek", kek: kek128, key: key128, wrapped: "1FA68B0A8112B447 AEF34BD8FB5A7B82 9D3E862371D2CFE5"},
+		{name: "4.2 128 bit key with 192 bit kek", kek: kek192, key: key128, wrapped: "96778B25AE6CA435 F92B5B97C050AED2 468AB8A17AD84E5D"},
+		{name: "4.3 128 bit key with 256 bit kek", kek: kek256, key: key128, wrapped: "64E8C3F9CE0F5BA2 63E9777905818A2A 93C8191E7D6E8AE7"},
+		{name: "4.4 192 bit key with 192 bit kek", kek: kek192, key: key192, wrapped: "031D33264E15D332 68F24EC260743EDC E1C6C7DDEE725A93 6BA814915C6762D2"},
+		{name: "4.5 192 bit key with 256 bit kek", kek: kek256, key: key192, wrapped: "A8F9BC1612C68B3F F6E6F4FBE30E71E4 769C8B80A32CB895 8CD5D17D6B254DA1"},
+		{name: "4.6 256 bit key with 256 bit kek", kek: kek256, key: key256, wrapped: "28C9F404C4B810F4 CBCCB35CFB87F826 3F5786E2D80ED326 CBC7F0E71A99F43B FB988B9B7A02DD21"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			kek, key, want := decodeHex(t, tt.kek), decodeHex(t, tt.key), decodeHex(t, tt.wrapped)
+
+			got, err := WrapKey(kek, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("wrapped want: %x got: %x", want, got)
+			}
+
+			unwrapped, err := UnwrapKey(kek, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(unwrapped, key) {
+				t.Errorf("unwrapped want: %x got: %x", key, unwrapped)
+			}
+		})
+	}
+}
+
+func TestKeyWrapRFC5649(t *testing.T) {
+	t.Parallel()
+
+	// RFC 5649, section 6.
+	kek := "5840df6e29b02af1 ab493b705bf16ea1 ae8338f4dcc176a8"
+	tests := []struct {
+		name    string
+		key     string
+		wrapped string
+	}{
+		{name: "20 octets", key: "c37b7e6492584340 bed1220780894115 5068f738", wrapped: "138bdeaa9b8fa7fc 61f97742e72248ee 5ae6ae5360d1ae6a 5f54f373fa543b6a"},
+		{name: "7 octets", key: "466f7250617369", wrapped: "afbeb0f07dfbf541 9200f2ccb50bb24f"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			kek, key, want := decodeHex(t, kek), decodeHex(t, tt.key), decodeHex(t, tt.wrapped)
+
+			got, err := WrapKeyWithPadding(kek, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("wrapped want: %x got: %x", want, got)
+			}
+
+			unwrapped, err := UnwrapKeyWithPadding(kek, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(unwrapped, key) {
+				t.Errorf("unwrapped want: %x got: %x", key, unwrapped)
+			}
+		})
+	}
+}
+
+func TestKeyWrapErrors(t *testing.T) {
+	t.Parallel()
+
+	kek := decodeHex(t, kek128)
+	wrapped, err := WrapKey(kek, decodeHex(t, key128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), wrapped...)
+	tampered[len(tampered)-1] ^= 1
+	// The RFC 5649 vector with 7 octets of key data; unwrapped without
+	// padding its initial value is wrong.
+	padded := decodeHex(t, "afbeb0f07dfbf541 9200f2ccb50bb24f")
+	padded24 := append(append([]byte(nil), padded...), padded[:8]...)
+	paddedKEK := decodeHex(t, "5840df6e29b02af1 ab493b705bf16ea1 ae8338f4dcc176a8")
+	// Key data wrapped without padding has the RFC 3394 initial value.
+	unpadded, err := WrapKey(paddedKEK, decodeHex(t, key128))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		fn   func() ([]byte, error)
+		err  error
+	}{
+		{name: "wrap with short kek", fn: func() ([]byte, error) { return WrapKey(kek[:8], decodeHex(t, key128)) }, err: ErrInvalidKEK},
+		{name: "wrap short key", fn: func() ([]byte, error) { return WrapKey(kek, kek[:8]) }, err: ErrInvalidKeyData},
+		{name: "wrap unaligned key", fn: func() ([]byte, error) { return WrapKey(kek, decodeHex(t, key128)[:15]) }, err: ErrInvalidKeyData},
+		{name: "wrap empty key with padding", fn: func() ([]byte, error) { return WrapKeyWithPadding(kek, nil) }, err: ErrInvalidKeyData},
+		{name: "unwrap with short kek", fn: func() ([]byte, error) { return UnwrapKey(kek[:8], wrapped) }, err: ErrInvalidKEK},
+		{name: "unwrap truncated", fn: func() ([]byte, error) { return UnwrapKey(kek, wrapped[:16]) }, err: ErrInvalidKeyData},
+		{name: "unwrap unaligned", fn: func() ([]byte, error) { return UnwrapKey(kek, wrapped[:23]) }, err: ErrInvalidKeyData},
+		{name: "unwrap tampered", fn: func() ([]byte, error) { return UnwrapKey(kek, tampered) }, err: ErrUnwrapFailed},
+		{name: "unwrap with wrong kek", fn: func() ([]byte, error) { return UnwrapKey(decodeHex(t, kek256), wrapped) }, err: ErrUnwrapFailed},
+		{name: "unwrap padded without padding", fn: func() ([]byte, error) { return UnwrapKey(paddedKEK, padded24) }, err: ErrUnwrapFailed},
+		{name: "unwrap unpadded with padding", fn: func() ([]byte, error) { return UnwrapKeyWithPadding(paddedKEK, unpadded) }, err: ErrUnwrapFailed},
+		{name: "unwrap truncated with padding", fn: func() ([]byte, error) { return UnwrapKeyWithPadding(paddedKEK, padded[:8]) }, err: ErrInvalidKeyData},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			key, err := tt.fn()
+			if !errors.Is(err, tt.err) {
+				t.Errorf("want: %v got: %v", tt.err, err)
+			}
+			if key != nil {
+				t.Errorf("key want: nil got: %x", key)
+			}
+		})
+	}
+}
+
+func TestHandleKeyWrap(t *testing.T) {
+	t.Parallel()
+
+	kek := base64.StdEncoding.EncodeToString(decodeHex(t, kek128))
+	key := base64.StdEncoding.EncodeToString(decodeHex(t, key128))
+	short := base64.StdEncoding.EncodeToString([]byte("7 bytes"))
+
+	tests := []struct {
+		name    string
+		kek     string
+		key     string
+		padding bool
+		code    int
+	}{
+		{name: "valid", kek: kek, key: key, code: http.StatusOK},
+		{name: "valid with padding", kek: kek, key: short, padding: true, code: http.StatusOK},
+		{name: "short key without padding", kek: kek, key: short, code: http.StatusBadRequest},
+		{name: "kek not base64", kek: "not base64!", key: key, code: http.StatusBadRequest},
+		{name: "invalid kek size", kek: short, key: key, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			body, err := json.Marshal(&keyWrapRequest{KEK: tt.kek, Key: tt.key, Padding: tt.padding})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", "/envelope/wrap", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			HandleKeyWrap()(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("wrap: wrong response code, want: %v got: %v (%s)", tt.code, w.Code, w.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var wrapped keyWrapResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &wrapped); err != nil {
+				t.Fatal(err)
+			}
+
+			body, err = json.Marshal(&keyUnwrapRequest{KEK: tt.kek, Envelope: wrapped.Envelope, Padding: tt.padding})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = httptest.NewRequest("POST", "/envelope/unwrap", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w = httptest.NewRecorder()
+			HandleKeyUnwrap()(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("unwrap: wrong response code, want: %v got: %v (%s)", http.StatusOK, w.Code, w.Body)
+			}
+			var res keyUnwrapResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Key != tt.key {
+				t.Errorf("key want: %v got: %v", tt.key, res.Key)
+			}
+		})
+	}
+}
+
+func TestHandleKeyUnwrapErrors(t *testing.T) {
+	t.Parallel()
+
+	kek := base64.StdEncoding.EncodeToString(decodeHex(t, kek128))
+	wrapped := decodeHex(t, "1FA68B0A8112B447 AEF34BD8FB5A7B82 9D3E862371D2CFE5")
+	tampered := append([]byte(nil), wrapped...)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name     string
+		envelope []byte
+		code     int
+	}{
+		{name: "tampered", envelope: tampered, code: http.StatusUnprocessableEntity},
+		{name: "truncated", envelope: wrapped[:16], code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			body, err := json.Marshal(&keyUnwrapRequest{KEK: kek, Envelope: base64.StdEncoding.EncodeToString(tt.envelope)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", "/envelope/unwrap", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			HandleKeyUnwrap()(w, r)
+
+			if w.Code != tt.code {
+				t.Errorf("wrong response code, want: %v got: %v (%s)", tt.code, w.Code, w.Body)
+			}
+		})
+	}
+}
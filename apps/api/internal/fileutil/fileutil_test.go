@@ -0,0 +1,42 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	for _, data := range []string{"first", "second"} {
+		if err := WriteFileAtomic(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Errorf("want: %q got: %q", data, got)
+		}
+	}
+
+	info, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 1 {
+		t.Errorf("temporary files left behind: %v", info)
+	}
+	if mode := info[0].Mode().Perm(); mode != 0600 {
+		t.Errorf("mode want: %v got: %v", 0600, mode)
+	}
+
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "state.json"), []byte("data")); err == nil {
+		t.Error("write into a missing directory succeeded")
+	}
+}
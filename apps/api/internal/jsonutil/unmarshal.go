@@ -46,12 +46,18 @@ const (
 // Unmarshal provides a common implemetation of JSON unmarshalling with well
 // defined error handling
 func Unmarshal(w http.ResponseWriter, r *http.Request, data interface{}) (int, error) {
+	return UnmarshalLimit(w, r, data, maxBodyBytes)
+}
+
+// UnmarshalLimit is Unmarshal for bodies of up to limit bytes, for the few
+// calls whose payloads outgrow the default limit.
+func UnmarshalLimit(w http.ResponseWriter, r *http.Request, data interface{}, limit int64) (int, error) {
 	if t := r.Header.Get("content-type"); len(t) < 16 || t[:16] != "application/json" {
 		return http.StatusUnsupportedMediaType, fmt.Errorf("content-type is not application/json")
 	}
 
 	defer r.Body.Close()
-	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
 
 	d := json.NewDecoder(r.Body)
 	d.DisallowUnknownFields()
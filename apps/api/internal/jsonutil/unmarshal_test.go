@@ -177,3 +177,36 @@ func unmarshalTestHelper(t *testing.T, payloads []string, errors []string, expec
 		}
 	}
 }
+
+func TestUnmarshalLimit(t *testing.T) {
+	t.Parallel()
+
+	input := map[string]string{"name": strings.Repeat("0", maxBodyBytes+10)}
+	largeJSON, err := json.Marshal(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		limit int64
+		code  int
+	}{
+		{"within limit", int64(len(largeJSON)), http.StatusOK},
+		{"over limit", int64(len(largeJSON)) - 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest("POST", "/", bytes.NewReader(largeJSON))
+			r.Header.Set("content-type", "application/json")
+
+			code, err := UnmarshalLimit(httptest.NewRecorder(), r, &testData{}, tt.limit)
+			if code != tt.code {
+				t.Errorf("unmarshal wanted %v response code, got %v (%v)", tt.code, code, err)
+			}
+		})
+	}
+}
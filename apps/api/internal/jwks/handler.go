@@ -0,0 +1,63 @@
+package jwks
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"ezzy-web-crypto/api/apps/api/internal/jsonutil"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxAge caps how long clients may cache the key set.
+const maxAge = 5 * time.Minute
+
+// HandleGetJWKS serves the active public keys. The ETag changes with every
+// rotation, and the cache lifetime never exceeds the grace period, so a cached
+// key set always holds a key that can still decrypt. Nor does it extend past
+// the next scheduled rotation.
+func HandleGetJWKS(ks *keystore.Keystore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		// An expired active key is left out until it is rotated.
+		set := JWKSet{Keys: []JWK{}}
+		if active, err := ks.Current(); err == nil {
+			set.Keys = append(set.Keys, FromKey(active))
+		}
+
+		age := maxAge
+		if grace := ks.GracePeriod(); grace < age {
+			age = grace
+		}
+		if next := ks.NextRotation(); !next.IsZero() {
+			if untilRotation := time.Until(next); untilRotation < age {
+				age = untilRotation
+			}
+			if age < 0 {
+				age = 0
+			}
+		}
+
+		etag := setETag(set)
+		rw.Header().Set("ETag", etag)
+		rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(age.Seconds())))
+
+		if r.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &set)
+	}
+}
+
+// setETag derives a strong ETag from the key IDs of set.
+func setETag(set JWKSet) string {
+	h := sha256.New()
+	for _, k := range set.Keys {
+		h.Write([]byte(k.Kid))
+		h.Write([]byte{0})
+	}
+
+	return `"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
@@ -0,0 +1,141 @@
+package jwks
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleGetJWKS(t *testing.T) {
+	t.Parallel()
+
+	ks, err := keystore.Open(keystore.Options{Bits: 2048, GracePeriod: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := ks.ActiveKey()
+	if _, err := ks.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	active := ks.ActiveKey()
+
+	handler := HandleGetJWKS(ks)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong response code, want: %v got: %v", http.StatusOK, w.Code)
+	}
+	if got, want := w.Header().Get("Cache-Control"), "public, max-age=60"; got != want {
+		t.Errorf("cache control want: %q got: %q", want, got)
+	}
+
+	var set JWKSet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("want only the active key, got %d keys", len(set.Keys))
+	}
+
+	jwk := set.Keys[0]
+	if jwk.Kid != active.ID || jwk.Kid == rotated.ID {
+		t.Errorf("kid want: %v got: %v", active.ID, jwk.Kid)
+	}
+	if jwk.Kty != "RSA" || jwk.Alg != "RSA-OAEP-256" || jwk.Use != "enc" {
+		t.Errorf("unexpected key parameters: %+v", jwk)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if new(big.Int).SetBytes(n).Cmp(active.PublicKey().N) != 0 || new(big.Int).SetBytes(e).Int64() != int64(active.PublicKey().E) {
+		t.Errorf("jwk does not match the active public key")
+	}
+
+	// Revalidation succeeds until the next rotation.
+	etag := w.Header().Get("ETag")
+	r := httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("revalidation want: %v got: %v", http.StatusNotModified, w.Code)
+	}
+
+	if _, err := ks.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("rotation did not change the key set etag")
+	}
+}
+
+func TestHandleGetJWKSExpiry(t *testing.T) {
+	t.Parallel()
+
+	ks, err := keystore.Open(keystore.Options{
+		Bits:         2048,
+		Lifetime:     time.Hour,
+		RotateBefore: time.Hour - time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := ks.ActiveKey()
+
+	handler := HandleGetJWKS(ks)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+	// The next rotation is due in less than a minute.
+	var age int
+	if _, err := fmt.Sscanf(w.Header().Get("Cache-Control"), "public, max-age=%d", &age); err != nil {
+		t.Fatal(err)
+	}
+	if age >= 60 {
+		t.Errorf("max-age want: below 60 got: %v", age)
+	}
+
+	var set JWKSet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0].Exp != active.NotAfter.Unix() {
+		t.Errorf("exp want: %v got: %+v", active.NotAfter.Unix(), set.Keys)
+	}
+}
+
+func TestHandleGetJWKSExpiredKey(t *testing.T) {
+	t.Parallel()
+
+	// The active key expires right away and stays until it is rotated.
+	ks, err := keystore.Open(keystore.Options{Bits: 2048, Lifetime: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	HandleGetJWKS(ks)(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+	var set JWKSet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 0 {
+		t.Errorf("want no keys, got %+v", set.Keys)
+	}
+}
@@ -0,0 +1,51 @@
+// Package jwks publishes the keystore public keys as a JSON Web Key Set
+// (RFC 7517), which WebCrypto can import with importKey("jwk", ...).
+package jwks
+
+import (
+	"encoding/base64"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"math/big"
+)
+
+// JWK is an RSA public key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// KeyOps lists the usages of the public key, so WebCrypto refuses to import
+	// it for anything else.
+	KeyOps []keystore.Usage `json:"key_ops,omitempty"`
+	// Exp is the expiry of the key as NumericDate, omitted if it does not
+	// expire. It is not a registered JWK parameter; JOSE libraries ignore it.
+	Exp int64 `json:"exp,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// FromKey returns the public key of key as JWK for RSA-OAEP with SHA-256, the
+// algorithm the keystore decrypts with.
+func FromKey(key *keystore.Key) JWK {
+	pub := key.PublicKey()
+
+	jwk := JWK{
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		Alg: "RSA-OAEP-256",
+		Kid: key.ID,
+		Use: "enc",
+
+		KeyOps: key.PublicUsages(),
+	}
+	if !key.NotAfter.IsZero() {
+		jwk.Exp = key.NotAfter.Unix()
+	}
+
+	return jwk
+}
@@ -0,0 +1,41 @@
+package keystore
+
+import (
+	"context"
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+)
+
+// record writes an audit event for the operation op on the key identified by
+// kid, which failed with err or succeeded if err is nil. It returns err, or
+// the error writing the event, so that no operation succeeds unrecorded.
+func (ks *Keystore) record(ctx context.Context, op, kid string, err error) error {
+	return ks.recordEvent(ctx, audit.Event{Op: op, Kid: kid}, err)
+}
+
+// recordEvent is record for events with further fields set.
+func (ks *Keystore) recordEvent(ctx context.Context, ev audit.Event, err error) error {
+	if ks.audit == nil {
+		return err
+	}
+
+	ev.Tenant = ks.tenant
+	ev.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		ev.Outcome = audit.OutcomeFailure
+		ev.Error = err.Error()
+	}
+
+	if recErr := ks.audit.Record(ctx, ev); recErr != nil && err == nil {
+		return recErr
+	}
+
+	return err
+}
+
+// keyID returns the ID of key or an empty string if key is nil.
+func keyID(key *Key) string {
+	if key == nil {
+		return ""
+	}
+	return key.ID
+}
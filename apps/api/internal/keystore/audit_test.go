@@ -0,0 +1,99 @@
+package keystore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type testRecorder struct {
+	err error
+
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (r *testRecorder) Record(ctx context.Context, ev audit.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	ev.Caller = audit.CallerFrom(ctx).ID
+	r.events = append(r.events, ev)
+
+	return nil
+}
+
+func TestKeystoreAudit(t *testing.T) {
+	t.Parallel()
+
+	rec := &testRecorder{}
+	ks := New(Options{Bits: 2048, Audit: rec, Tenant: "acme"})
+	ctx := audit.WithCaller(context.Background(), audit.Caller{ID: "tenant:acme"})
+
+	first, err := ks.Rotate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, first.PublicKey(), []byte("data key"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Decrypt(ctx, first.ID, UsageUnwrapKey, ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Decrypt(ctx, "unknown", UsageDecrypt, ciphertext); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("decrypt with unknown kid want: %v got: %v", ErrKeyNotFound, err)
+	}
+	second, err := ks.Rotate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Revoke(ctx, first.ID, ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []audit.Event{
+		{Op: audit.OpKeyRotate, Tenant: "acme", Kid: first.ID, Caller: "tenant:acme", Outcome: audit.OutcomeSuccess},
+		{Op: audit.OpKeyUnwrap, Tenant: "acme", Kid: first.ID, Caller: "tenant:acme", Outcome: audit.OutcomeSuccess},
+		{Op: audit.OpKeyDecrypt, Tenant: "acme", Kid: "unknown", Caller: "tenant:acme", Outcome: audit.OutcomeFailure, Error: ErrKeyNotFound.Error()},
+		{Op: audit.OpKeyRotate, Tenant: "acme", Kid: second.ID, Caller: "tenant:acme", Outcome: audit.OutcomeSuccess},
+		{Op: audit.OpKeyRevoke, Tenant: "acme", Kid: first.ID, Caller: "tenant:acme", Outcome: audit.OutcomeSuccess, Detail: "reason key_compromise"},
+	}
+	if diff := cmp.Diff(want, rec.events); diff != "" {
+		t.Errorf("audit events mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDecryptFailsUnrecorded(t *testing.T) {
+	t.Parallel()
+
+	rec := &testRecorder{}
+	ks := New(Options{Bits: 2048, Audit: rec})
+	key, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.PublicKey(), []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	rec.err = errors.New("disk full")
+	rec.mu.Unlock()
+
+	plaintext, err := ks.Decrypt(context.Background(), key.ID, UsageDecrypt, ciphertext)
+	if err == nil || plaintext != nil {
+		t.Errorf("decrypt without audit want: error got: %q, %v", plaintext, err)
+	}
+}
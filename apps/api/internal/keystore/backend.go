@@ -0,0 +1,330 @@
+package keystore
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// Backend stores key pairs together with their metadata. Private keys never
+// leave a backend; private key operations go through Decrypt. Implementations
+// must be safe for concurrent use.
+type Backend interface {
+	// Generate creates a key pair of the given size and stores it with the
+	// metadata of meta. It returns the stored key with its ID filled in.
+	Generate(bits int, meta Key) (*Key, error)
+	// Import stores an existing private key with the metadata of meta. It
+	// fails with ErrKeyExists if the key is already stored.
+	Import(priv *rsa.PrivateKey, meta Key) (*Key, error)
+	// ImportTombstone stores the metadata of a revoked or destroyed key
+	// without a key pair, e.g. one restored from a backup. It fails with
+	// ErrKeyExists if the key is already stored.
+	ImportTombstone(meta Key) (*Key, error)
+	// Get returns the key with the given ID or ErrKeyNotFound.
+	Get(kid string) (*Key, error)
+	// List returns all stored keys in no particular order.
+	List() ([]*Key, error)
+	// Update replaces the metadata of a stored key. Updating a key to
+	// StatusRetired, StatusRevoked or StatusDestroyed destroys its key pair;
+	// only the metadata is kept.
+	Update(key *Key) error
+	// Delete destroys a key pair and removes its metadata.
+	Delete(kid string) error
+	// Decrypt decrypts an RSA-OAEP (SHA-256) ciphertext with the private key
+	// identified by kid.
+	Decrypt(kid string, ciphertext []byte) ([]byte, error)
+}
+
+// memoryBackend keeps keys in memory. An optional persist hook is called with
+// the complete new state before every change takes effect, which is how the
+// file backend writes the key file. Discarded private keys are zeroed.
+type memoryBackend struct {
+	persist func([]*memoryEntry) error
+
+	// keyMu is held for writing while a private key is zeroed, so no
+	// decryption uses it at the same time.
+	keyMu sync.RWMutex
+
+	mu      sync.RWMutex
+	entries map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	key  Key
+	priv *rsa.PrivateKey
+}
+
+// NewMemoryBackend returns a backend that only holds keys in memory, so they
+// are lost on restart.
+func NewMemoryBackend() Backend {
+	return newMemoryBackend(nil)
+}
+
+func newMemoryBackend(entries []*memoryEntry) *memoryBackend {
+	b := &memoryBackend{entries: make(map[string]*memoryEntry, len(entries))}
+	for _, e := range entries {
+		b.entries[e.key.ID] = e
+	}
+
+	return b
+}
+
+func newMemoryEntry(priv *rsa.PrivateKey, meta Key) (*memoryEntry, error) {
+	kid, err := KeyID(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	meta.ID = kid
+	meta.pub = &priv.PublicKey
+
+	return &memoryEntry{key: meta, priv: priv}, nil
+}
+
+func (b *memoryBackend) Generate(bits int, meta Key) (*Key, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Import(priv, meta)
+}
+
+func (b *memoryBackend) Import(priv *rsa.PrivateKey, meta Key) (*Key, error) {
+	e, err := newMemoryEntry(priv, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.change(func(next map[string]*memoryEntry) error {
+		if _, ok := next[e.key.ID]; ok {
+			return ErrKeyExists
+		}
+		next[e.key.ID] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key := e.key
+	return &key, nil
+}
+
+func (b *memoryBackend) ImportTombstone(meta Key) (*Key, error) {
+	if meta.Status != StatusRevoked && meta.Status != StatusDestroyed {
+		return nil, fmt.Errorf("keystore: key %s in status %s is no tombstone", meta.ID, meta.Status)
+	}
+
+	meta.pub = nil
+	e := &memoryEntry{key: meta}
+	err := b.change(func(next map[string]*memoryEntry) error {
+		if _, ok := next[e.key.ID]; ok {
+			return ErrKeyExists
+		}
+		next[e.key.ID] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key := e.key
+	return &key, nil
+}
+
+func (b *memoryBackend) Get(kid string) (*Key, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, ok := b.entries[kid]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	key := e.key
+	return &key, nil
+}
+
+func (b *memoryBackend) List() ([]*Key, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	list := make([]*Key, 0, len(b.entries))
+	for _, e := range b.entries {
+		key := e.key
+		list = append(list, &key)
+	}
+
+	return list, nil
+}
+
+func (b *memoryBackend) Update(key *Key) error {
+	var discarded *rsa.PrivateKey
+
+	err := b.change(func(next map[string]*memoryEntry) error {
+		e, ok := next[key.ID]
+		if !ok {
+			return ErrKeyNotFound
+		}
+
+		updated := &memoryEntry{key: *key, priv: e.priv}
+		updated.key.pub = e.key.pub
+		if !hasKeyMaterial(key.Status) {
+			updated.key.pub = nil
+			updated.priv = nil
+			discarded = e.priv
+		}
+		next[key.ID] = updated
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b.destroy(discarded)
+	return nil
+}
+
+func (b *memoryBackend) Delete(kid string) error {
+	var discarded *rsa.PrivateKey
+
+	err := b.change(func(next map[string]*memoryEntry) error {
+		e, ok := next[kid]
+		if !ok {
+			return ErrKeyNotFound
+		}
+		discarded = e.priv
+		delete(next, kid)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b.destroy(discarded)
+	return nil
+}
+
+// destroy zeroes a private key once it is no longer referenced by the entries.
+func (b *memoryBackend) destroy(priv *rsa.PrivateKey) {
+	if priv == nil {
+		return
+	}
+
+	b.keyMu.Lock()
+	defer b.keyMu.Unlock()
+
+	zeroize(priv)
+}
+
+func (b *memoryBackend) Decrypt(kid string, ciphertext []byte) ([]byte, error) {
+	b.mu.RLock()
+	e, ok := b.entries[kid]
+	b.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if e.priv == nil {
+		return nil, ErrKeyRetired
+	}
+
+	b.keyMu.RLock()
+	defer b.keyMu.RUnlock()
+
+	// The key may have been destroyed since the entry was read.
+	if e.priv.D.Sign() == 0 {
+		return nil, ErrKeyRetired
+	}
+
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, e.priv, ciphertext, nil)
+}
+
+// Export returns a copy of the private key, so a key destroyed during a backup
+// is not zeroed under the caller.
+func (b *memoryBackend) Export(kid string) (*rsa.PrivateKey, error) {
+	b.mu.RLock()
+	e, ok := b.entries[kid]
+	b.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if e.priv == nil {
+		return nil, ErrKeyRetired
+	}
+
+	b.keyMu.RLock()
+	defer b.keyMu.RUnlock()
+
+	if e.priv.D.Sign() == 0 {
+		return nil, ErrKeyRetired
+	}
+
+	return copyPrivateKey(e.priv), nil
+}
+
+// copyPrivateKey returns a deep copy of priv.
+func copyPrivateKey(priv *rsa.PrivateKey) *rsa.PrivateKey {
+	cp := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: new(big.Int).Set(priv.N), E: priv.E},
+		D:         new(big.Int).Set(priv.D),
+	}
+	for _, p := range priv.Primes {
+		cp.Primes = append(cp.Primes, new(big.Int).Set(p))
+	}
+	cp.Precompute()
+
+	return cp
+}
+
+// Close zeroes all private keys and forgets the entries without persisting
+// the change, so the key file stays intact.
+func (b *memoryBackend) Close() error {
+	b.mu.Lock()
+	entries := b.entries
+	b.entries = make(map[string]*memoryEntry)
+	b.mu.Unlock()
+
+	for _, e := range entries {
+		b.destroy(e.priv)
+	}
+
+	return nil
+}
+
+// change applies fn to a copy of the entries, persists the result and makes it
+// the current state. Entries are never modified in place.
+func (b *memoryBackend) change(fn func(next map[string]*memoryEntry) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	next := make(map[string]*memoryEntry, len(b.entries)+1)
+	for kid, e := range b.entries {
+		next[kid] = e
+	}
+
+	if err := fn(next); err != nil {
+		return err
+	}
+
+	if b.persist != nil {
+		list := make([]*memoryEntry, 0, len(next))
+		for _, e := range next {
+			list = append(list, e)
+		}
+		if err := b.persist(list); err != nil {
+			return err
+		}
+	}
+
+	b.entries = next
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package keystore
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	t.Parallel()
+
+	testBackend(t, NewMemoryBackend())
+}
+
+func TestFileBackend(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	b, err := NewFileBackend(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+
+	// Everything testBackend left behind must survive a reload.
+	want, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewFileBackend(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := reloaded.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("reloaded keys want: %d got: %d", len(want), len(got))
+	}
+}
+
+// testBackend checks the contract of the Backend interface.
+func testBackend(t *testing.T, b Backend) {
+	t.Helper()
+
+	created := time.Now().UTC().Truncate(time.Second)
+	key, err := b.Generate(2048, Key{Created: created, Status: StatusActive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid, _ := KeyID(key.PublicKey()); key.ID == "" || key.ID != kid {
+		t.Errorf("generated key ID want: %v got: %v", kid, key.ID)
+	}
+
+	got, err := b.Get(key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusActive || !got.Created.Equal(created) || !got.PublicKey().Equal(key.PublicKey()) {
+		t.Errorf("get key want: %+v got: %+v", key, got)
+	}
+	if _, err := b.Get("unknown"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("get unknown key want: %v got: %v", ErrKeyNotFound, err)
+	}
+
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.PublicKey(), []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := b.Decrypt(key.ID, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" {
+		t.Errorf("decrypt want: %q got: %q", "secret", plaintext)
+	}
+
+	other, err := b.Generate(2048, Key{Created: created, Status: StatusDecryptOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("list want: 2 keys got: %d", len(list))
+	}
+
+	retired := *key
+	retired.Status = StatusRetired
+	retired.Retired = created.Add(time.Hour)
+	if err := b.Update(&retired); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.Get(key.ID); got.Status != StatusRetired || got.PublicKey() != nil {
+		t.Errorf("retired key want no key material, got %+v", got)
+	}
+	if _, err := b.Decrypt(key.ID, ciphertext); err == nil {
+		t.Errorf("decrypt with retired key succeeded")
+	}
+
+	if err := b.Delete(other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(other.ID); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("get deleted key want: %v got: %v", ErrKeyNotFound, err)
+	}
+	if err := b.Delete(other.ID); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("delete unknown key want: %v got: %v", ErrKeyNotFound, err)
+	}
+
+	tombstone := Key{
+		ID:               other.ID,
+		Created:          created,
+		Status:           StatusRevoked,
+		Revoked:          created.Add(time.Hour),
+		RevocationReason: ReasonKeyCompromise,
+	}
+	if _, err := b.ImportTombstone(tombstone); err != nil {
+		t.Fatal(err)
+	}
+	got, err = b.Get(other.ID)
+	if err != nil || got.Status != StatusRevoked || got.RevocationReason != ReasonKeyCompromise || got.PublicKey() != nil {
+		t.Errorf("tombstone want: %+v got: %+v (%v)", tombstone, got, err)
+	}
+	if _, err := b.ImportTombstone(tombstone); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("duplicate tombstone want: %v got: %v", ErrKeyExists, err)
+	}
+	if _, err := b.ImportTombstone(Key{ID: "pending", Status: StatusPending}); err == nil {
+		t.Errorf("tombstone with key material status accepted")
+	}
+}
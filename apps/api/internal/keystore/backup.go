@@ -0,0 +1,458 @@
+package keystore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+	"fmt"
+	"time"
+)
+
+const archiveVersion = 1
+
+// Algorithms protecting the archive key.
+const (
+	ArchiveWrapRSA        = "RSA-OAEP-256"
+	ArchiveWrapPassphrase = "PBKDF2-A256GCM"
+)
+
+var (
+	ErrNotExportable    = errors.New("keystore: backend does not allow exporting private keys")
+	ErrArchiveIntegrity = errors.New("keystore: backup archive integrity check failed")
+)
+
+// Exporter is implemented by backends whose private keys may leave the backend
+// for a backup. Hardware backends do not implement it.
+type Exporter interface {
+	// Export returns a copy of the private key identified by kid, which the
+	// caller zeroes once done with it.
+	Export(kid string) (*rsa.PrivateKey, error)
+}
+
+// BackupKey protects a backup archive. It is either an RSA key pair, of which
+// Backup only needs the public key, or a passphrase.
+type BackupKey struct {
+	PublicKey  *rsa.PublicKey
+	PrivateKey *rsa.PrivateKey
+	Passphrase []byte
+}
+
+// Archive is a keystore backup. A random archive key encrypts every private
+// key with AES-256-GCM and authenticates the whole archive with HMAC-SHA256;
+// the archive key itself is wrapped under the BackupKey. Private keys never
+// appear in plaintext.
+type Archive struct {
+	Version  int             `json:"version"`
+	Created  time.Time       `json:"created"`
+	Wrapping ArchiveWrapping `json:"wrapping"`
+	Keys     []ArchivedKey   `json:"keys"`
+	MAC      []byte          `json:"mac,omitempty"`
+}
+
+type ArchiveWrapping struct {
+	Alg string `json:"alg"`
+	// Kid identifies the backup public key for ArchiveWrapRSA.
+	Kid string `json:"kid,omitempty"`
+	// Salt, Iterations and Nonce parameterize ArchiveWrapPassphrase.
+	Salt       []byte `json:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+type ArchivedKey struct {
+	ID       string     `json:"kid"`
+	Created  time.Time  `json:"created"`
+	Status   Status     `json:"status"`
+	Usages   []Usage    `json:"usages,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	RetireAt *time.Time `json:"retire_at,omitempty"`
+	Retired  *time.Time `json:"retired,omitempty"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+	// RevocationReason is set for revoked keys.
+	RevocationReason RevocationReason `json:"revocation_reason,omitempty"`
+	Destroyed        *time.Time       `json:"destroyed,omitempty"`
+	Nonce            []byte           `json:"nonce,omitempty"`
+	// WrappedKey is the AES-GCM encrypted PKCS#8 private key, empty for
+	// retired, revoked and destroyed keys.
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+}
+
+// Backup exports all keys into an archive protected by bk. Every exported
+// private key is recorded.
+func (ks *Keystore) Backup(ctx context.Context, bk BackupKey) (*Archive, error) {
+	exporter, ok := ks.backend.(Exporter)
+	if !ok {
+		return nil, ks.record(ctx, audit.OpKeyExport, "", ErrNotExportable)
+	}
+
+	ks.lifecycle.Lock()
+	defer ks.lifecycle.Unlock()
+
+	archiveKey := make([]byte, 32)
+	if _, err := rand.Read(archiveKey); err != nil {
+		return nil, err
+	}
+
+	wrapping, err := wrapArchiveKey(archiveKey, bk)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := archiveCipher(archiveKey)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Archive{
+		Version:  archiveVersion,
+		Created:  ks.now().UTC(),
+		Wrapping: *wrapping,
+	}
+	for _, k := range ks.Keys() {
+		ak := ArchivedKey{
+			ID:               k.ID,
+			Created:          k.Created,
+			Status:           k.Status,
+			Usages:           k.Usages,
+			NotAfter:         timePtr(k.NotAfter),
+			RetireAt:         timePtr(k.RetireAt),
+			Retired:          timePtr(k.Retired),
+			Revoked:          timePtr(k.Revoked),
+			RevocationReason: k.RevocationReason,
+			Destroyed:        timePtr(k.Destroyed),
+		}
+
+		if hasKeyMaterial(k.Status) {
+			priv, err := exporter.Export(k.ID)
+			if err != nil {
+				err = fmt.Errorf("error exporting key %s: %w", k.ID, err)
+			}
+			if err := ks.record(ctx, audit.OpKeyExport, k.ID, err); err != nil {
+				return nil, err
+			}
+			der, err := x509.MarshalPKCS8PrivateKey(priv)
+			zeroize(priv)
+			if err != nil {
+				return nil, err
+			}
+
+			ak.Nonce = make([]byte, gcm.NonceSize())
+			if _, err := rand.Read(ak.Nonce); err != nil {
+				return nil, err
+			}
+			ak.WrappedKey = gcm.Seal(nil, ak.Nonce, der, []byte(k.ID))
+		}
+
+		a.Keys = append(a.Keys, ak)
+	}
+
+	if a.MAC, err = archiveMAC(a, archiveKey); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Restore verifies the integrity of a and unwraps all of its keys before any
+// of them is loaded. Keys already in the keystore are skipped; revoked and
+// destroyed keys are refused, which is recorded as a failure. Revoked and
+// destroyed keys in the archive are restored as tombstones, revoking or
+// destroying the key pair if the keystore still holds it, so later restores
+// refuse them too. If the archive holds an active key, it replaces the current
+// active key, which enters its grace period. Restore returns the restored
+// keys.
+func (ks *Keystore) Restore(ctx context.Context, a *Archive, bk BackupKey) ([]*Key, error) {
+	keys, err := ks.restore(ctx, a, bk)
+	if err != nil {
+		// Restored keys are recorded one by one; a failure is recorded
+		// once, as most happen before any key is known.
+		return keys, ks.record(ctx, audit.OpKeyRestore, "", err)
+	}
+
+	return keys, nil
+}
+
+func (ks *Keystore) restore(ctx context.Context, a *Archive, bk BackupKey) ([]*Key, error) {
+	if a.Version != archiveVersion {
+		return nil, fmt.Errorf("keystore: unsupported archive version %d", a.Version)
+	}
+
+	archiveKey, err := unwrapArchiveKey(&a.Wrapping, bk)
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := archiveMAC(a, archiveKey)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, a.MAC) {
+		return nil, ErrArchiveIntegrity
+	}
+
+	gcm, err := archiveCipher(archiveKey)
+	if err != nil {
+		return nil, err
+	}
+
+	type restoredKey struct {
+		meta Key
+		priv *rsa.PrivateKey
+	}
+	restored := make([]restoredKey, 0, len(a.Keys))
+	for _, ak := range a.Keys {
+		meta := Key{
+			ID:               ak.ID,
+			Created:          ak.Created,
+			Status:           ak.Status,
+			Usages:           ak.Usages,
+			NotAfter:         timeValue(ak.NotAfter),
+			RetireAt:         timeValue(ak.RetireAt),
+			Retired:          timeValue(ak.Retired),
+			Revoked:          timeValue(ak.Revoked),
+			RevocationReason: ak.RevocationReason,
+			Destroyed:        timeValue(ak.Destroyed),
+		}
+		switch meta.Status {
+		case StatusRevoked, StatusDestroyed:
+			restored = append(restored, restoredKey{meta: meta})
+			continue
+		case StatusRetired:
+			// Retired keys carry no key material to restore.
+			continue
+		}
+
+		if len(ak.Nonce) != gcm.NonceSize() {
+			return nil, ErrArchiveIntegrity
+		}
+		der, err := gcm.Open(nil, ak.Nonce, ak.WrappedKey, []byte(ak.ID))
+		if err != nil {
+			return nil, ErrArchiveIntegrity
+		}
+		priv, err := parsePKCS8RSA(der)
+		if err != nil {
+			return nil, fmt.Errorf("keystore: archived key %s: %w", ak.ID, err)
+		}
+		if kid, err := KeyID(&priv.PublicKey); err != nil || kid != ak.ID {
+			return nil, fmt.Errorf("keystore: archived key %s does not match its key ID", ak.ID)
+		}
+
+		restored = append(restored, restoredKey{meta: meta, priv: priv})
+	}
+
+	ks.lifecycle.Lock()
+	defer ks.lifecycle.Unlock()
+
+	if ks.closed {
+		return nil, ErrClosed
+	}
+
+	previous := ks.ActiveKey()
+	var keys []*Key
+	for _, r := range restored {
+		if r.priv == nil {
+			key, err := ks.restoreTombstone(r.meta)
+			if err != nil {
+				return keys, fmt.Errorf("error restoring key %s: %w", r.meta.ID, err)
+			}
+			if key == nil {
+				continue
+			}
+			keys = append(keys, key)
+			if err := ks.record(ctx, audit.OpKeyRestore, key.ID, nil); err != nil {
+				return keys, err
+			}
+			if previous != nil && previous.ID == key.ID {
+				previous = nil
+			}
+			continue
+		}
+
+		if known, ok := ks.lookup(r.meta.ID); ok {
+			var refused error
+			switch known.Status {
+			case StatusRevoked:
+				refused = ErrKeyRevoked
+			case StatusDestroyed:
+				refused = ErrKeyDestroyed
+			}
+			if refused != nil {
+				// The key is skipped whether or not the refusal is recorded.
+				ks.record(ctx, audit.OpKeyRestore, r.meta.ID, fmt.Errorf("error restoring key %s: %w", r.meta.ID, refused))
+			}
+			continue
+		}
+
+		key, err := ks.backend.Import(r.priv, r.meta)
+		if err != nil {
+			return keys, fmt.Errorf("error restoring key %s: %w", r.meta.ID, err)
+		}
+		ks.put(key)
+		keys = append(keys, key)
+		if err := ks.record(ctx, audit.OpKeyRestore, key.ID, nil); err != nil {
+			return keys, err
+		}
+
+		if key.Status == StatusActive && previous != nil && previous.ID != key.ID {
+			if _, err := ks.demote(previous, ks.now().UTC()); err != nil {
+				return keys, fmt.Errorf("error demoting key %s: %w", previous.ID, err)
+			}
+			previous = nil
+		}
+	}
+
+	return keys, nil
+}
+
+// restoreTombstone stores the revoked or destroyed key meta. A key the
+// keystore still holds is revoked or destroyed as in the archive; nil is
+// returned if the keystore already knows it as revoked or destroyed. The
+// caller holds ks.lifecycle.
+func (ks *Keystore) restoreTombstone(meta Key) (*Key, error) {
+	known, ok := ks.lookup(meta.ID)
+	if !ok {
+		key, err := ks.backend.ImportTombstone(meta)
+		if err != nil {
+			return nil, err
+		}
+		ks.put(key)
+		return key, nil
+	}
+	if known.Status == StatusRevoked || known.Status == StatusDestroyed {
+		return nil, nil
+	}
+
+	tombstone := *known
+	tombstone.Status = meta.Status
+	tombstone.Revoked = meta.Revoked
+	tombstone.RevocationReason = meta.RevocationReason
+	tombstone.Destroyed = meta.Destroyed
+	tombstone.pub = nil
+	if err := ks.backend.Update(&tombstone); err != nil {
+		return nil, err
+	}
+	ks.put(&tombstone)
+
+	return &tombstone, nil
+}
+
+func wrapArchiveKey(archiveKey []byte, bk BackupKey) (*ArchiveWrapping, error) {
+	switch {
+	case bk.PublicKey != nil:
+		kid, err := KeyID(bk.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, bk.PublicKey, archiveKey, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ArchiveWrapping{Alg: ArchiveWrapRSA, Kid: kid, WrappedKey: wrapped}, nil
+	case len(bk.Passphrase) > 0:
+		salt := make([]byte, kdfSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		gcm, err := newFileCipher(bk.Passphrase, salt, kdfIterations)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+
+		return &ArchiveWrapping{
+			Alg:        ArchiveWrapPassphrase,
+			Salt:       salt,
+			Iterations: kdfIterations,
+			Nonce:      nonce,
+			WrappedKey: gcm.Seal(nil, nonce, archiveKey, []byte(ArchiveWrapPassphrase)),
+		}, nil
+	default:
+		return nil, errors.New("keystore: backup needs a public key or a passphrase")
+	}
+}
+
+func unwrapArchiveKey(w *ArchiveWrapping, bk BackupKey) ([]byte, error) {
+	switch w.Alg {
+	case ArchiveWrapRSA:
+		if bk.PrivateKey == nil {
+			return nil, errors.New("keystore: archive is wrapped under a backup key pair, private key required")
+		}
+		if kid, err := KeyID(&bk.PrivateKey.PublicKey); err != nil || kid != w.Kid {
+			return nil, fmt.Errorf("keystore: archive is wrapped under backup key %s", w.Kid)
+		}
+		archiveKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, bk.PrivateKey, w.WrappedKey, nil)
+		if err != nil {
+			return nil, ErrArchiveIntegrity
+		}
+		return archiveKey, nil
+	case ArchiveWrapPassphrase:
+		if len(bk.Passphrase) == 0 {
+			return nil, errors.New("keystore: archive is wrapped under a passphrase")
+		}
+		// The iteration count is read before the archive is authenticated,
+		// so only the count Backup writes is accepted.
+		if w.Iterations != kdfIterations {
+			return nil, ErrArchiveIntegrity
+		}
+		gcm, err := newFileCipher(bk.Passphrase, w.Salt, w.Iterations)
+		if err != nil {
+			return nil, err
+		}
+		if len(w.Nonce) != gcm.NonceSize() {
+			return nil, ErrArchiveIntegrity
+		}
+		archiveKey, err := gcm.Open(nil, w.Nonce, w.WrappedKey, []byte(ArchiveWrapPassphrase))
+		if err != nil {
+			return nil, ErrWrongPassphrase
+		}
+		return archiveKey, nil
+	default:
+		return nil, fmt.Errorf("keystore: unsupported archive wrapping %q", w.Alg)
+	}
+}
+
+// archiveCipher and archiveMAC use separate keys derived from the archive key.
+func archiveCipher(archiveKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveArchiveKey(archiveKey, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// archiveMAC authenticates the JSON encoding of a without its MAC.
+func archiveMAC(a *Archive, archiveKey []byte) ([]byte, error) {
+	unsigned := *a
+	unsigned.MAC = nil
+
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, deriveArchiveKey(archiveKey, "authentication"))
+	mac.Write(data)
+
+	return mac.Sum(nil), nil
+}
+
+func deriveArchiveKey(archiveKey []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, archiveKey)
+	mac.Write([]byte("ezzy-web-crypto backup " + purpose))
+
+	return mac.Sum(nil)
+}
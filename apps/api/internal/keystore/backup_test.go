@@ -0,0 +1,132 @@
+package keystore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore(t *testing.T) {
+	t.Parallel()
+
+	backupKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		backup  BackupKey
+		restore BackupKey
+	}{
+		{
+			name:    "key pair",
+			backup:  BackupKey{PublicKey: &backupKey.PublicKey},
+			restore: BackupKey{PrivateKey: backupKey},
+		},
+		{
+			name:    "passphrase",
+			backup:  BackupKey{Passphrase: []byte("correct horse battery staple")},
+			restore: BackupKey{Passphrase: []byte("correct horse battery staple")},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			src := New(Options{Bits: 2048, GracePeriod: time.Hour})
+			old, err := src.Rotate(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			active, err := src.Rotate(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			archive, err := src.Backup(context.Background(), tt.backup)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dst := New(Options{Bits: 2048, GracePeriod: time.Hour})
+			previous, err := dst.Rotate(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys, err := dst.Restore(context.Background(), archive, tt.restore)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 2 {
+				t.Fatalf("restored keys want: %v got: %v", 2, len(keys))
+			}
+
+			if got := dst.ActiveKey(); got.ID != active.ID {
+				t.Errorf("active key want: %v got: %v", active.ID, got.ID)
+			}
+			if got, _ := dst.Get(previous.ID); got.Status != StatusDecryptOnly {
+				t.Errorf("replaced key status want: %v got: %v", StatusDecryptOnly, got.Status)
+			}
+
+			ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, old.PublicKey(), []byte("secret"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := dst.Decrypt(context.Background(), old.ID, UsageDecrypt, ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != "secret" {
+				t.Errorf("decrypt want: %q got: %q", "secret", plaintext)
+			}
+
+			// Restoring twice is a no-op.
+			if keys, err := dst.Restore(context.Background(), archive, tt.restore); err != nil || len(keys) != 0 {
+				t.Errorf("second restore want: 0 keys got: %v keys, %v", len(keys), err)
+			}
+		})
+	}
+}
+
+func TestRestoreRejectsTamperedArchive(t *testing.T) {
+	t.Parallel()
+
+	bk := BackupKey{Passphrase: []byte("secret")}
+
+	src := New(Options{Bits: 2048})
+	if _, err := src.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := src.Backup(context.Background(), bk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := *archive
+	tampered.Keys = append([]ArchivedKey(nil), archive.Keys...)
+	tampered.Keys[0].Status = StatusDecryptOnly
+
+	dst := New(Options{})
+	if _, err := dst.Restore(context.Background(), &tampered, bk); !errors.Is(err, ErrArchiveIntegrity) {
+		t.Errorf("restore of tampered archive want: %v got: %v", ErrArchiveIntegrity, err)
+	}
+	expensive := *archive
+	expensive.Wrapping.Iterations = 1<<31 - 1
+	if _, err := dst.Restore(context.Background(), &expensive, bk); !errors.Is(err, ErrArchiveIntegrity) {
+		t.Errorf("restore with raised iteration count want: %v got: %v", ErrArchiveIntegrity, err)
+	}
+	if _, err := dst.Restore(context.Background(), archive, BackupKey{Passphrase: []byte("not the secret")}); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("restore with wrong passphrase want: %v got: %v", ErrWrongPassphrase, err)
+	}
+	if keys := dst.Keys(); len(keys) != 0 {
+		t.Errorf("failed restores loaded %d key(s)", len(keys))
+	}
+}
@@ -0,0 +1,372 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/fileutil"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The key file is protected the same way the TS library derives keys from
+// passwords (aesFromPassword): PBKDF2-SHA256 with 250000 iterations and a
+// 16 byte salt, producing an AES-256-GCM key. Key files protected by a master
+// key derive the AES key with HKDF-SHA256 from the master key and the salt
+// instead.
+const (
+	fileVersion    = 2
+	kdfIterations  = 250000
+	kdfSaltSize    = 16
+	kdfKeySize     = 32
+	fileAADPattern = "ezzy-web-crypto keystore v%d"
+)
+
+var (
+	ErrWrongPassphrase     = errors.New("keystore: wrong passphrase or corrupted key file")
+	ErrMasterKeyRequired   = errors.New("keystore: key file is protected by a master key")
+	errInvalidMasterKeyLen = errors.New("keystore: master key must be 32 bytes")
+)
+
+type keyFile struct {
+	Version    int       `json:"version"`
+	KDF        kdfParams `json:"kdf"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"`
+}
+
+type kdfParams struct {
+	Name       string `json:"name"`
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations,omitempty"`
+	Salt       []byte `json:"salt"`
+}
+
+type keyFilePayload struct {
+	Keys []storedKey `json:"keys"`
+}
+
+type storedKey struct {
+	ID       string     `json:"kid"`
+	Created  time.Time  `json:"created"`
+	Status   Status     `json:"status"`
+	Usages   []Usage    `json:"usages,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	RetireAt *time.Time `json:"retire_at,omitempty"`
+	Retired  *time.Time `json:"retired,omitempty"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+	// RevocationReason is set for revoked keys.
+	RevocationReason RevocationReason `json:"revocation_reason,omitempty"`
+	Destroyed        *time.Time       `json:"destroyed,omitempty"`
+	PrivateKey       []byte           `json:"private_key,omitempty"` // PKCS#8 DER
+}
+
+// keyFilePayloadV1 is the payload of version 1 key files, which held a single
+// key.
+type keyFilePayloadV1 struct {
+	PrivateKey []byte `json:"private_key"` // PKCS#8 DER
+}
+
+type persistence struct {
+	path       string
+	passphrase []byte
+	// masterKey protects the key file instead of passphrase if set.
+	masterKey []byte
+}
+
+// NewFileBackend returns a backend that keeps keys in memory and writes them to
+// an encrypted key file on every change. Existing keys in the file are loaded.
+func NewFileBackend(path string, passphrase []byte) (Backend, error) {
+	p := &persistence{path: path, passphrase: passphrase}
+
+	entries, err := p.load()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	b := newMemoryBackend(entries)
+	b.persist = p.save
+
+	return b, nil
+}
+
+// NewFileBackendWithKey is NewFileBackend for a key file protected by a 32
+// byte master key, e.g. one recovered by unsealing, instead of a passphrase.
+// A key file still protected by passphrase is loaded with it and encrypted
+// under the master key right away. The backend keeps using masterKey, so it
+// must be closed before masterKey is wiped.
+func NewFileBackendWithKey(path string, masterKey, passphrase []byte) (Backend, error) {
+	if len(masterKey) != kdfKeySize {
+		return nil, errInvalidMasterKeyLen
+	}
+	p := &persistence{path: path, passphrase: passphrase, masterKey: masterKey}
+
+	entries, err := p.load()
+	if errors.Is(err, os.ErrNotExist) {
+		entries, err = nil, nil
+	} else if err == nil {
+		err = p.save(entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := newMemoryBackend(entries)
+	b.persist = p.save
+
+	return b, nil
+}
+
+func (p *persistence) load() ([]*memoryEntry, error) {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("keystore: malformed key file: %w", err)
+	}
+	if kf.Version != 1 && kf.Version != fileVersion {
+		return nil, fmt.Errorf("keystore: unsupported key file version %d", kf.Version)
+	}
+
+	gcm, err := p.cipher(kf.KDF)
+	if err != nil {
+		return nil, err
+	}
+	if len(kf.Nonce) != gcm.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+
+	plaintext, err := gcm.Open(nil, kf.Nonce, kf.Ciphertext, fileAAD(kf.Version))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	var payload keyFilePayload
+	if kf.Version == 1 {
+		payload, err = migrateV1(plaintext)
+	} else {
+		err = json.Unmarshal(plaintext, &payload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("keystore: malformed key file payload: %w", err)
+	}
+
+	list := make([]*memoryEntry, 0, len(payload.Keys))
+	for _, sk := range payload.Keys {
+		e, err := sk.entry()
+		if err != nil {
+			return nil, fmt.Errorf("keystore: key %s: %w", sk.ID, err)
+		}
+		list = append(list, e)
+	}
+
+	return list, nil
+}
+
+func (sk *storedKey) entry() (*memoryEntry, error) {
+	meta := Key{
+		ID:               sk.ID,
+		Created:          sk.Created,
+		Status:           sk.Status,
+		Usages:           sk.Usages,
+		NotAfter:         timeValue(sk.NotAfter),
+		RetireAt:         timeValue(sk.RetireAt),
+		Retired:          timeValue(sk.Retired),
+		Revoked:          timeValue(sk.Revoked),
+		RevocationReason: sk.RevocationReason,
+		Destroyed:        timeValue(sk.Destroyed),
+	}
+
+	switch sk.Status {
+	case StatusRetired, StatusRevoked, StatusDestroyed:
+		// Retired, revoked and destroyed keys are kept for the record only,
+		// without key material.
+		return &memoryEntry{key: meta}, nil
+	case StatusPending, StatusActive, StatusDecryptOnly:
+	default:
+		return nil, fmt.Errorf("unknown status %q", sk.Status)
+	}
+
+	priv, err := parsePKCS8RSA(sk.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := newMemoryEntry(priv, meta)
+	if err != nil {
+		return nil, err
+	}
+	if sk.ID != "" && sk.ID != e.key.ID {
+		return nil, errors.New("private key does not match its key ID")
+	}
+
+	return e, nil
+}
+
+// migrateV1 turns the single key of a version 1 key file into the active key.
+func migrateV1(plaintext []byte) (keyFilePayload, error) {
+	var v1 keyFilePayloadV1
+	if err := json.Unmarshal(plaintext, &v1); err != nil {
+		return keyFilePayload{}, err
+	}
+
+	return keyFilePayload{Keys: []storedKey{{
+		Status:     StatusActive,
+		PrivateKey: v1.PrivateKey,
+	}}}, nil
+}
+
+func parsePKCS8RSA(der []byte) (*rsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("malformed private key: %w", err)
+	}
+
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+
+	return priv, nil
+}
+
+// save encrypts entries under a freshly salted passphrase or master key
+// derived key and atomically replaces the key file.
+func (p *persistence) save(entries []*memoryEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return keyLess(&entries[i].key, &entries[j].key)
+	})
+
+	payload := keyFilePayload{Keys: make([]storedKey, 0, len(entries))}
+	for _, e := range entries {
+		sk := storedKey{
+			ID:               e.key.ID,
+			Created:          e.key.Created,
+			Status:           e.key.Status,
+			Usages:           e.key.Usages,
+			NotAfter:         timePtr(e.key.NotAfter),
+			RetireAt:         timePtr(e.key.RetireAt),
+			Retired:          timePtr(e.key.Retired),
+			Revoked:          timePtr(e.key.Revoked),
+			RevocationReason: e.key.RevocationReason,
+			Destroyed:        timePtr(e.key.Destroyed),
+		}
+		if e.priv != nil {
+			der, err := x509.MarshalPKCS8PrivateKey(e.priv)
+			if err != nil {
+				return err
+			}
+			sk.PrivateKey = der
+		}
+		payload.Keys = append(payload.Keys, sk)
+	}
+
+	plaintext, err := json.Marshal(&payload)
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, kdfSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	kdf := kdfParams{Name: "PBKDF2", Hash: "SHA-256", Iterations: kdfIterations, Salt: salt}
+	if p.masterKey != nil {
+		kdf = kdfParams{Name: "HKDF", Hash: "SHA-256", Salt: salt}
+	}
+
+	gcm, err := p.cipher(kdf)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(&keyFile{
+		Version:    fileVersion,
+		KDF:        kdf,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, fileAAD(fileVersion)),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteFileAtomic(p.path, data)
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func timeValue(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// cipher returns the cipher of a key file with the given key derivation.
+func (p *persistence) cipher(kdf kdfParams) (cipher.AEAD, error) {
+	switch {
+	case kdf.Name == "PBKDF2" && kdf.Hash == "SHA-256":
+		// The iteration count is read before the key file is authenticated,
+		// so only the count save writes is accepted.
+		if kdf.Iterations != kdfIterations {
+			return nil, fmt.Errorf("%w: PBKDF2 with %d iterations", ErrWrongPassphrase, kdf.Iterations)
+		}
+		return newFileCipher(p.passphrase, kdf.Salt, kdf.Iterations)
+	case kdf.Name == "HKDF" && kdf.Hash == "SHA-256":
+		if p.masterKey == nil {
+			return nil, ErrMasterKeyRequired
+		}
+		key := make([]byte, kdfKeySize)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, p.masterKey, kdf.Salt, []byte("ezzy-web-crypto keystore file")), key); err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, fmt.Errorf("keystore: unsupported key derivation %s/%s", kdf.Name, kdf.Hash)
+	}
+}
+
+func newFileCipher(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	key := pbkdf2.Key(passphrase, salt, iterations, kdfKeySize, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func fileAAD(version int) []byte {
+	return []byte(fmt.Sprintf(fileAADPattern, version))
+}
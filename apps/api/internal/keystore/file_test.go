@@ -0,0 +1,219 @@
+package keystore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntry(t *testing.T, status Status) *memoryEntry {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := newMemoryEntry(priv, Key{
+		Created: time.Now().UTC().Truncate(time.Second),
+		Status:  status,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	retired := &memoryEntry{key: Key{
+		ID:       "retired",
+		Created:  time.Now().UTC().Add(-72 * time.Hour).Truncate(time.Second),
+		Status:   StatusRetired,
+		RetireAt: time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second),
+		Retired:  time.Now().UTC().Add(-23 * time.Hour).Truncate(time.Second),
+	}}
+	decryptOnly := testEntry(t, StatusDecryptOnly)
+	decryptOnly.key.RetireAt = time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	entries := []*memoryEntry{retired, decryptOnly, testEntry(t, StatusActive)}
+
+	p := &persistence{
+		path:       filepath.Join(t.TempDir(), "keystore.json"),
+		passphrase: []byte("correct horse battery staple"),
+	}
+	if err := p.save(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file permissions want: %o got: %o", 0600, perm)
+	}
+
+	loaded, err := p.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(entries) {
+		t.Fatalf("loaded %d keys, want %d", len(loaded), len(entries))
+	}
+
+	got := make(map[string]*memoryEntry, len(loaded))
+	for _, e := range loaded {
+		got[e.key.ID] = e
+	}
+	for _, want := range entries {
+		e, ok := got[want.key.ID]
+		if !ok {
+			t.Errorf("key %v missing after load", want.key.ID)
+			continue
+		}
+		if e.key.Status != want.key.Status || !e.key.Created.Equal(want.key.Created) ||
+			!e.key.RetireAt.Equal(want.key.RetireAt) || !e.key.Retired.Equal(want.key.Retired) {
+			t.Errorf("key %v metadata want: %+v got: %+v", want.key.ID, want.key, e.key)
+		}
+		if want.priv == nil {
+			if e.priv != nil {
+				t.Errorf("key %v gained a private key", want.key.ID)
+			}
+		} else if !e.priv.Equal(want.priv) {
+			t.Errorf("key %v does not match saved key", want.key.ID)
+		}
+	}
+}
+
+func TestKeyFileWrongPassphrase(t *testing.T) {
+	t.Parallel()
+
+	entries := []*memoryEntry{testEntry(t, StatusActive)}
+
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	if err := (&persistence{path: path, passphrase: []byte("secret")}).save(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := (&persistence{path: path, passphrase: []byte("not the secret")}).load()
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("load with wrong passphrase want: %v got: %v", ErrWrongPassphrase, err)
+	}
+}
+
+func TestKeyFileTampered(t *testing.T) {
+	t.Parallel()
+
+	entries := []*memoryEntry{testEntry(t, StatusActive)}
+
+	p := &persistence{
+		path:       filepath.Join(t.TempDir(), "keystore.json"),
+		passphrase: []byte("secret"),
+	}
+	if err := p.save(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lowering the iteration count must not go unnoticed, raising it must not
+	// keep the CPU busy before the file is authenticated.
+	for _, iterations := range []string{"1", "2147483647"} {
+		tampered := []byte(strings.Replace(string(data), `"iterations": 250000`, `"iterations": `+iterations, 1))
+		if err := ioutil.WriteFile(p.path, tampered, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := p.load(); !errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("load with %s iterations want: %v got: %v", iterations, ErrWrongPassphrase, err)
+		}
+	}
+}
+
+func TestKeyFileMasterKey(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	passphrase := []byte("secret")
+	entries := []*memoryEntry{testEntry(t, StatusActive)}
+	if err := (&persistence{path: path, passphrase: passphrase}).save(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	masterKey := make([]byte, 32)
+	if _, err := rand.Read(masterKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The passphrase protected file is migrated to the master key.
+	b, err := NewFileBackendWithKey(path, masterKey, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(entries[0].key.ID); err != nil {
+		t.Fatalf("migrated key: %v", err)
+	}
+
+	if _, err := (&persistence{path: path, passphrase: passphrase}).load(); !errors.Is(err, ErrMasterKeyRequired) {
+		t.Errorf("load with passphrase only want: %v got: %v", ErrMasterKeyRequired, err)
+	}
+
+	wrongKey := make([]byte, 32)
+	if _, err := NewFileBackendWithKey(path, wrongKey, nil); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("load with wrong master key want: %v got: %v", ErrWrongPassphrase, err)
+	}
+
+	loaded, err := (&persistence{path: path, masterKey: masterKey}).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || !loaded[0].priv.Equal(entries[0].priv) {
+		t.Errorf("key after migration does not match saved key")
+	}
+}
+
+func TestKeystoreClose(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	backend, err := NewFileBackend(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := Open(Options{Backend: backend, Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := ks.ActiveKey()
+	priv := backend.(*memoryBackend).entries[active.ID].priv
+
+	if err := ks.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if priv.D.Sign() != 0 {
+		t.Error("private key not zeroed on close")
+	}
+	if _, err := ks.Rotate(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("rotate after close want: %v got: %v", ErrClosed, err)
+	}
+
+	// The key file is left intact.
+	backend, err = NewFileBackend(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Get(active.ID); err != nil {
+		t.Errorf("key after reopening: %v", err)
+	}
+}
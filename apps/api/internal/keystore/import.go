@@ -0,0 +1,176 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Key sizes accepted by ParsePrivateKey.
+const (
+	MinImportBits = 2048
+	MaxImportBits = 8192
+)
+
+// Private key encodings understood by ParsePrivateKey.
+const (
+	FormatAuto  = ""
+	FormatPKCS8 = "pkcs8"
+	FormatPKCS1 = "pkcs1"
+	FormatPEM   = "pem"
+	FormatJWK   = "jwk"
+)
+
+var ErrInvalidKey = errors.New("keystore: invalid private key")
+
+// ParsePrivateKey parses an RSA private key in PKCS#8 or PKCS#1 DER, PEM
+// ("PRIVATE KEY" or "RSA PRIVATE KEY" blocks) or JWK form and validates it.
+// FormatAuto detects the encoding.
+func ParsePrivateKey(data []byte, format string) (*rsa.PrivateKey, error) {
+	if format == FormatAuto {
+		format = detectFormat(data)
+	}
+
+	var (
+		priv *rsa.PrivateKey
+		err  error
+	)
+	switch format {
+	case FormatPKCS8:
+		priv, err = parsePKCS8RSA(data)
+	case FormatPKCS1:
+		priv, err = x509.ParsePKCS1PrivateKey(data)
+	case FormatPEM:
+		priv, err = parsePEM(data)
+	case FormatJWK:
+		priv, err = parseJWK(data)
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidKey, format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	if err := validateImport(priv); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	return priv, nil
+}
+
+func detectFormat(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("-----BEGIN")):
+		return FormatPEM
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return FormatJWK
+	}
+
+	// PKCS#8 wraps the PKCS#1 structure in an algorithm identifier, so only a
+	// PKCS#8 key parses as PKCS#8.
+	if _, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+		return FormatPKCS8
+	}
+	return FormatPKCS1
+}
+
+func parsePEM(data []byte) (*rsa.PrivateKey, error) {
+	block, rest := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, errors.New("more than one PEM block")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		return parsePKCS8RSA(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+type privateJWK struct {
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	D   string `json:"d"`
+	P   string `json:"p"`
+	Q   string `json:"q"`
+	Dp  string `json:"dp"`
+	Dq  string `json:"dq"`
+	Qi  string `json:"qi"`
+}
+
+func parseJWK(data []byte) (*rsa.PrivateKey, error) {
+	var jwk privateJWK
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, fmt.Errorf("malformed JWK: %v", err)
+	}
+	if jwk.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+	// The keystore decrypts with RSA-OAEP and SHA-256 only.
+	if jwk.Alg != "" && jwk.Alg != "RSA-OAEP-256" {
+		return nil, fmt.Errorf("unsupported algorithm %q", jwk.Alg)
+	}
+
+	var fields [8]*big.Int
+	for i, v := range []string{jwk.N, jwk.E, jwk.D, jwk.P, jwk.Q, jwk.Dp, jwk.Dq, jwk.Qi} {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("JWK is missing private key parameters")
+		}
+		fields[i] = new(big.Int).SetBytes(b)
+	}
+	if !fields[1].IsInt64() || fields[1].Int64() > 1<<31-1 {
+		return nil, errors.New("public exponent too large")
+	}
+
+	priv := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: fields[0], E: int(fields[1].Int64())},
+		D:         fields[2],
+		Primes:    []*big.Int{fields[3], fields[4]},
+	}
+	// Precompute leaves the CRT values nil for keys it cannot use, so the key
+	// is validated first.
+	if err := validateImport(priv); err != nil {
+		return nil, err
+	}
+	priv.Precompute()
+
+	// The CRT parameters are recomputed from the primes and must match.
+	pre := priv.Precomputed
+	if pre.Dp == nil || pre.Dq == nil || pre.Qinv == nil ||
+		pre.Dp.Cmp(fields[5]) != 0 || pre.Dq.Cmp(fields[6]) != 0 || pre.Qinv.Cmp(fields[7]) != 0 {
+		return nil, errors.New("inconsistent CRT parameters")
+	}
+
+	return priv, nil
+}
+
+func validateImport(priv *rsa.PrivateKey) error {
+	if err := priv.Validate(); err != nil {
+		return err
+	}
+
+	if bits := priv.N.BitLen(); bits < MinImportBits || bits > MaxImportBits {
+		return fmt.Errorf("key size %d bits outside %d-%d", bits, MinImportBits, MaxImportBits)
+	}
+	if priv.E < 3 || priv.E%2 == 0 {
+		return fmt.Errorf("invalid public exponent %d", priv.E)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package keystore
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	t.Parallel()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := x509.MarshalPKCS1PrivateKey(priv)
+
+	cases := []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"pkcs8", pkcs8, FormatPKCS8},
+		{"pkcs8 detected", pkcs8, FormatAuto},
+		{"pkcs1", pkcs1, FormatPKCS1},
+		{"pkcs1 detected", pkcs1, FormatAuto},
+		{"pem pkcs8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), FormatPEM},
+		{"pem pkcs1 detected", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: pkcs1}), FormatAuto},
+		{"jwk detected", testJWK(t, priv, nil), FormatAuto},
+	}
+	for _, c := range cases {
+		got, err := ParsePrivateKey(c.data, c.format)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !got.Equal(priv) {
+			t.Errorf("%s: parsed key does not match", c.name)
+		}
+	}
+}
+
+// TestParseWebCryptoExports parses a key exported by WebCrypto (as the TS
+// exportPrivateKeyAsPkcs8 does) in PKCS#8 and JWK form.
+func TestParseWebCryptoExports(t *testing.T) {
+	t.Parallel()
+
+	b64, err := ioutil.ReadFile("testdata/webcrypto-pkcs8.b64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := ioutil.ReadFile("testdata/webcrypto-jwk.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromPKCS8, err := ParsePrivateKey(pkcs8, FormatAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJWK, err := ParsePrivateKey(jwk, FormatAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromPKCS8.Equal(fromJWK) {
+		t.Errorf("PKCS#8 and JWK exports parse to different keys")
+	}
+}
+
+func TestParsePrivateKeyRejects(t *testing.T) {
+	t.Parallel()
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"too small", x509.MarshalPKCS1PrivateKey(small)},
+		{"not rsa", ecPKCS8},
+		{"garbage", []byte("garbage")},
+		{"public key pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{0}})},
+		{"jwk bad crt", testJWK(t, priv, func(m map[string]string) { m["qi"] = m["dp"] })},
+		{"jwk other alg", testJWK(t, priv, func(m map[string]string) { m["alg"] = "RSA-OAEP" })},
+		{"jwk public only", testJWK(t, priv, func(m map[string]string) { delete(m, "d") })},
+		{"jwk p equals q", testJWK(t, priv, func(m map[string]string) { m["p"] = m["q"] })},
+		{"jwk p one", testJWK(t, priv, func(m map[string]string) { m["p"] = "AQ" })},
+		{"jwk p four", testJWK(t, priv, func(m map[string]string) { m["p"] = "BA" })},
+		{"jwk n one", testJWK(t, priv, func(m map[string]string) { m["n"] = "AQ" })},
+		{"jwk e one", testJWK(t, priv, func(m map[string]string) { m["e"] = "AQ" })},
+	}
+	for _, c := range cases {
+		if _, err := ParsePrivateKey(c.data, FormatAuto); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("%s: want %v got: %v", c.name, ErrInvalidKey, err)
+		}
+	}
+}
+
+func TestKeystoreImport(t *testing.T) {
+	t.Parallel()
+
+	ks, err := Open(Options{Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated := ks.ActiveKey()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := ks.Import(context.Background(), priv, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active := ks.ActiveKey(); active.ID != imported.ID {
+		t.Errorf("active key want: %v got: %v", imported.ID, active.ID)
+	}
+	if key, err := ks.Get(generated.ID); err != nil || key.Status != StatusDecryptOnly {
+		t.Errorf("previous key want decrypt-only, got %v (%v)", key, err)
+	}
+
+	if _, err := ks.Import(context.Background(), priv, false, nil); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("duplicate import want: %v got: %v", ErrKeyExists, err)
+	}
+}
+
+func testJWK(t *testing.T, priv *rsa.PrivateKey, modify func(map[string]string)) []byte {
+	t.Helper()
+
+	priv.Precompute()
+	enc := base64.RawURLEncoding.EncodeToString
+	m := map[string]string{
+		"kty": "RSA",
+		"n":   enc(priv.N.Bytes()),
+		"e":   "AQAB",
+		"d":   enc(priv.D.Bytes()),
+		"p":   enc(priv.Primes[0].Bytes()),
+		"q":   enc(priv.Primes[1].Bytes()),
+		"dp":  enc(priv.Precomputed.Dp.Bytes()),
+		"dq":  enc(priv.Precomputed.Dq.Bytes()),
+		"qi":  enc(priv.Precomputed.Qinv.Bytes()),
+	}
+	if modify != nil {
+		modify(m)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
@@ -1,61 +1,747 @@
 package keystore
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
 )
 
-var rsaKey *rsa.PrivateKey
+type Status string
 
-func NewKeyPair() error {
-	reader := rand.Reader
-	bitSize := 4096
+// A key starts out active and is handed out for new encryptions. Rotating
+// demotes it to decrypt-only for the grace period, so envelopes wrapped just
+// before the rotation can still be opened. Afterwards the key is retired and
+// its private key discarded. Keys generated ahead of time wait in the pending
+// state until they are activated and cannot be used before. A revoked key is
+// considered compromised; its key pair is destroyed right away. Destroying a
+// key leaves a tombstone, so its key ID can never be restored.
+const (
+	StatusPending     Status = "pending"
+	StatusActive      Status = "active"
+	StatusDecryptOnly Status = "decrypt_only"
+	StatusRetired     Status = "retired"
+	StatusRevoked     Status = "revoked"
+	StatusDestroyed   Status = "destroyed"
+)
+
+const (
+	// DefaultBits is the modulus size of generated keys.
+	DefaultBits = 4096
+	// DefaultGracePeriod is how long a rotated key keeps decrypting.
+	DefaultGracePeriod = 24 * time.Hour
+)
+
+// KeySizes are the supported modulus sizes of generated keys.
+var KeySizes = []int{2048, 3072, 4096}
+
+var (
+	ErrKeyNotFound   = errors.New("keystore: key not found")
+	ErrKeyRetired    = errors.New("keystore: key retired")
+	ErrKeyExists     = errors.New("keystore: key already exists")
+	ErrKeyNotPending = errors.New("keystore: key is not pending")
+	ErrInvalidBits   = errors.New("keystore: unsupported key size")
+	ErrKeyExpired    = errors.New("keystore: active key expired")
+	ErrClosed        = errors.New("keystore: keystore destroyed")
+)
+
+// ValidateBits returns ErrInvalidBits unless bits is one of KeySizes.
+func ValidateBits(bits int) error {
+	for _, b := range KeySizes {
+		if bits == b {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %d bits, want one of %v", ErrInvalidBits, bits, KeySizes)
+}
+
+// Key describes an RSA key pair held by the keystore. The private key itself
+// stays in the backend. Keys are never modified once handed out; status
+// changes replace them with a copy.
+type Key struct {
+	ID      string
+	Created time.Time
+	Status  Status
+	// Usages restricts the operations the key may be used for.
+	Usages []Usage
+	// NotAfter is the end of the key's lifetime as active key; it is rotated
+	// before. Zero if keys do not expire.
+	NotAfter time.Time
+	// RetireAt is the end of the grace period of a decrypt-only key.
+	RetireAt time.Time
+	// Retired is the time the key was retired.
+	Retired time.Time
+	// Revoked is the time the key was revoked.
+	Revoked time.Time
+	// RevocationReason records why the key was revoked.
+	RevocationReason RevocationReason
+	// Destroyed is the time the key was destroyed.
+	Destroyed time.Time
+
+	pub *rsa.PublicKey
+}
+
+// PublicKey returns the public key or nil for retired, revoked and destroyed
+// keys.
+func (k *Key) PublicKey() *rsa.PublicKey {
+	return k.pub
+}
+
+// Bits returns the modulus size of the key or 0 for retired, revoked and
+// destroyed keys.
+func (k *Key) Bits() int {
+	if k.pub == nil {
+		return 0
+	}
+	return k.pub.N.BitLen()
+}
+
+// ExportPublicKey returns the public key in SPKI (PKIX) DER form or nil for
+// retired, revoked and destroyed keys.
+func (k *Key) ExportPublicKey() []byte {
+	if k.pub == nil {
+		return nil
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(k.pub)
+	return pub
+}
+
+// Options configure a Keystore. The zero value is an in-memory keystore with
+// default settings.
+type Options struct {
+	// Backend stores the keys. Defaults to an in-memory backend.
+	Backend Backend
+	// Bits is the modulus size of generated keys. Defaults to DefaultBits.
+	Bits int
+	// GracePeriod is how long rotated keys keep decrypting. Defaults to
+	// DefaultGracePeriod.
+	GracePeriod time.Duration
+	// Lifetime is how long a key stays active before it expires. Keys do not
+	// expire if it is zero.
+	Lifetime time.Duration
+	// RotateBefore is how long before its expiry the active key is due for
+	// rotation.
+	RotateBefore time.Duration
+	// Usages are the usages of generated keys. Defaults to DefaultUsages.
+	Usages []Usage
+	// Audit records every key operation. Nothing is recorded if it is nil.
+	Audit audit.Recorder
+	// Tenant names the owner of the keystore in audit events.
+	Tenant string
+}
+
+// Keystore manages the lifecycle of the server's RSA keys on top of a Backend.
+// It is safe for concurrent use.
+type Keystore struct {
+	backend      Backend
+	bits         int
+	grace        time.Duration
+	lifetime     time.Duration
+	rotateBefore time.Duration
+	usages       []Usage
+	audit        audit.Recorder
+	tenant       string
+	now          func() time.Time
+
+	// lifecycle serializes key changes, which may take seconds for key
+	// generation, without blocking readers of the key cache.
+	lifecycle sync.Mutex
+	// generating is held for reading while Generate runs outside lifecycle,
+	// so DestroyAll can wait for it.
+	generating sync.RWMutex
+	// closed is set by DestroyAll while holding lifecycle and generating.
+	closed bool
+
+	mu     sync.RWMutex
+	keys   map[string]*Key
+	active *Key
+}
 
-	key, err := rsa.GenerateKey(reader, bitSize)
+// New returns a keystore on top of opts.Backend without loading its keys; use
+// Open for that.
+func New(opts Options) *Keystore {
+	ks := &Keystore{
+		backend:      opts.Backend,
+		bits:         opts.Bits,
+		grace:        opts.GracePeriod,
+		lifetime:     opts.Lifetime,
+		rotateBefore: opts.RotateBefore,
+		usages:       opts.Usages,
+		audit:        opts.Audit,
+		tenant:       opts.Tenant,
+		now:          time.Now,
+		keys:         make(map[string]*Key),
+	}
+	if ks.backend == nil {
+		ks.backend = NewMemoryBackend()
+	}
+	if ks.bits == 0 {
+		ks.bits = DefaultBits
+	}
+	if ks.grace == 0 {
+		ks.grace = DefaultGracePeriod
+	}
+	if len(ks.usages) == 0 {
+		ks.usages = DefaultUsages
+	}
+
+	return ks
+}
+
+// Open returns a keystore with the keys of opts.Backend loaded. If the backend
+// holds no active key, or only an expired one, a pending key is activated or,
+// failing that, a key pair is generated.
+func Open(opts Options) (*Keystore, error) {
+	ks := New(opts)
+
+	list, err := ks.backend.List()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := ks.load(list); err != nil {
+		return nil, err
 	}
 
-	rsaKey = key
+	if _, err := ks.Current(); err != nil {
+		ctx := audit.System("open")
+		if pending := ks.Pending(ks.bits); len(pending) > 0 {
+			_, err = ks.Activate(ctx, pending[0].ID)
+		} else {
+			_, err = ks.Rotate(ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return nil
+	return ks, nil
 }
 
-func ExportPrivateKey() []byte {
-	if rsaKey != nil {
-		return x509.MarshalPKCS1PrivateKey(rsaKey)
+// load fills the key cache. Only the newest active key stays active; older
+// ones, left behind by an interrupted rotation, are demoted. An active key
+// without expiry gets one based on its creation time once a lifetime is
+// configured.
+func (ks *Keystore) load(list []*Key) error {
+	sort.Slice(list, func(i, j int) bool { return keyLess(list[i], list[j]) })
+
+	newest := -1
+	for i, k := range list {
+		if k.Status == StatusActive {
+			newest = i
+		}
+	}
+	for i, k := range list {
+		if k.Status != StatusActive {
+			continue
+		}
+		if i != newest {
+			demoted, err := ks.demote(k, ks.now().UTC())
+			if err != nil {
+				return err
+			}
+			list[i] = demoted
+		} else if k.NotAfter.IsZero() && ks.lifetime != 0 {
+			expiring := *k
+			expiring.NotAfter = ks.notAfter(k.Created)
+			if err := ks.backend.Update(&expiring); err != nil {
+				return err
+			}
+			list[i] = &expiring
+		}
 	}
+
+	ks.setKeys(list)
+
 	return nil
 }
 
-func ExportPublicKey() []byte {
-	if rsaKey != nil {
-		pub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
-		return pub
+// Bits returns the modulus size of keys generated by Rotate.
+func (ks *Keystore) Bits() int {
+	return ks.bits
+}
+
+// GracePeriod returns how long rotated keys keep decrypting.
+func (ks *Keystore) GracePeriod() time.Duration {
+	return ks.grace
+}
+
+// KeyID returns the stable identifier of a public key: the unpadded base64url
+// encoded SHA-256 fingerprint of its SPKI DER encoding.
+func KeyID(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
 	}
-	return nil
+
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
 }
 
-func ImportPublicKey(pubBase64 string) (*rsa.PublicKey, error) {
-	bytes, err := base64.StdEncoding.DecodeString(pubBase64)
+// Rotate generates a new key pair and makes it the active key. The previously
+// active key stays available for decryption under its key ID until the grace
+// period ends.
+func (ks *Keystore) Rotate(ctx context.Context) (*Key, error) {
+	key, err := ks.rotate()
+	if err := ks.record(ctx, audit.OpKeyRotate, keyID(key), err); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (ks *Keystore) rotate() (*Key, error) {
+	ks.lifecycle.Lock()
+	defer ks.lifecycle.Unlock()
+
+	if ks.closed {
+		return nil, ErrClosed
+	}
+
+	previous := ks.ActiveKey()
+
+	// The new key is stored before the old one is demoted, so an interrupted
+	// rotation never leaves the keystore without an active key.
+	now := ks.now().UTC()
+	key, err := ks.backend.Generate(ks.bits, Key{
+		Created:  now,
+		Status:   StatusActive,
+		Usages:   ks.usages,
+		NotAfter: ks.notAfter(now),
+	})
 	if err != nil {
+		return nil, fmt.Errorf("error generating keypair: %w", err)
+	}
+	ks.put(key)
+
+	if previous != nil {
+		if _, err := ks.demote(previous, key.Created); err != nil {
+			return nil, fmt.Errorf("error demoting key %s: %w", previous.ID, err)
+		}
+	}
+
+	return key, nil
+}
+
+// Generate generates a pending key pair of the given size. Unlike Rotate it
+// does not block other key changes while the key is generated.
+func (ks *Keystore) Generate(ctx context.Context, bits int) (*Key, error) {
+	key, err := ks.generate(bits)
+	if err := ks.record(ctx, audit.OpKeyGenerate, keyID(key), err); err != nil {
 		return nil, err
 	}
 
-	pub, err := x509.ParsePKIXPublicKey(bytes)
+	return key, nil
+}
+
+func (ks *Keystore) generate(bits int) (*Key, error) {
+	if err := ValidateBits(bits); err != nil {
+		return nil, err
+	}
+
+	ks.generating.RLock()
+	defer ks.generating.RUnlock()
+
+	if ks.closed {
+		return nil, ErrClosed
+	}
+
+	key, err := ks.backend.Generate(bits, Key{
+		Created: ks.now().UTC(),
+		Status:  StatusPending,
+		Usages:  ks.usages,
+	})
 	if err != nil {
+		return nil, fmt.Errorf("error generating keypair: %w", err)
+	}
+	ks.put(key)
+
+	return key, nil
+}
+
+// Activate makes the pending key identified by kid the active key. The
+// previously active key enters its grace period.
+func (ks *Keystore) Activate(ctx context.Context, kid string) (*Key, error) {
+	key, err := ks.activate(kid)
+	if err := ks.record(ctx, audit.OpKeyActivate, kid, err); err != nil {
 		return nil, err
 	}
 
-	return pub.(*rsa.PublicKey), nil
+	return key, nil
 }
 
-func PrivateKey() *rsa.PrivateKey {
-	return rsaKey
+func (ks *Keystore) activate(kid string) (*Key, error) {
+	ks.lifecycle.Lock()
+	defer ks.lifecycle.Unlock()
+
+	if ks.closed {
+		return nil, ErrClosed
+	}
+
+	pending, ok := ks.lookup(kid)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if pending.Status != StatusPending {
+		return nil, ErrKeyNotPending
+	}
+
+	previous := ks.ActiveKey()
+
+	key := *pending
+	key.Status = StatusActive
+	key.NotAfter = ks.notAfter(ks.now().UTC())
+	if err := ks.backend.Update(&key); err != nil {
+		return nil, fmt.Errorf("error activating key %s: %w", kid, err)
+	}
+	ks.put(&key)
+
+	if previous != nil {
+		if _, err := ks.demote(previous, ks.now().UTC()); err != nil {
+			return nil, fmt.Errorf("error demoting key %s: %w", previous.ID, err)
+		}
+	}
+
+	return &key, nil
 }
 
-func PublicKey() *rsa.PublicKey {
-	return &rsaKey.PublicKey
+// Pending returns the pending keys of the given size, oldest first.
+func (ks *Keystore) Pending(bits int) []*Key {
+	var pending []*Key
+	for _, k := range ks.Keys() {
+		if k.Status == StatusPending && k.Bits() == bits {
+			pending = append(pending, k)
+		}
+	}
+
+	return pending
+}
+
+// Import adds an existing private key to the keystore, e.g. one parsed with
+// ParsePrivateKey. If activate is set, the key becomes the active key and the
+// previously active key enters its grace period; otherwise the imported key
+// itself is decrypt-only for the grace period. The key gets the usages of
+// generated keys if usages is empty.
+func (ks *Keystore) Import(ctx context.Context, priv *rsa.PrivateKey, activate bool, usages []Usage) (*Key, error) {
+	key, err := ks.importKey(priv, activate, usages)
+
+	kid := keyID(key)
+	if kid == "" {
+		kid, _ = KeyID(&priv.PublicKey)
+	}
+	if err := ks.record(ctx, audit.OpKeyImport, kid, err); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (ks *Keystore) importKey(priv *rsa.PrivateKey, activate bool, usages []Usage) (*Key, error) {
+	if len(usages) == 0 {
+		usages = ks.usages
+	}
+	if err := ValidateUsages(usages); err != nil {
+		return nil, err
+	}
+
+	ks.lifecycle.Lock()
+	defer ks.lifecycle.Unlock()
+
+	if ks.closed {
+		return nil, ErrClosed
+	}
+
+	now := ks.now().UTC()
+	meta := Key{Created: now, Status: StatusActive, Usages: usages, NotAfter: ks.notAfter(now)}
+	if !activate {
+		meta.NotAfter = time.Time{}
+		meta.Status = StatusDecryptOnly
+		meta.RetireAt = now.Add(ks.grace)
+	}
+
+	previous := ks.ActiveKey()
+
+	key, err := ks.backend.Import(priv, meta)
+	if err != nil {
+		return nil, err
+	}
+	ks.put(key)
+
+	if activate && previous != nil {
+		if _, err := ks.demote(previous, now); err != nil {
+			return nil, fmt.Errorf("error demoting key %s: %w", previous.ID, err)
+		}
+	}
+
+	return key, nil
+}
+
+// notAfter returns the expiry of a key activated at now.
+func (ks *Keystore) notAfter(now time.Time) time.Time {
+	if ks.lifetime == 0 {
+		return time.Time{}
+	}
+	return now.Add(ks.lifetime)
+}
+
+// NextRotation returns when the active key is due for rotation, or the zero
+// time if it does not expire.
+func (ks *Keystore) NextRotation() time.Time {
+	active := ks.ActiveKey()
+	if active == nil || active.NotAfter.IsZero() {
+		return time.Time{}
+	}
+
+	return active.NotAfter.Add(-ks.rotateBefore)
+}
+
+// RotationDue reports whether the active key is missing or due for rotation
+// at now.
+func (ks *Keystore) RotationDue(now time.Time) bool {
+	if ks.ActiveKey() == nil {
+		return true
+	}
+
+	next := ks.NextRotation()
+	return !next.IsZero() && !now.Before(next)
+}
+
+// demote makes key decrypt-only for the grace period starting at now.
+func (ks *Keystore) demote(key *Key, now time.Time) (*Key, error) {
+	demoted := *key
+	demoted.Status = StatusDecryptOnly
+	demoted.RetireAt = now.Add(ks.grace)
+
+	if err := ks.backend.Update(&demoted); err != nil {
+		return nil, err
+	}
+	ks.put(&demoted)
+
+	return &demoted, nil
+}
+
+// RetireExpired retires every decrypt-only key whose grace period ended
+// before now and discards its private key. It returns the number of retired
+// keys.
+func (ks *Keystore) RetireExpired(ctx context.Context, now time.Time) (int, error) {
+	ks.lifecycle.Lock()
+	defer ks.lifecycle.Unlock()
+
+	retired := 0
+	for _, k := range ks.Keys() {
+		if k.Status != StatusDecryptOnly || now.Before(k.RetireAt) {
+			continue
+		}
+
+		r := &Key{
+			ID:       k.ID,
+			Created:  k.Created,
+			Status:   StatusRetired,
+			Usages:   k.Usages,
+			NotAfter: k.NotAfter,
+			RetireAt: k.RetireAt,
+			Retired:  now.UTC(),
+		}
+		err := ks.backend.Update(r)
+		if err != nil {
+			err = fmt.Errorf("error retiring key %s: %w", k.ID, err)
+		} else {
+			ks.put(r)
+			retired++
+		}
+		if err := ks.record(ctx, audit.OpKeyRetire, k.ID, err); err != nil {
+			return retired, err
+		}
+	}
+
+	return retired, nil
+}
+
+// put adds or replaces a key in the cache.
+func (ks *Keystore) put(key *Key) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.keys[key.ID] = key
+	if key.Status == StatusActive {
+		ks.active = key
+	} else if ks.active != nil && ks.active.ID == key.ID {
+		ks.active = nil
+	}
+}
+
+// ActiveKey returns the active key or nil if the keystore is empty. The key
+// may have expired; use Current to hand out a key for new encryptions.
+func (ks *Keystore) ActiveKey() *Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.active
+}
+
+// Current returns the active key for new encryptions. It fails with
+// ErrKeyNotFound if there is none and with ErrKeyExpired once the key is past
+// its NotAfter, until the key is rotated. An expired key still decrypts.
+func (ks *Keystore) Current() (*Key, error) {
+	active := ks.ActiveKey()
+	if active == nil {
+		return nil, ErrKeyNotFound
+	}
+	if !active.NotAfter.IsZero() && !ks.now().Before(active.NotAfter) {
+		return nil, fmt.Errorf("%w: key %s expired at %v", ErrKeyExpired, active.ID, active.NotAfter)
+	}
+
+	return active, nil
+}
+
+// Get returns the key with the given key ID if it can still decrypt. An empty
+// kid selects the active key.
+func (ks *Keystore) Get(kid string) (*Key, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if kid == "" {
+		if ks.active == nil {
+			return nil, ErrKeyNotFound
+		}
+		return ks.active, nil
+	}
+
+	key, ok := ks.keys[kid]
+	if !ok || key.Status == StatusPending || key.Status == StatusDestroyed {
+		return nil, ErrKeyNotFound
+	}
+
+	if key.Status == StatusRevoked {
+		return nil, ErrKeyRevoked
+	}
+
+	// The grace period is enforced here as well, so a late RetireExpired run
+	// never extends it.
+	if key.Status == StatusRetired ||
+		key.Status == StatusDecryptOnly && !ks.now().Before(key.RetireAt) {
+		return nil, ErrKeyRetired
+	}
+
+	return key, nil
+}
+
+// remove drops a key from the cache.
+func (ks *Keystore) remove(kid string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	delete(ks.keys, kid)
+	if ks.active != nil && ks.active.ID == kid {
+		ks.active = nil
+	}
+}
+
+// lookup returns the cached key with the given ID regardless of its status.
+func (ks *Keystore) lookup(kid string) (*Key, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// Keys returns all keys ordered by creation time, oldest first.
+func (ks *Keystore) Keys() []*Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	list := make([]*Key, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return keyLess(list[i], list[j]) })
+
+	return list
+}
+
+// Decrypt decrypts an RSA-OAEP (SHA-256) ciphertext with the key identified by
+// kid on behalf of an operation with the given usage, which must be
+// UsageDecrypt or UsageUnwrapKey and allowed by the key. An empty kid selects
+// the active key. The plaintext is only returned once the operation has been
+// recorded.
+func (ks *Keystore) Decrypt(ctx context.Context, kid string, usage Usage, ciphertext []byte) ([]byte, error) {
+	op := audit.OpKeyDecrypt
+	if usage == UsageUnwrapKey {
+		op = audit.OpKeyUnwrap
+	}
+
+	plaintext, kid, err := ks.decrypt(kid, usage, ciphertext)
+	if err := ks.record(ctx, op, kid, err); err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+// decrypt implements Decrypt and also returns the ID of the selected key.
+func (ks *Keystore) decrypt(kid string, usage Usage, ciphertext []byte) ([]byte, string, error) {
+	if usage != UsageDecrypt && usage != UsageUnwrapKey {
+		return nil, kid, fmt.Errorf("%w: %s is not a private key operation", ErrInvalidUsage, usage)
+	}
+
+	key, err := ks.Get(kid)
+	if err != nil {
+		return nil, kid, err
+	}
+	if !key.Allows(usage) {
+		return nil, key.ID, fmt.Errorf("%w: key %s does not allow %s", ErrUsageNotAllowed, key.ID, usage)
+	}
+
+	plaintext, err := ks.backend.Decrypt(key.ID, ciphertext)
+	return plaintext, key.ID, err
+}
+
+// keyLess orders keys by creation time, oldest first.
+func keyLess(a, b *Key) bool {
+	if a.Created.Equal(b.Created) {
+		return a.ID < b.ID
+	}
+	return a.Created.Before(b.Created)
+}
+
+// setKeys replaces the key cache.
+func (ks *Keystore) setKeys(list []*Key) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.keys = make(map[string]*Key, len(list))
+	ks.active = nil
+	for _, k := range list {
+		ks.keys[k.ID] = k
+		if k.Status == StatusActive {
+			ks.active = k
+		}
+	}
+}
+
+func ImportPublicKey(pubBase64 string) (*rsa.PublicKey, error) {
+	bytes, err := base64.StdEncoding.DecodeString(pubBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+
+	return rsaPub, nil
 }
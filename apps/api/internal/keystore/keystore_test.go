@@ -0,0 +1,310 @@
+package keystore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEmptyKeystore(t *testing.T) {
+	t.Parallel()
+
+	ks := New(Options{})
+
+	if key := ks.ActiveKey(); key != nil {
+		t.Errorf("active key of empty keystore want: nil got: %v", key.ID)
+	}
+	if _, err := ks.Get(""); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("get from empty keystore want: %v got: %v", ErrKeyNotFound, err)
+	}
+	if _, err := ks.Decrypt(context.Background(), "", UsageDecrypt, []byte("ciphertext")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("decrypt with empty keystore want: %v got: %v", ErrKeyNotFound, err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	t.Parallel()
+
+	ks := New(Options{Bits: 2048, GracePeriod: time.Hour})
+
+	first, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if active := ks.ActiveKey(); active.ID != second.ID {
+		t.Errorf("active key want: %v got: %v", second.ID, active.ID)
+	}
+
+	old, err := ks.Get(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Status != StatusDecryptOnly {
+		t.Errorf("rotated key status want: %v got: %v", StatusDecryptOnly, old.Status)
+	}
+	if first.Status != StatusActive {
+		t.Errorf("rotation modified a handed out key")
+	}
+
+	// Envelopes wrapped for the old key still open during the grace period.
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, first.PublicKey(), []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := ks.Decrypt(context.Background(), first.ID, UsageDecrypt, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret" {
+		t.Errorf("decrypt want: %q got: %q", "secret", plaintext)
+	}
+}
+
+func TestCurrentRefusesExpiredKey(t *testing.T) {
+	t.Parallel()
+
+	ks := New(Options{Bits: 2048, Lifetime: time.Hour})
+	key, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, err := ks.Current(); err != nil || current.ID != key.ID {
+		t.Errorf("current want: %v got: %v, %v", key.ID, current, err)
+	}
+
+	ks.now = func() time.Time { return key.NotAfter }
+	if _, err := ks.Current(); !errors.Is(err, ErrKeyExpired) {
+		t.Errorf("current after expiry want: %v got: %v", ErrKeyExpired, err)
+	}
+	// The expired key keeps decrypting.
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.PublicKey(), []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Decrypt(context.Background(), key.ID, UsageDecrypt, ciphertext); err != nil {
+		t.Errorf("decrypt with expired key: %v", err)
+	}
+
+	rotated, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, err := ks.Current(); err != nil || current.ID != rotated.ID {
+		t.Errorf("current after rotation want: %v got: %v, %v", rotated.ID, current, err)
+	}
+}
+
+func TestOpenReplacesExpiredKey(t *testing.T) {
+	t.Parallel()
+
+	expired := testEntry(t, StatusActive)
+	expired.key.NotAfter = time.Now().UTC().Add(-time.Minute)
+	pending := testEntry(t, StatusPending)
+
+	ks, err := Open(Options{Backend: newMemoryBackend([]*memoryEntry{expired, pending}), Bits: 2048, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, err := ks.Current(); err != nil || current.ID != pending.key.ID {
+		t.Errorf("current want: %v got: %v, %v", pending.key.ID, current, err)
+	}
+	if old, _ := ks.lookup(expired.key.ID); old.Status != StatusDecryptOnly {
+		t.Errorf("expired key status want: %v got: %v", StatusDecryptOnly, old.Status)
+	}
+}
+
+func TestRetireExpired(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC()
+
+	active := testEntry(t, StatusActive)
+	expired := testEntry(t, StatusDecryptOnly)
+	expired.key.RetireAt = now.Add(-time.Minute)
+	grace := testEntry(t, StatusDecryptOnly)
+	grace.key.RetireAt = now.Add(time.Hour)
+
+	backend := newMemoryBackend([]*memoryEntry{active, expired, grace})
+	ks, err := Open(Options{Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired key stops decrypting before the retirement run.
+	if _, err := ks.Get(expired.key.ID); !errors.Is(err, ErrKeyRetired) {
+		t.Errorf("get expired key want: %v got: %v", ErrKeyRetired, err)
+	}
+
+	n, err := ks.RetireExpired(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("retired keys want: 1 got: %d", n)
+	}
+
+	for _, k := range ks.Keys() {
+		switch k.ID {
+		case expired.key.ID:
+			if k.Status != StatusRetired || k.PublicKey() != nil {
+				t.Errorf("expired key want retired without key material, got %v", k.Status)
+			}
+		case grace.key.ID:
+			if k.Status != StatusDecryptOnly {
+				t.Errorf("key in grace period want: %v got: %v", StatusDecryptOnly, k.Status)
+			}
+		}
+	}
+
+	if _, err := ks.Get(grace.key.ID); err != nil {
+		t.Errorf("get key in grace period: %v", err)
+	}
+	if key, err := ks.Get(""); err != nil || key.ID != active.key.ID {
+		t.Errorf("get active key want: %v got: %v (%v)", active.key.ID, key, err)
+	}
+	if _, err := backend.Decrypt(expired.key.ID, []byte("ciphertext")); !errors.Is(err, ErrKeyRetired) {
+		t.Errorf("backend still holds the retired private key")
+	}
+}
+
+func TestOpenReloadsKeyFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	backend, err := NewFileBackend(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := Open(Options{Backend: backend, Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := ks.ActiveKey()
+	if first == nil {
+		t.Fatal("open did not generate a key")
+	}
+	second, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err = NewFileBackend(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(Options{Backend: backend, Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active := reopened.ActiveKey(); active.ID != second.ID {
+		t.Errorf("reopened active key want: %v got: %v", second.ID, active.ID)
+	}
+	if _, err := reopened.Get(first.ID); err != nil {
+		t.Errorf("reopened keystore lost rotated key: %v", err)
+	}
+}
+
+func TestOpenRepairsInterruptedRotation(t *testing.T) {
+	t.Parallel()
+
+	older := testEntry(t, StatusActive)
+	older.key.Created = older.key.Created.Add(-time.Minute)
+	newer := testEntry(t, StatusActive)
+
+	ks, err := Open(Options{Backend: newMemoryBackend([]*memoryEntry{older, newer})})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if active := ks.ActiveKey(); active.ID != newer.key.ID {
+		t.Errorf("active key want: %v got: %v", newer.key.ID, active.ID)
+	}
+	key, err := ks.Get(older.key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Status != StatusDecryptOnly {
+		t.Errorf("older active key status want: %v got: %v", StatusDecryptOnly, key.Status)
+	}
+}
+
+// TestConcurrentRotateAndDecrypt is meant to be run with the race detector.
+func TestConcurrentRotateAndDecrypt(t *testing.T) {
+	t.Parallel()
+
+	ks := New(Options{Bits: 2048})
+	if _, err := ks.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		rotations = 4
+		readers   = 8
+	)
+
+	done := make(chan struct{})
+	var rotators sync.WaitGroup
+	for i := 0; i < rotations; i++ {
+		rotators.Add(1)
+		go func() {
+			defer rotators.Done()
+			if _, err := ks.Rotate(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	go func() {
+		rotators.Wait()
+		close(done)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				key := ks.ActiveKey()
+				ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.PublicKey(), []byte("secret"), nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				plaintext, err := ks.Decrypt(context.Background(), key.ID, UsageUnwrapKey, ciphertext)
+				if err != nil {
+					t.Errorf("decrypt with %v: %v", key.ID, err)
+					return
+				}
+				if string(plaintext) != "secret" {
+					t.Errorf("decrypt want: %q got: %q", "secret", plaintext)
+					return
+				}
+				ks.Keys()
+				ks.RetireExpired(context.Background(), time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(ks.Keys()); n != rotations+1 {
+		t.Errorf("keys after rotations want: %d got: %d", rotations+1, n)
+	}
+}
@@ -0,0 +1,516 @@
+//go:build pkcs11
+// +build pkcs11
+
+package keystore
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Application tags the data objects holding key metadata.
+const pkcs11Application = "ezzy-web-crypto"
+
+// pkcs11Backend keeps keys on a PKCS#11 token. Every key consists of a
+// non-extractable private key, its public key and a data object with the
+// metadata, all labeled with the key ID.
+type pkcs11Backend struct {
+	ctx *pkcs11.Ctx
+
+	// mu guards the session, which must not be used concurrently.
+	mu      sync.Mutex
+	session pkcs11.SessionHandle
+}
+
+// NewPKCS11Backend opens a session on the token labeled cfg.TokenLabel and logs
+// in with cfg.PIN.
+func NewPKCS11Backend(cfg PKCS11Config) (Backend, error) {
+	ctx := pkcs11.New(cfg.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("keystore: cannot load PKCS#11 module %s", cfg.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("keystore: PKCS#11 initialize: %w", err)
+	}
+
+	b := &pkcs11Backend{ctx: ctx}
+	if err := b.open(cfg); err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *pkcs11Backend) open(cfg PKCS11Config) error {
+	slots, err := b.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("keystore: PKCS#11 slot list: %w", err)
+	}
+
+	for _, slot := range slots {
+		info, err := b.ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != cfg.TokenLabel {
+			continue
+		}
+
+		session, err := b.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return fmt.Errorf("keystore: PKCS#11 open session: %w", err)
+		}
+		err = b.ctx.Login(session, pkcs11.CKU_USER, cfg.PIN)
+		if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			b.ctx.CloseSession(session)
+			return fmt.Errorf("keystore: PKCS#11 login: %w", err)
+		}
+
+		b.session = session
+		return nil
+	}
+
+	return fmt.Errorf("keystore: PKCS#11 token %q not found", cfg.TokenLabel)
+}
+
+// Close logs out and releases the PKCS#11 module.
+func (b *pkcs11Backend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ctx.Logout(b.session)
+	b.ctx.CloseSession(b.session)
+	err := b.ctx.Finalize()
+	b.ctx.Destroy()
+
+	return err
+}
+
+func (b *pkcs11Backend) Generate(bits int, meta Key) (*Key, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The key ID is only known once the public key exists, so the pair is
+	// generated under a random placeholder ID and relabeled afterwards.
+	tmpID := make([]byte, 16)
+	if _, err := rand.Read(tmpID); err != nil {
+		return nil, err
+	}
+
+	pubHandle, privHandle, err := b.ctx.GenerateKeyPair(b.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, tmpID),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, tmpID),
+		})
+	if err != nil {
+		return nil, fmt.Errorf("keystore: PKCS#11 generate key pair: %w", err)
+	}
+
+	key, err := b.finishKeyPair(pubHandle, privHandle, meta)
+	if err != nil {
+		b.ctx.DestroyObject(b.session, pubHandle)
+		b.ctx.DestroyObject(b.session, privHandle)
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (b *pkcs11Backend) Import(priv *rsa.PrivateKey, meta Key) (*Key, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	kid, err := KeyID(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.metadataObject(kid); err == nil {
+		return nil, ErrKeyExists
+	}
+
+	priv.Precompute()
+	e := big.NewInt(int64(priv.E)).Bytes()
+
+	pubHandle, err := b.ctx.CreateObject(b.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, priv.N.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, e),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(kid)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("keystore: PKCS#11 import public key: %w", err)
+	}
+
+	privHandle, err := b.ctx.CreateObject(b.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, priv.N.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, e),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, priv.D.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, priv.Primes[0].Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, priv.Primes[1].Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, priv.Precomputed.Dp.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, priv.Precomputed.Dq.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, priv.Precomputed.Qinv.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(kid)),
+	})
+	if err != nil {
+		b.ctx.DestroyObject(b.session, pubHandle)
+		return nil, fmt.Errorf("keystore: PKCS#11 import private key: %w", err)
+	}
+
+	key, err := b.finishKeyPair(pubHandle, privHandle, meta)
+	if err != nil {
+		b.ctx.DestroyObject(b.session, pubHandle)
+		b.ctx.DestroyObject(b.session, privHandle)
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (b *pkcs11Backend) finishKeyPair(pubHandle, privHandle pkcs11.ObjectHandle, meta Key) (*Key, error) {
+	pub, err := b.publicKey(pubHandle)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := KeyID(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	label := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(kid)),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, kid),
+	}
+	if err := b.ctx.SetAttributeValue(b.session, pubHandle, label); err != nil {
+		return nil, fmt.Errorf("keystore: PKCS#11 label public key: %w", err)
+	}
+	if err := b.ctx.SetAttributeValue(b.session, privHandle, label); err != nil {
+		return nil, fmt.Errorf("keystore: PKCS#11 label private key: %w", err)
+	}
+
+	meta.ID = kid
+	if err := b.createMetadata(&meta); err != nil {
+		return nil, err
+	}
+
+	meta.pub = pub
+	return &meta, nil
+}
+
+func (b *pkcs11Backend) ImportTombstone(meta Key) (*Key, error) {
+	if meta.Status != StatusRevoked && meta.Status != StatusDestroyed {
+		return nil, fmt.Errorf("keystore: key %s in status %s is no tombstone", meta.ID, meta.Status)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.metadataObject(meta.ID); err == nil {
+		return nil, ErrKeyExists
+	}
+
+	meta.pub = nil
+	if err := b.createMetadata(&meta); err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// createMetadata stores the metadata object of key.
+func (b *pkcs11Backend) createMetadata(key *Key) error {
+	value, err := pkcs11MetadataValue(key)
+	if err != nil {
+		return err
+	}
+	_, err = b.ctx.CreateObject(b.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, pkcs11Application),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, key.ID),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, value),
+	})
+	if err != nil {
+		return fmt.Errorf("keystore: PKCS#11 store metadata: %w", err)
+	}
+
+	return nil
+}
+
+func (b *pkcs11Backend) Get(kid string) (*Key, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	handle, err := b.metadataObject(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.key(handle)
+}
+
+func (b *pkcs11Backend) List() ([]*Key, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	handles, err := b.find([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, pkcs11Application),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Key, 0, len(handles))
+	for _, h := range handles {
+		key, err := b.key(h)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, key)
+	}
+
+	return list, nil
+}
+
+func (b *pkcs11Backend) Update(key *Key) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	handle, err := b.metadataObject(key.ID)
+	if err != nil {
+		return err
+	}
+
+	value, err := pkcs11MetadataValue(key)
+	if err != nil {
+		return err
+	}
+	err = b.ctx.SetAttributeValue(b.session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, value),
+	})
+	if err != nil {
+		return fmt.Errorf("keystore: PKCS#11 update metadata: %w", err)
+	}
+
+	if !hasKeyMaterial(key.Status) {
+		return b.destroyKeyPair(key.ID)
+	}
+
+	return nil
+}
+
+func (b *pkcs11Backend) Delete(kid string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	handle, err := b.metadataObject(kid)
+	if err != nil {
+		return err
+	}
+	if err := b.destroyKeyPair(kid); err != nil {
+		return err
+	}
+
+	return b.ctx.DestroyObject(b.session, handle)
+}
+
+func (b *pkcs11Backend) Decrypt(kid string, ciphertext []byte) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	handles, err := b.find([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(kid)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(handles) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	params := pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, nil)
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)}
+	if err := b.ctx.DecryptInit(b.session, mech, handles[0]); err != nil {
+		return nil, fmt.Errorf("keystore: PKCS#11 decrypt init: %w", err)
+	}
+
+	// Like rsa.DecryptOAEP, padding errors are reported without detail.
+	plaintext, err := b.ctx.Decrypt(b.session, ciphertext)
+	if err != nil {
+		return nil, rsa.ErrDecryption
+	}
+
+	return plaintext, nil
+}
+
+func (b *pkcs11Backend) key(metadata pkcs11.ObjectHandle) (*Key, error) {
+	attrs, err := b.ctx.GetAttributeValue(b.session, metadata, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("keystore: PKCS#11 read metadata: %w", err)
+	}
+
+	var sk storedKey
+	if err := json.Unmarshal(attrs[0].Value, &sk); err != nil {
+		return nil, fmt.Errorf("keystore: PKCS#11 malformed metadata: %w", err)
+	}
+	key := &Key{
+		ID:               sk.ID,
+		Created:          sk.Created,
+		Status:           sk.Status,
+		Usages:           sk.Usages,
+		NotAfter:         timeValue(sk.NotAfter),
+		RetireAt:         timeValue(sk.RetireAt),
+		Retired:          timeValue(sk.Retired),
+		Revoked:          timeValue(sk.Revoked),
+		RevocationReason: sk.RevocationReason,
+		Destroyed:        timeValue(sk.Destroyed),
+	}
+	if !hasKeyMaterial(key.Status) {
+		return key, nil
+	}
+
+	handles, err := b.find([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(key.ID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(handles) == 0 {
+		return nil, fmt.Errorf("keystore: PKCS#11 public key of %s missing", key.ID)
+	}
+	if key.pub, err = b.publicKey(handles[0]); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (b *pkcs11Backend) publicKey(handle pkcs11.ObjectHandle) (*rsa.PublicKey, error) {
+	attrs, err := b.ctx.GetAttributeValue(b.session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("keystore: PKCS#11 read public key: %w", err)
+	}
+
+	e := new(big.Int).SetBytes(attrs[1].Value)
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("keystore: PKCS#11 public exponent too large")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attrs[0].Value),
+		E: int(e.Int64()),
+	}, nil
+}
+
+func (b *pkcs11Backend) metadataObject(kid string) (pkcs11.ObjectHandle, error) {
+	handles, err := b.find([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, pkcs11Application),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, kid),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(handles) == 0 {
+		return 0, ErrKeyNotFound
+	}
+
+	return handles[0], nil
+}
+
+func (b *pkcs11Backend) destroyKeyPair(kid string) error {
+	handles, err := b.find([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(kid)),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range handles {
+		if err := b.ctx.DestroyObject(b.session, h); err != nil {
+			return fmt.Errorf("keystore: PKCS#11 destroy key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (b *pkcs11Backend) find(template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := b.ctx.FindObjectsInit(b.session, template); err != nil {
+		return nil, fmt.Errorf("keystore: PKCS#11 find objects: %w", err)
+	}
+	defer b.ctx.FindObjectsFinal(b.session)
+
+	var handles []pkcs11.ObjectHandle
+	for {
+		objs, _, err := b.ctx.FindObjects(b.session, 16)
+		if err != nil {
+			return nil, fmt.Errorf("keystore: PKCS#11 find objects: %w", err)
+		}
+		if len(objs) == 0 {
+			return handles, nil
+		}
+		handles = append(handles, objs...)
+	}
+}
+
+func pkcs11MetadataValue(key *Key) ([]byte, error) {
+	return json.Marshal(&storedKey{
+		ID:               key.ID,
+		Created:          key.Created,
+		Status:           key.Status,
+		Usages:           key.Usages,
+		NotAfter:         timePtr(key.NotAfter),
+		RetireAt:         timePtr(key.RetireAt),
+		Retired:          timePtr(key.Retired),
+		Revoked:          timePtr(key.Revoked),
+		RevocationReason: key.RevocationReason,
+		Destroyed:        timePtr(key.Destroyed),
+	})
+}
@@ -0,0 +1,16 @@
+package keystore
+
+import "errors"
+
+// PKCS11Config selects the PKCS#11 token holding the keys.
+type PKCS11Config struct {
+	// Module is the path of the PKCS#11 library, e.g.
+	// /usr/lib/softhsm/libsofthsm2.so.
+	Module string
+	// TokenLabel selects the token by its label.
+	TokenLabel string
+	// PIN is the user PIN of the token.
+	PIN string
+}
+
+var ErrPKCS11Unsupported = errors.New("keystore: built without PKCS#11 support, rebuild with -tags pkcs11")
@@ -0,0 +1,10 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package keystore
+
+// NewPKCS11Backend is only available in builds with the pkcs11 tag, which
+// requires cgo.
+func NewPKCS11Backend(cfg PKCS11Config) (Backend, error) {
+	return nil, ErrPKCS11Unsupported
+}
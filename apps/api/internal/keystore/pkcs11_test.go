@@ -0,0 +1,45 @@
+//go:build pkcs11
+// +build pkcs11
+
+package keystore
+
+import (
+	"os"
+	"testing"
+)
+
+// TestPKCS11Backend runs against a token dedicated to tests, since all
+// keystore keys on it are deleted afterwards, e.g. with SoftHSM:
+//
+//	softhsm2-util --init-token --free --label ezzy-test --pin 1234 --so-pin 1234
+//	PKCS11_TEST_MODULE=/usr/lib/softhsm/libsofthsm2.so \
+//	PKCS11_TEST_TOKEN=ezzy-test PKCS11_TEST_PIN=1234 \
+//	go test -tags pkcs11 ./apps/api/internal/keystore/
+func TestPKCS11Backend(t *testing.T) {
+	module := os.Getenv("PKCS11_TEST_MODULE")
+	if module == "" {
+		t.Skip("PKCS11_TEST_MODULE not set")
+	}
+
+	b, err := NewPKCS11Backend(PKCS11Config{
+		Module:     module,
+		TokenLabel: os.Getenv("PKCS11_TEST_TOKEN"),
+		PIN:        os.Getenv("PKCS11_TEST_PIN"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.(*pkcs11Backend).Close()
+
+	testBackend(t, b)
+
+	list, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range list {
+		if err := b.Delete(k.ID); err != nil {
+			t.Error(err)
+		}
+	}
+}
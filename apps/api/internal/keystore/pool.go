@@ -0,0 +1,234 @@
+package keystore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+	"sync"
+	"time"
+)
+
+// DefaultPoolSize is the number of pending keys a Pool keeps ready.
+const DefaultPoolSize = 2
+
+// jobRetention is how long finished jobs can be looked up.
+const jobRetention = time.Hour
+
+var ErrJobNotFound = errors.New("keystore: job not found")
+
+type JobStatus string
+
+const (
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is a rotation that waits for its key pair to be generated. Jobs are
+// never modified once handed out.
+type Job struct {
+	ID       string
+	Bits     int
+	Status   JobStatus
+	Created  time.Time
+	Finished time.Time
+	// Kid is the key ID of the activated key once the job is done.
+	Kid string
+	// Err is set if the job failed.
+	Err error
+}
+
+// Pool keeps pending keys of the keystore's default size ready, so rotations
+// do not wait for key generation. It is safe for concurrent use.
+type Pool struct {
+	ks   *Keystore
+	size int
+
+	// drained is signaled when a pooled key is taken.
+	drained chan struct{}
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// scheduled is the job started by the last RotateIfDue call.
+	scheduled string
+}
+
+// NewPool returns a pool keeping size pending keys in ks. A size of 0 selects
+// DefaultPoolSize.
+func NewPool(ks *Keystore, size int) *Pool {
+	if size == 0 {
+		size = DefaultPoolSize
+	}
+
+	return &Pool{
+		ks:      ks,
+		size:    size,
+		drained: make(chan struct{}, 1),
+		jobs:    make(map[string]*Job),
+	}
+}
+
+// Fill generates pending keys until the pool is full and returns the number of
+// generated keys. Calls should not overlap.
+func (p *Pool) Fill(ctx context.Context) (int, error) {
+	generated := 0
+	for len(p.ks.Pending(p.ks.Bits())) < p.size {
+		if _, err := p.ks.Generate(ctx, p.ks.Bits()); err != nil {
+			return generated, err
+		}
+		generated++
+	}
+
+	return generated, nil
+}
+
+// Drained is signaled when a key was taken from the pool, so it can be filled
+// again.
+func (p *Pool) Drained() <-chan struct{} {
+	return p.drained
+}
+
+// Rotate activates a new key of the given size, or of the keystore's default
+// size if bits is 0. If a pending key is ready, it is activated and returned
+// right away. Otherwise the key is generated in the background and Rotate
+// returns the job tracking it, which is recorded on behalf of the caller of
+// ctx. While a job for keys of that size runs, Rotate returns it instead of
+// starting another one, so at most one key per size is generated at a time
+// however often it is called.
+func (p *Pool) Rotate(ctx context.Context, bits int) (*Key, *Job, error) {
+	if bits == 0 {
+		bits = p.ks.Bits()
+	}
+	if err := ValidateBits(bits); err != nil {
+		return nil, nil, err
+	}
+
+	for _, pending := range p.ks.Pending(bits) {
+		key, err := p.ks.Activate(ctx, pending.ID)
+		if errors.Is(err, ErrKeyNotPending) || errors.Is(err, ErrKeyNotFound) {
+			// Taken by a concurrent rotation.
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		select {
+		case p.drained <- struct{}{}:
+		default:
+		}
+		return key, nil, nil
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	for _, job := range p.jobs {
+		if job.Status == JobRunning && job.Bits == bits {
+			p.mu.Unlock()
+			return nil, job, nil
+		}
+	}
+	job := &Job{
+		ID:      id,
+		Bits:    bits,
+		Status:  JobRunning,
+		Created: p.ks.now().UTC(),
+	}
+	p.storeJob(job)
+	p.mu.Unlock()
+
+	// The job outlives the request that started it.
+	go p.run(audit.WithCaller(context.Background(), audit.CallerFrom(ctx)), *job)
+
+	return nil, job, nil
+}
+
+// RotateIfDue rotates if the active key is due for rotation at now. It does
+// nothing while a rotation started by an earlier call is still running. It
+// returns nil, nil, nil if no rotation was started.
+func (p *Pool) RotateIfDue(ctx context.Context, now time.Time) (*Key, *Job, error) {
+	if !p.ks.RotationDue(now) {
+		return nil, nil, nil
+	}
+
+	p.mu.Lock()
+	job, running := p.jobs[p.scheduled]
+	p.mu.Unlock()
+	if running && job.Status == JobRunning {
+		return nil, nil, nil
+	}
+
+	key, job, err := p.Rotate(ctx, 0)
+	if job != nil {
+		p.mu.Lock()
+		p.scheduled = job.ID
+		p.mu.Unlock()
+	}
+
+	return key, job, err
+}
+
+// Job returns the job with the given ID.
+func (p *Pool) Job(id string) (*Job, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	job, ok := p.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+
+	return job, nil
+}
+
+func (p *Pool) run(ctx context.Context, job Job) {
+	key, err := p.ks.Generate(ctx, job.Bits)
+	if err == nil {
+		key, err = p.ks.Activate(ctx, key.ID)
+	}
+
+	job.Finished = p.ks.now().UTC()
+	if err != nil {
+		job.Status = JobFailed
+		job.Err = err
+	} else {
+		job.Status = JobDone
+		job.Kid = key.ID
+	}
+	p.setJob(&job)
+}
+
+func (p *Pool) setJob(job *Job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.storeJob(job)
+}
+
+// storeJob stores job and forgets jobs that finished before jobRetention.
+// p.mu must be held.
+func (p *Pool) storeJob(job *Job) {
+	p.jobs[job.ID] = job
+
+	cutoff := p.ks.now().Add(-jobRetention)
+	for id, j := range p.jobs {
+		if j.Status != JobRunning && j.Finished.Before(cutoff) {
+			delete(p.jobs, id)
+		}
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,156 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoolRotate(t *testing.T) {
+	t.Parallel()
+
+	ks := New(Options{Bits: 2048})
+	pool := NewPool(ks, 1)
+
+	if n, err := pool.Fill(context.Background()); err != nil || n != 1 {
+		t.Fatalf("fill want: 1 key got: %v keys, %v", n, err)
+	}
+	pending := ks.Pending(2048)[0]
+	if _, err := ks.Get(pending.ID); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("get pending key want: %v got: %v", ErrKeyNotFound, err)
+	}
+
+	key, job, err := pool.Rotate(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job != nil || key.ID != pending.ID {
+		t.Fatalf("rotate want: pooled key %v got: key %v, job %v", pending.ID, key, job)
+	}
+	if active := ks.ActiveKey(); active.ID != pending.ID {
+		t.Errorf("active key want: %v got: %v", pending.ID, active.ID)
+	}
+
+	select {
+	case <-pool.Drained():
+	default:
+		t.Errorf("taking a pooled key did not signal the pool")
+	}
+}
+
+func TestPoolRotateEmpty(t *testing.T) {
+	t.Parallel()
+
+	ks := New(Options{Bits: 2048})
+	pool := NewPool(ks, 1)
+
+	key, job, err := pool.Rotate(context.Background(), 3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != nil || job == nil {
+		t.Fatalf("rotate of empty pool want: job got: key %v, job %v", key, job)
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	for job.Status == JobRunning && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		if job, err = pool.Job(job.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.Status != JobDone {
+		t.Fatalf("job status want: %v got: %v (%v)", JobDone, job.Status, job.Err)
+	}
+
+	active := ks.ActiveKey()
+	if active == nil || active.ID != job.Kid {
+		t.Fatalf("active key want: %v got: %v", job.Kid, active)
+	}
+	if bits := active.Bits(); bits != 3072 {
+		t.Errorf("key size want: %v got: %v", 3072, bits)
+	}
+}
+
+func TestPoolRotateReusesRunningJob(t *testing.T) {
+	t.Parallel()
+
+	ks := New(Options{Bits: 2048})
+	pool := NewPool(ks, 1)
+
+	_, first, err := pool.Rotate(context.Background(), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, job, err := pool.Rotate(context.Background(), 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == JobRunning && job.ID != first.ID {
+			t.Fatalf("rotate while generating want: job %v got: job %v", first.ID, job.ID)
+		}
+	}
+
+	pool.mu.Lock()
+	running := 0
+	for _, job := range pool.jobs {
+		if job.Status == JobRunning {
+			running++
+		}
+	}
+	pool.mu.Unlock()
+	if running > 1 {
+		t.Errorf("running jobs want: at most 1 got: %v", running)
+	}
+}
+
+func TestPoolRotateInvalidBits(t *testing.T) {
+	t.Parallel()
+
+	pool := NewPool(New(Options{}), 1)
+
+	if _, _, err := pool.Rotate(context.Background(), 1024); !errors.Is(err, ErrInvalidBits) {
+		t.Errorf("rotate with 1024 bits want: %v got: %v", ErrInvalidBits, err)
+	}
+	if _, err := pool.Job("unknown"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("unknown job want: %v got: %v", ErrJobNotFound, err)
+	}
+}
+
+func TestPoolRotateIfDue(t *testing.T) {
+	t.Parallel()
+
+	ks := New(Options{Bits: 2048, Lifetime: 30 * 24 * time.Hour, RotateBefore: 24 * time.Hour})
+	pool := NewPool(ks, 1)
+
+	first, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := first.Created.Add(30 * 24 * time.Hour); !first.NotAfter.Equal(want) {
+		t.Errorf("not after want: %v got: %v", want, first.NotAfter)
+	}
+	if _, err := pool.Fill(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if key, job, err := pool.RotateIfDue(context.Background(), first.NotAfter.Add(-25*time.Hour)); key != nil || job != nil || err != nil {
+		t.Errorf("rotation before lead time want: none got: %v, %v, %v", key, job, err)
+	}
+
+	key, job, err := pool.RotateIfDue(context.Background(), first.NotAfter.Add(-23*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == nil || job != nil {
+		t.Fatalf("due rotation want: pooled key got: %v, %v", key, job)
+	}
+	if key.NotAfter.Before(first.NotAfter) {
+		t.Errorf("rotated key expires at %v, before the key it replaced", key.NotAfter)
+	}
+	if old, _ := ks.Get(first.ID); old.Status != StatusDecryptOnly {
+		t.Errorf("expiring key status want: %v got: %v", StatusDecryptOnly, old.Status)
+	}
+}
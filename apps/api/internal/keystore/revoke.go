@@ -0,0 +1,222 @@
+package keystore
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// RevocationReason records why a key was revoked. The values follow the
+// CRLReason codes of RFC 5280 that apply to encryption keys.
+type RevocationReason string
+
+const (
+	ReasonUnspecified          RevocationReason = "unspecified"
+	ReasonKeyCompromise        RevocationReason = "key_compromise"
+	ReasonSuperseded           RevocationReason = "superseded"
+	ReasonCessationOfOperation RevocationReason = "cessation_of_operation"
+)
+
+var (
+	ErrKeyRevoked       = errors.New("keystore: key revoked")
+	ErrKeyDestroyed     = errors.New("keystore: key destroyed")
+	ErrKeyActive        = errors.New("keystore: key is active")
+	ErrInvalidRevReason = errors.New("keystore: invalid revocation reason")
+)
+
+// Revoke marks the key identified by kid as revoked and destroys its key pair.
+// A revoked key refuses all operations and is published by Revoked. Revoking
+// the active key leaves the keystore without one until the next rotation.
+func (ks *Keystore) Revoke(ctx context.Context, kid string, reason RevocationReason) (*Key, error) {
+	key, err := ks.revoke(kid, reason)
+
+	ev := audit.Event{Op: audit.OpKeyRevoke, Kid: kid, Detail: "reason " + string(reason)}
+	if key != nil {
+		ev.Detail = "reason " + string(key.RevocationReason)
+	}
+	if err := ks.recordEvent(ctx, ev, err); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (ks *Keystore) revoke(kid string, reason RevocationReason) (*Key, error) {
+	switch reason {
+	case "":
+		reason = ReasonUnspecified
+	case ReasonUnspecified, ReasonKeyCompromise, ReasonSuperseded, ReasonCessationOfOperation:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRevReason, reason)
+	}
+
+	ks.lifecycle.Lock()
+	defer ks.lifecycle.Unlock()
+
+	if ks.closed {
+		return nil, ErrClosed
+	}
+
+	key, ok := ks.lookup(kid)
+	if !ok || key.Status == StatusDestroyed {
+		return nil, ErrKeyNotFound
+	}
+	if key.Status == StatusRevoked {
+		return key, nil
+	}
+
+	revoked := *key
+	revoked.Status = StatusRevoked
+	revoked.Revoked = ks.now().UTC()
+	revoked.RevocationReason = reason
+	revoked.pub = nil
+	if err := ks.backend.Update(&revoked); err != nil {
+		return nil, fmt.Errorf("error revoking key %s: %w", kid, err)
+	}
+	ks.put(&revoked)
+
+	return &revoked, nil
+}
+
+// Revoked returns all revoked keys ordered by creation time, including those
+// destroyed since.
+func (ks *Keystore) Revoked() []*Key {
+	var revoked []*Key
+	for _, k := range ks.Keys() {
+		if !k.Revoked.IsZero() {
+			revoked = append(revoked, k)
+		}
+	}
+
+	return revoked
+}
+
+// Destroy deletes the key pair identified by kid, zeroing the private key if
+// the backend holds it in memory. Its metadata is kept as a tombstone in
+// StatusDestroyed, so neither Restore nor a revocation list ever forgets the
+// key ID. The active key cannot be destroyed; revoke or rotate it first.
+func (ks *Keystore) Destroy(ctx context.Context, kid string) error {
+	return ks.record(ctx, audit.OpKeyDestroy, kid, ks.destroy(kid))
+}
+
+func (ks *Keystore) destroy(kid string) error {
+	ks.lifecycle.Lock()
+	defer ks.lifecycle.Unlock()
+
+	if ks.closed {
+		return ErrClosed
+	}
+
+	key, ok := ks.lookup(kid)
+	if !ok || key.Status == StatusDestroyed {
+		return ErrKeyNotFound
+	}
+	if key.Status == StatusActive {
+		return ErrKeyActive
+	}
+
+	destroyed := *key
+	destroyed.Status = StatusDestroyed
+	destroyed.Destroyed = ks.now().UTC()
+	destroyed.pub = nil
+	if err := ks.backend.Update(&destroyed); err != nil {
+		return fmt.Errorf("error destroying key %s: %w", kid, err)
+	}
+	ks.put(&destroyed)
+
+	return nil
+}
+
+// DestroyAll deletes every key, including the active one, together with its
+// metadata, e.g. when the owner of the keystore is removed. No keys can be
+// added to the keystore afterwards.
+func (ks *Keystore) DestroyAll(ctx context.Context) error {
+	ks.lifecycle.Lock()
+	defer ks.lifecycle.Unlock()
+
+	ks.generating.Lock()
+	ks.closed = true
+	ks.generating.Unlock()
+
+	for _, k := range ks.Keys() {
+		err := ks.backend.Delete(k.ID)
+		if err != nil {
+			err = fmt.Errorf("error destroying key %s: %w", k.ID, err)
+		} else {
+			ks.remove(k.ID)
+		}
+		if err := ks.record(ctx, audit.OpKeyDestroy, k.ID, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close makes the keystore unusable and releases its backend, zeroing private
+// keys held in memory. Unlike DestroyAll it leaves the stored keys untouched,
+// so the keystore can be opened again, e.g. after the server was unsealed.
+func (ks *Keystore) Close() error {
+	ks.lifecycle.Lock()
+	defer ks.lifecycle.Unlock()
+
+	ks.generating.Lock()
+	ks.closed = true
+	ks.generating.Unlock()
+
+	ks.setKeys(nil)
+
+	if c, ok := ks.backend.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// hasKeyMaterial reports whether keys in status s keep their key pair.
+func hasKeyMaterial(s Status) bool {
+	return s != StatusRetired && s != StatusRevoked && s != StatusDestroyed
+}
+
+// zeroize overwrites the private values of priv, including the precomputed CRT
+// values, so they do not linger in memory until garbage collection. Copies
+// the Go runtime or crypto/rsa made internally are out of reach.
+func zeroize(priv *rsa.PrivateKey) {
+	if priv == nil {
+		return
+	}
+
+	zeroizeInt(priv.D)
+	for _, p := range priv.Primes {
+		zeroizeInt(p)
+	}
+	zeroizeInt(priv.Precomputed.Dp)
+	zeroizeInt(priv.Precomputed.Dq)
+	zeroizeInt(priv.Precomputed.Qinv)
+	for i := range priv.Precomputed.CRTValues {
+		crt := &priv.Precomputed.CRTValues[i]
+		zeroizeInt(crt.Exp)
+		zeroizeInt(crt.Coeff)
+		zeroizeInt(crt.R)
+	}
+
+	priv.Primes = nil
+	priv.Precomputed = rsa.PrecomputedValues{}
+}
+
+// zeroizeInt overwrites the limbs backing b and sets it to 0.
+func zeroizeInt(b *big.Int) {
+	if b == nil {
+		return
+	}
+
+	words := b.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	b.SetInt64(0)
+}
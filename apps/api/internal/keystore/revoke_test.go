@@ -0,0 +1,281 @@
+package keystore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestRevoke(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	backend, err := NewFileBackend(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := Open(Options{Backend: backend, Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ks.ActiveKey()
+
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.PublicKey(), []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ks.Revoke(context.Background(), key.ID, "stolen"); !errors.Is(err, ErrInvalidRevReason) {
+		t.Errorf("revoke with unknown reason want: %v got: %v", ErrInvalidRevReason, err)
+	}
+	revoked, err := ks.Revoke(context.Background(), key.ID, ReasonKeyCompromise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked.Status != StatusRevoked || revoked.Revoked.IsZero() || revoked.PublicKey() != nil {
+		t.Errorf("unexpected revoked key: %+v", revoked)
+	}
+
+	if active := ks.ActiveKey(); active != nil {
+		t.Errorf("revoked key %v is still active", active.ID)
+	}
+	if _, err := ks.Decrypt(context.Background(), key.ID, UsageDecrypt, ciphertext); !errors.Is(err, ErrKeyRevoked) {
+		t.Errorf("decrypt with revoked key want: %v got: %v", ErrKeyRevoked, err)
+	}
+	if _, err := backend.Decrypt(key.ID, ciphertext); err == nil {
+		t.Errorf("backend still decrypts with revoked key")
+	}
+
+	// The revocation survives a restart.
+	backend, err = NewFileBackend(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(Options{Backend: backend, Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := reopened.Revoked()
+	if len(list) != 1 || list[0].ID != key.ID || list[0].RevocationReason != ReasonKeyCompromise {
+		t.Errorf("revocation list want: %v got: %+v", key.ID, list)
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	t.Parallel()
+
+	ks := New(Options{Bits: 2048})
+	old, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ks.Destroy(context.Background(), active.ID); !errors.Is(err, ErrKeyActive) {
+		t.Errorf("destroy active key want: %v got: %v", ErrKeyActive, err)
+	}
+	if err := ks.Destroy(context.Background(), old.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Get(old.ID); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("get destroyed key want: %v got: %v", ErrKeyNotFound, err)
+	}
+	if err := ks.Destroy(context.Background(), old.ID); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("destroy twice want: %v got: %v", ErrKeyNotFound, err)
+	}
+	if tombstone, _ := ks.lookup(old.ID); tombstone == nil || tombstone.Status != StatusDestroyed || tombstone.Destroyed.IsZero() {
+		t.Errorf("unexpected tombstone: %+v", tombstone)
+	}
+
+	if err := ks.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Revoke(context.Background(), active.ID, ReasonUnspecified); !errors.Is(err, ErrClosed) {
+		t.Errorf("revoke after close want: %v got: %v", ErrClosed, err)
+	}
+	if err := ks.Destroy(context.Background(), active.ID); !errors.Is(err, ErrClosed) {
+		t.Errorf("destroy after close want: %v got: %v", ErrClosed, err)
+	}
+}
+
+func TestRestoreRefusesRevoked(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	backend, err := NewFileBackend(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := Open(Options{Backend: backend, Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := ks.ActiveKey()
+	active, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bk := BackupKey{Passphrase: []byte("correct horse battery staple")}
+	archive, err := ks.Backup(context.Background(), bk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The active key is compromised and destroyed after its revocation, the
+	// old one is destroyed.
+	if _, err := ks.Revoke(context.Background(), active.ID, ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Destroy(context.Background(), active.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Destroy(context.Background(), old.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tombstones survive a restart.
+	backend, err = NewFileBackend(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(Options{Backend: backend, Bits: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.Revoked(); len(list) != 1 || list[0].ID != active.ID {
+		t.Errorf("revocation list want: %v got: %+v", active.ID, list)
+	}
+
+	restored, err := reopened.Restore(context.Background(), archive, bk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 0 {
+		t.Errorf("restored want: none got: %+v", restored)
+	}
+	for _, kid := range []string{old.ID, active.ID} {
+		if _, err := reopened.Get(kid); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("get %s want: %v got: %v", kid, ErrKeyNotFound, err)
+		}
+	}
+	if current := reopened.ActiveKey(); current == nil || current.ID == active.ID {
+		t.Errorf("unexpected active key: %+v", current)
+	}
+}
+
+func TestRestoreTombstones(t *testing.T) {
+	t.Parallel()
+
+	src := New(Options{Bits: 2048})
+	var keys [3]*Key
+	for i := range keys {
+		key, err := src.Rotate(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	old, compromised := keys[0], keys[1]
+
+	bk := BackupKey{Passphrase: []byte("correct horse battery staple")}
+	stale, err := src.Backup(context.Background(), bk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Revoke(context.Background(), compromised.ID, ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Destroy(context.Background(), old.ID); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := src.Backup(context.Background(), bk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, ks *Keystore) {
+		t.Helper()
+
+		list := ks.Revoked()
+		if len(list) != 1 || list[0].ID != compromised.ID || list[0].RevocationReason != ReasonKeyCompromise {
+			t.Errorf("revocation list want: %v got: %+v", compromised.ID, list)
+		}
+		if _, err := ks.Get(old.ID); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("get destroyed key want: %v got: %v", ErrKeyNotFound, err)
+		}
+		// The stale archive must not bring the keys back.
+		if _, err := ks.Restore(context.Background(), stale, bk); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ks.Get(compromised.ID); !errors.Is(err, ErrKeyRevoked) {
+			t.Errorf("get revoked key want: %v got: %v", ErrKeyRevoked, err)
+		}
+	}
+
+	t.Run("new keystore", func(t *testing.T) {
+		t.Parallel()
+
+		dst := New(Options{Bits: 2048})
+		restored, err := dst.Restore(context.Background(), archive, bk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(restored) != 3 {
+			t.Errorf("restored want: 3 keys got: %+v", restored)
+		}
+		check(t, dst)
+	})
+
+	t.Run("keys known", func(t *testing.T) {
+		t.Parallel()
+
+		dst := New(Options{Bits: 2048})
+		if _, err := dst.Restore(context.Background(), stale, bk); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := dst.Restore(context.Background(), archive, bk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(restored) != 2 {
+			t.Errorf("restored want: 2 tombstones got: %+v", restored)
+		}
+		check(t, dst)
+	})
+}
+
+func TestZeroize(t *testing.T) {
+	t.Parallel()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := priv.D
+	primes := priv.Primes
+	dp := priv.Precomputed.Dp
+
+	zeroize(priv)
+
+	if d.Sign() != 0 || dp.Sign() != 0 {
+		t.Errorf("private exponent or CRT values not zeroed")
+	}
+	for _, p := range primes {
+		if p.Sign() != 0 {
+			t.Errorf("prime not zeroed")
+		}
+	}
+	for _, w := range d.Bits()[:cap(d.Bits())] {
+		if w != 0 {
+			t.Fatalf("limbs of the private exponent not zeroed")
+		}
+	}
+}
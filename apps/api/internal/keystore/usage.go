@@ -0,0 +1,92 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Usage is an operation a key may be used for. The values mirror WebCrypto
+// KeyUsage.
+type Usage string
+
+const (
+	UsageEncrypt   Usage = "encrypt"
+	UsageDecrypt   Usage = "decrypt"
+	UsageWrapKey   Usage = "wrapKey"
+	UsageUnwrapKey Usage = "unwrapKey"
+	UsageSign      Usage = "sign"
+	UsageVerify    Usage = "verify"
+)
+
+// DefaultUsages are the usages of keys unless configured otherwise. They match
+// the key pairs generated by the TS lib.
+var DefaultUsages = []Usage{UsageEncrypt, UsageDecrypt, UsageWrapKey, UsageUnwrapKey}
+
+var (
+	ErrInvalidUsage    = errors.New("keystore: invalid key usage")
+	ErrUsageNotAllowed = errors.New("keystore: operation not allowed by key usages")
+)
+
+// ParseUsages converts and validates WebCrypto usage names.
+func ParseUsages(names []string) ([]Usage, error) {
+	usages := make([]Usage, 0, len(names))
+	for _, name := range names {
+		usages = append(usages, Usage(name))
+	}
+	if err := ValidateUsages(usages); err != nil {
+		return nil, err
+	}
+
+	return usages, nil
+}
+
+// ValidateUsages checks that usages is a non-empty set of usages an RSA-OAEP
+// key supports. Signing usages are rejected.
+func ValidateUsages(usages []Usage) error {
+	if len(usages) == 0 {
+		return fmt.Errorf("%w: no usages", ErrInvalidUsage)
+	}
+
+	for _, u := range usages {
+		switch u {
+		case UsageEncrypt, UsageDecrypt, UsageWrapKey, UsageUnwrapKey:
+		case UsageSign, UsageVerify:
+			return fmt.Errorf("%w: RSA-OAEP keys cannot %s", ErrInvalidUsage, u)
+		default:
+			return fmt.Errorf("%w: unknown usage %q", ErrInvalidUsage, u)
+		}
+	}
+
+	return nil
+}
+
+// Allows reports whether the key may be used for u. Keys stored before usages
+// were recorded allow all usages of DefaultUsages.
+func (k *Key) Allows(u Usage) bool {
+	usages := k.Usages
+	if len(usages) == 0 {
+		usages = DefaultUsages
+	}
+
+	for _, allowed := range usages {
+		if allowed == u {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PublicUsages returns the usages of the public key: encrypt and wrapKey,
+// either directly or as counterpart of decrypt and unwrapKey.
+func (k *Key) PublicUsages() []Usage {
+	var usages []Usage
+	if k.Allows(UsageEncrypt) || k.Allows(UsageDecrypt) {
+		usages = append(usages, UsageEncrypt)
+	}
+	if k.Allows(UsageWrapKey) || k.Allows(UsageUnwrapKey) {
+		usages = append(usages, UsageWrapKey)
+	}
+
+	return usages
+}
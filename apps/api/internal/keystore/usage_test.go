@@ -0,0 +1,68 @@
+package keystore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestParseUsages(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		names []string
+		err   error
+	}{
+		{name: "all oaep usages", names: []string{"encrypt", "decrypt", "wrapKey", "unwrapKey"}},
+		{name: "wrap only", names: []string{"wrapKey", "unwrapKey"}},
+		{name: "empty", names: nil, err: ErrInvalidUsage},
+		{name: "sign", names: []string{"unwrapKey", "sign"}, err: ErrInvalidUsage},
+		{name: "verify", names: []string{"verify"}, err: ErrInvalidUsage},
+		{name: "unknown", names: []string{"deriveKey"}, err: ErrInvalidUsage},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := ParseUsages(tt.names)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("want: %v got: %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestDecryptEnforcesUsages(t *testing.T) {
+	t.Parallel()
+
+	ks := New(Options{Bits: 2048, Usages: []Usage{UsageWrapKey, UsageUnwrapKey}})
+	key, err := ks.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.PublicKey(), []byte("data key"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ks.Decrypt(context.Background(), key.ID, UsageUnwrapKey, ciphertext); err != nil {
+		t.Errorf("unwrap with wrap-only key: %v", err)
+	}
+	if _, err := ks.Decrypt(context.Background(), key.ID, UsageDecrypt, ciphertext); !errors.Is(err, ErrUsageNotAllowed) {
+		t.Errorf("decrypt with wrap-only key want: %v got: %v", ErrUsageNotAllowed, err)
+	}
+	if _, err := ks.Decrypt(context.Background(), key.ID, UsageSign, ciphertext); !errors.Is(err, ErrInvalidUsage) {
+		t.Errorf("decrypt for signing want: %v got: %v", ErrInvalidUsage, err)
+	}
+
+	if got := key.PublicUsages(); len(got) != 1 || got[0] != UsageWrapKey {
+		t.Errorf("public usages want: [%v] got: %v", UsageWrapKey, got)
+	}
+}
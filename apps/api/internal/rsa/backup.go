@@ -0,0 +1,163 @@
+package rsa
+
+import (
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/apihelper"
+	"ezzy-web-crypto/api/apps/api/internal/jsonutil"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"fmt"
+	"net/http"
+)
+
+type backupRequest struct {
+	// PublicKey is the base64 SPKI backup public key the archive is wrapped
+	// under.
+	PublicKey string `json:"public_key"`
+	// Passphrase wraps the archive instead of PublicKey.
+	Passphrase string `json:"passphrase"`
+}
+
+func HandleBackup(ks *keystore.Keystore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req backupRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &req)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		var bk keystore.BackupKey
+		switch {
+		case req.PublicKey != "" && req.Passphrase != "":
+			err = errors.New("public_key and passphrase are mutually exclusive")
+		case req.PublicKey != "":
+			bk.PublicKey, err = keystore.ImportPublicKey(req.PublicKey)
+		case req.Passphrase != "":
+			bk.Passphrase = []byte(req.Passphrase)
+		default:
+			err = errors.New("public_key or passphrase is required")
+		}
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		archive, err := ks.Backup(r.Context(), bk)
+		if errors.Is(err, keystore.ErrNotExportable) {
+			jsonutil.MarshalResponse(rw, http.StatusConflict, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error creating backup: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, archive)
+	}
+}
+
+// maxRestoreBytes bounds restore requests. Archives carry every key with
+// material and outgrow the default body limit at around 17 4096-bit keys.
+const maxRestoreBytes = 16 << 20
+
+type restoreRequest struct {
+	Archive *keystore.Archive `json:"archive"`
+	// Format and PrivateKey hold the backup private key, as for key import.
+	Format     string `json:"format"`
+	PrivateKey string `json:"private_key"`
+	// Passphrase unwraps a passphrase protected archive.
+	Passphrase string `json:"passphrase"`
+}
+
+type restoreResponse struct {
+	Keys []keyState `json:"keys"`
+}
+
+func HandleRestore(ks *keystore.Keystore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req restoreRequest
+
+		code, err := jsonutil.UnmarshalLimit(rw, r, &req, maxRestoreBytes)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		bk, err := restoreBackupKey(&req)
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		keys, err := ks.Restore(r.Context(), req.Archive, bk)
+		if errors.Is(err, keystore.ErrArchiveIntegrity) || errors.Is(err, keystore.ErrWrongPassphrase) {
+			jsonutil.MarshalResponse(rw, http.StatusUnprocessableEntity, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		if err != nil && len(keys) == 0 {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error restoring backup after %d key(s): %v", len(keys), err)
+			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		res := &restoreResponse{Keys: make([]keyState, 0, len(keys))}
+		for _, k := range keys {
+			res.Keys = append(res.Keys, newKeyState(k))
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, res)
+	}
+}
+
+// restoreBackupKey returns the key unwrapping req.Archive.
+func restoreBackupKey(req *restoreRequest) (keystore.BackupKey, error) {
+	var bk keystore.BackupKey
+
+	if req.Archive == nil {
+		return bk, errors.New("archive is required")
+	}
+
+	switch {
+	case req.PrivateKey != "" && req.Passphrase != "":
+		return bk, errors.New("private_key and passphrase are mutually exclusive")
+	case req.Passphrase != "":
+		bk.Passphrase = []byte(req.Passphrase)
+		return bk, nil
+	case req.PrivateKey == "":
+		return bk, errors.New("private_key or passphrase is required")
+	}
+
+	data, format, err := importKeyData(&importKeyRequest{Format: req.Format, PrivateKey: req.PrivateKey})
+	if err != nil {
+		return bk, fmt.Errorf("error reading private key: %v", err)
+	}
+
+	bk.PrivateKey, err = keystore.ParsePrivateKey(data, format)
+	return bk, err
+}
@@ -0,0 +1,58 @@
+package rsa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleRestoreLargeArchive(t *testing.T) {
+	t.Parallel()
+
+	src := keystore.New(keystore.Options{Bits: 2048})
+	if _, err := src.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Enough pending keys to take the archive past the default 64 KB body
+	// limit.
+	const pending = 40
+	for i := 0; i < pending; i++ {
+		if _, err := src.Generate(context.Background(), 2048); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bk := keystore.BackupKey{Passphrase: []byte("correct horse battery staple")}
+	archive, err := src.Backup(context.Background(), bk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(&restoreRequest{Archive: archive, Passphrase: string(bk.Passphrase)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) <= 64_000 {
+		t.Fatalf("archive want more than 64000 bytes got: %v", len(body))
+	}
+
+	dst := keystore.New(keystore.Options{Bits: 2048})
+	r := httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(body))
+	r.Header.Set("content-type", "application/json")
+	w := httptest.NewRecorder()
+	HandleRestore(dst)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong response code, want: %v got: %v (%s)", http.StatusOK, w.Code, w.Body)
+	}
+	var res restoreResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Keys) != pending+1 {
+		t.Errorf("restored keys want: %v got: %v", pending+1, len(res.Keys))
+	}
+}
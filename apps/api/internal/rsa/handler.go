@@ -2,16 +2,54 @@ package rsa
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"ezzy-web-crypto/api/apps/api/internal/apihelper"
 	"ezzy-web-crypto/api/apps/api/internal/jsonutil"
 	"ezzy-web-crypto/api/apps/api/internal/keystore"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
-func HandlePostNewKeyPair() http.HandlerFunc {
+type newKeyPairRequest struct {
+	// Bits is the modulus size of the new key. Defaults to the configured
+	// key size.
+	Bits int `json:"bits"`
+}
+
+type newKeyPairResponse struct {
+	Kid string `json:"kid"`
+}
+
+// HandlePostNewKeyPair rotates to a pre-generated key and responds with 201.
+// If none is ready, it responds with 202 and the job generating the key.
+func HandlePostNewKeyPair(pool *keystore.Pool) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		err := keystore.NewKeyPair()
+		var req newKeyPairRequest
+
+		// The body is optional.
+		if r.ContentLength != 0 {
+			code, err := jsonutil.Unmarshal(rw, r, &req)
+			if err != nil {
+				message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+				jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+					ErrorMessage: message,
+				})
+				return
+			}
+		}
+
+		key, job, err := pool.Rotate(r.Context(), req.Bits)
+		if errors.Is(err, keystore.ErrInvalidBits) {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
 		if err != nil {
 			message := fmt.Sprintf("error generating keypair: %v", err)
 			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
@@ -20,18 +58,83 @@ func HandlePostNewKeyPair() http.HandlerFunc {
 			return
 		}
 
-		rw.WriteHeader(http.StatusCreated)
+		if job != nil {
+			rw.Header().Set("Location", apihelper.URLPath(r, "/rsa/jobs/"+job.ID))
+			jsonutil.MarshalResponse(rw, http.StatusAccepted, newJobResponse(job))
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusCreated, &newKeyPairResponse{
+			Kid: key.ID,
+		})
+	}
+}
+
+type jobResponse struct {
+	JobID    string     `json:"job_id"`
+	Status   string     `json:"status"`
+	Bits     int        `json:"bits"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Kid      string     `json:"kid,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+func newJobResponse(job *keystore.Job) *jobResponse {
+	res := &jobResponse{
+		JobID:   job.ID,
+		Status:  string(job.Status),
+		Bits:    job.Bits,
+		Created: job.Created,
+		Kid:     job.Kid,
+	}
+	if !job.Finished.IsZero() {
+		finished := job.Finished
+		res.Finished = &finished
+	}
+	if job.Err != nil {
+		res.Error = job.Err.Error()
+	}
+
+	return res
+}
+
+func HandleGetJob(pool *keystore.Pool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		job, err := pool.Job(chi.URLParam(r, "id"))
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusNotFound, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, newJobResponse(job))
 	}
 }
 
 type getPublicKeyResponse struct {
+	Kid       string `json:"kid"`
 	PublicKey string `json:"public_key"`
+	// KeyOps are the WebCrypto usages the public key may be imported with.
+	KeyOps []keystore.Usage `json:"key_ops"`
+	// NotAfter is the expiry of the key. Clients should fetch a new key
+	// before.
+	NotAfter *time.Time `json:"not_after,omitempty"`
 }
 
-func HandleGetPublicKey() http.HandlerFunc {
+func HandleGetPublicKey(ks *keystore.Keystore) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		pub := keystore.ExportPublicKey()
-		if pub == nil {
+		key, err := ks.Current()
+		if errors.Is(err, keystore.ErrKeyExpired) {
+			// The key is refused until maintenance or POST /rsa rotates it.
+			message := fmt.Sprintf("error no valid keypair available, rotation pending: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusServiceUnavailable, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if err != nil {
 			message := "error no keypair available"
 			jsonutil.MarshalResponse(rw, http.StatusNotFound, &apihelper.ErrorResponse{
 				ErrorMessage: message,
@@ -39,15 +142,87 @@ func HandleGetPublicKey() http.HandlerFunc {
 			return
 		}
 
-		pubBase64 := base64.StdEncoding.EncodeToString(pub)
+		pubBase64 := base64.StdEncoding.EncodeToString(key.ExportPublicKey())
 
-		jsonutil.MarshalResponse(rw, http.StatusOK, &getPublicKeyResponse{
+		res := &getPublicKeyResponse{
+			Kid:       key.ID,
 			PublicKey: pubBase64,
-		})
+			KeyOps:    key.PublicUsages(),
+		}
+		if !key.NotAfter.IsZero() {
+			notAfter := key.NotAfter
+			res.NotAfter = &notAfter
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, res)
 	}
 }
 
+type keyState struct {
+	Kid      string           `json:"kid"`
+	Status   string           `json:"status"`
+	Usages   []keystore.Usage `json:"usages,omitempty"`
+	Created  time.Time        `json:"created"`
+	NotAfter *time.Time       `json:"not_after,omitempty"`
+	RetireAt *time.Time       `json:"retire_at,omitempty"`
+	Retired  *time.Time       `json:"retired,omitempty"`
+	Revoked  *time.Time       `json:"revoked,omitempty"`
+	// RevocationReason is set for revoked keys.
+	RevocationReason string     `json:"revocation_reason,omitempty"`
+	Destroyed        *time.Time `json:"destroyed,omitempty"`
+}
+
+type listKeysResponse struct {
+	Keys []keyState `json:"keys"`
+}
+
+func HandleListKeys(ks *keystore.Keystore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		keys := ks.Keys()
+
+		res := listKeysResponse{Keys: make([]keyState, 0, len(keys))}
+		for _, k := range keys {
+			res.Keys = append(res.Keys, newKeyState(k))
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &res)
+	}
+}
+
+func newKeyState(k *keystore.Key) keyState {
+	state := keyState{
+		Kid:     k.ID,
+		Status:  string(k.Status),
+		Usages:  k.Usages,
+		Created: k.Created,
+	}
+	if !k.NotAfter.IsZero() {
+		notAfter := k.NotAfter
+		state.NotAfter = &notAfter
+	}
+	if !k.RetireAt.IsZero() {
+		retireAt := k.RetireAt
+		state.RetireAt = &retireAt
+	}
+	if !k.Retired.IsZero() {
+		retired := k.Retired
+		state.Retired = &retired
+	}
+	if !k.Revoked.IsZero() {
+		revoked := k.Revoked
+		state.Revoked = &revoked
+		state.RevocationReason = string(k.RevocationReason)
+	}
+	if !k.Destroyed.IsZero() {
+		destroyed := k.Destroyed
+		state.Destroyed = &destroyed
+	}
+
+	return state
+}
+
 type rsaDecryptRequest struct {
+	Kid        string `json:"kid"`
 	EncMessage string `json:"enc_message"`
 }
 
@@ -55,7 +230,7 @@ type rsaDecryptResponse struct {
 	Message string `json:"message"`
 }
 
-func HandleRsaDecryption() http.HandlerFunc {
+func HandleRsaDecryption(ks *keystore.Keystore) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		var req rsaDecryptRequest
 
@@ -68,9 +243,37 @@ func HandleRsaDecryption() http.HandlerFunc {
 			return
 		}
 
-		plaintext, err := decrypt(req.EncMessage)
+		plaintext, err := decrypt(r.Context(), ks, req.Kid, req.EncMessage)
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			message := fmt.Sprintf("error unknown kid %q", req.Kid)
+			jsonutil.MarshalResponse(rw, http.StatusNotFound, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if errors.Is(err, keystore.ErrKeyRetired) {
+			message := fmt.Sprintf("error key %q is retired", req.Kid)
+			jsonutil.MarshalResponse(rw, http.StatusGone, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if errors.Is(err, keystore.ErrKeyRevoked) {
+			message := fmt.Sprintf("error key %q is revoked", req.Kid)
+			jsonutil.MarshalResponse(rw, http.StatusGone, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if errors.Is(err, keystore.ErrUsageNotAllowed) {
+			message := fmt.Sprintf("error key %q does not allow decryption", req.Kid)
+			jsonutil.MarshalResponse(rw, http.StatusForbidden, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
 		if err != nil {
-			message := fmt.Sprintf("error encrypting message: %v", err)
+			message := fmt.Sprintf("error decrypting message: %v", err)
 			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
 				ErrorMessage: message,
 			})
@@ -116,3 +319,111 @@ func HandleRsaEncryption() http.HandlerFunc {
 		})
 	}
 }
+
+type importKeyRequest struct {
+	// Format is one of pkcs8, pkcs1, pem or jwk. It is detected if empty.
+	Format string `json:"format"`
+	// PrivateKey holds a PEM encoded key or base64 encoded DER.
+	PrivateKey string `json:"private_key"`
+	// JWK holds a key in JWK form instead of PrivateKey.
+	JWK json.RawMessage `json:"jwk"`
+	// Activate makes the imported key the active key. Defaults to true.
+	Activate *bool `json:"activate"`
+	// Usages restricts the key to these WebCrypto key usages. Defaults to the
+	// usages of generated keys.
+	Usages []string `json:"usages"`
+}
+
+type importKeyResponse struct {
+	Kid    string `json:"kid"`
+	Status string `json:"status"`
+}
+
+func HandleImportKey(ks *keystore.Keystore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req importKeyRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &req)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		data, format, err := importKeyData(&req)
+		if err != nil {
+			message := fmt.Sprintf("error reading private key: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		priv, err := keystore.ParsePrivateKey(data, format)
+		if err != nil {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+
+		var usages []keystore.Usage
+		if len(req.Usages) > 0 {
+			usages, err = keystore.ParseUsages(req.Usages)
+			if err != nil {
+				jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+					ErrorMessage: err.Error(),
+				})
+				return
+			}
+		}
+
+		activate := req.Activate == nil || *req.Activate
+		key, err := ks.Import(r.Context(), priv, activate, usages)
+		if errors.Is(err, keystore.ErrKeyExists) {
+			jsonutil.MarshalResponse(rw, http.StatusConflict, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error importing key: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusCreated, &importKeyResponse{
+			Kid:    key.ID,
+			Status: string(key.Status),
+		})
+	}
+}
+
+// importKeyData returns the raw key of req and its format.
+func importKeyData(req *importKeyRequest) ([]byte, string, error) {
+	if len(req.JWK) > 0 {
+		if req.PrivateKey != "" {
+			return nil, "", errors.New("private_key and jwk are mutually exclusive")
+		}
+		return req.JWK, keystore.FormatJWK, nil
+	}
+
+	if req.PrivateKey == "" {
+		return nil, "", errors.New("private_key or jwk is required")
+	}
+
+	if req.Format == keystore.FormatPEM || strings.HasPrefix(strings.TrimSpace(req.PrivateKey), "-----BEGIN") {
+		return []byte(req.PrivateKey), keystore.FormatPEM, nil
+	}
+
+	der, err := base64.StdEncoding.DecodeString(req.PrivateKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("private_key is neither PEM nor base64: %v", err)
+	}
+
+	return der, req.Format, nil
+}
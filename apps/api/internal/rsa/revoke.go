@@ -0,0 +1,155 @@
+package rsa
+
+import (
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/apihelper"
+	"ezzy-web-crypto/api/apps/api/internal/jsonutil"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type revokeKeyRequest struct {
+	// Reason is one of unspecified, key_compromise, superseded or
+	// cessation_of_operation. Defaults to unspecified.
+	Reason string `json:"reason"`
+}
+
+type revokeKeyResponse struct {
+	keyState
+	// Replacement is the new active key if the active key was revoked.
+	Replacement string `json:"replacement,omitempty"`
+	// Job generates the new active key if no pre-generated key was ready.
+	Job *jobResponse `json:"job,omitempty"`
+}
+
+// HandleRevokeKey revokes the key given by the kid URL parameter and destroys
+// its key pair. A revoked active key is replaced right away.
+func HandleRevokeKey(ks *keystore.Keystore, pool *keystore.Pool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req revokeKeyRequest
+
+		// The body is optional.
+		if r.ContentLength != 0 {
+			code, err := jsonutil.Unmarshal(rw, r, &req)
+			if err != nil {
+				message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+				jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+					ErrorMessage: message,
+				})
+				return
+			}
+		}
+
+		kid := chi.URLParam(r, "kid")
+		wasActive := false
+		if active := ks.ActiveKey(); active != nil && active.ID == kid {
+			wasActive = true
+		}
+
+		key, err := ks.Revoke(r.Context(), kid, keystore.RevocationReason(req.Reason))
+		if errors.Is(err, keystore.ErrInvalidRevReason) {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			message := fmt.Sprintf("error unknown kid %q", kid)
+			jsonutil.MarshalResponse(rw, http.StatusNotFound, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error revoking key: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		res := &revokeKeyResponse{keyState: newKeyState(key)}
+		if wasActive {
+			replacement, job, err := pool.Rotate(r.Context(), 0)
+			if err != nil {
+				message := fmt.Sprintf("key revoked, error replacing the active key: %v", err)
+				jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+					ErrorMessage: message,
+				})
+				return
+			}
+			if replacement != nil {
+				res.Replacement = replacement.ID
+			} else {
+				res.Job = newJobResponse(job)
+			}
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, res)
+	}
+}
+
+// HandleDestroyKey destroys the key pair given by the kid URL parameter. The
+// key ID is kept as a tombstone in status destroyed.
+func HandleDestroyKey(ks *keystore.Keystore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		kid := chi.URLParam(r, "kid")
+
+		err := ks.Destroy(r.Context(), kid)
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			message := fmt.Sprintf("error unknown kid %q", kid)
+			jsonutil.MarshalResponse(rw, http.StatusNotFound, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if errors.Is(err, keystore.ErrKeyActive) {
+			jsonutil.MarshalResponse(rw, http.StatusConflict, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error destroying key: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type revokedKey struct {
+	Kid     string    `json:"kid"`
+	Revoked time.Time `json:"revoked"`
+	Reason  string    `json:"reason"`
+}
+
+type revocationListResponse struct {
+	Keys []revokedKey `json:"keys"`
+}
+
+// HandleGetRevocationList publishes the revoked keys, so clients drop them
+// from their caches.
+func HandleGetRevocationList(ks *keystore.Keystore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		revoked := ks.Revoked()
+
+		res := revocationListResponse{Keys: make([]revokedKey, 0, len(revoked))}
+		for _, k := range revoked {
+			res.Keys = append(res.Keys, revokedKey{
+				Kid:     k.ID,
+				Revoked: k.Revoked,
+				Reason:  string(k.RevocationReason),
+			})
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &res)
+	}
+}
@@ -1,30 +1,24 @@
 package rsa
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
-	"errors"
 	"ezzy-web-crypto/api/apps/api/internal/keystore"
 	"fmt"
 )
 
-func decrypt(encMsgBase64 string) (string, error) {
-	priv := keystore.PrivateKey()
-	if priv == nil {
-		return "", errors.New("no private key available")
-	}
-
+func decrypt(ctx context.Context, ks *keystore.Keystore, kid, encMsgBase64 string) (string, error) {
 	encMessage, err := base64.StdEncoding.DecodeString(encMsgBase64)
 	if err != nil {
 		return "", err
 	}
 
-	hash := sha256.New()
-	plaintext, err := rsa.DecryptOAEP(hash, rand.Reader, priv, encMessage, nil)
+	plaintext, err := ks.Decrypt(ctx, kid, keystore.UsageDecrypt, encMessage)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	return string(plaintext), nil
@@ -0,0 +1,167 @@
+package seal
+
+import (
+	"encoding/base64"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/apihelper"
+	"ezzy-web-crypto/api/apps/api/internal/jsonutil"
+	"fmt"
+	"net/http"
+)
+
+type statusResponse struct {
+	Initialized bool `json:"initialized"`
+	Sealed      bool `json:"sealed"`
+	Unsealing   bool `json:"unsealing,omitempty"`
+	Shares      int  `json:"shares"`
+	Threshold   int  `json:"threshold"`
+	Progress    int  `json:"progress"`
+}
+
+func newStatusResponse(st Status) *statusResponse {
+	return &statusResponse{
+		Initialized: st.Initialized,
+		Sealed:      st.Sealed,
+		Unsealing:   st.Unsealing,
+		Shares:      st.Shares,
+		Threshold:   st.Threshold,
+		Progress:    st.Progress,
+	}
+}
+
+type initRequest struct {
+	Shares    int `json:"shares"`
+	Threshold int `json:"threshold"`
+}
+
+type initResponse struct {
+	// Shares are the base64 encoded master key shares. They are only shown
+	// once.
+	Shares    []string `json:"shares"`
+	Threshold int      `json:"threshold"`
+}
+
+type unsealRequest struct {
+	Share string `json:"share"` // base64
+}
+
+func HandleGetStatus(s *Seal) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		jsonutil.MarshalResponse(rw, http.StatusOK, newStatusResponse(s.Status()))
+	}
+}
+
+// HandleInit initializes the seal and returns the master key shares.
+func HandleInit(s *Seal) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req initRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &req)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		shares, err := s.Init(r.Context(), req.Shares, req.Threshold)
+		if errors.Is(err, ErrInvalidShares) {
+			message := fmt.Sprintf("%v: want 2 <= threshold <= shares <= %d", err, maxShares)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if errors.Is(err, ErrInitialized) {
+			jsonutil.MarshalResponse(rw, http.StatusConflict, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error initializing seal: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		res := &initResponse{Shares: make([]string, len(shares)), Threshold: req.Threshold}
+		for i, share := range shares {
+			res.Shares[i] = base64.StdEncoding.EncodeToString(share)
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, res)
+	}
+}
+
+// HandleUnseal submits a master key share and returns the seal status.
+func HandleUnseal(s *Seal) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req unsealRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &req)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		share, err := base64.StdEncoding.DecodeString(req.Share)
+		if err != nil {
+			message := fmt.Sprintf("error decoding share: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		st, err := s.Unseal(r.Context(), share)
+		switch {
+		case errors.Is(err, ErrMalformedShare), errors.Is(err, ErrDuplicateShare):
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+		case errors.Is(err, ErrNotInitialized), errors.Is(err, ErrUnsealing):
+			jsonutil.MarshalResponse(rw, http.StatusConflict, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+		case errors.Is(err, ErrWrongShares):
+			jsonutil.MarshalResponse(rw, http.StatusUnprocessableEntity, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+		case err != nil:
+			message := fmt.Sprintf("error unsealing: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+		default:
+			jsonutil.MarshalResponse(rw, http.StatusOK, newStatusResponse(st))
+		}
+	}
+}
+
+// HandleSeal seals the server, wiping the master key from memory.
+func HandleSeal(s *Seal) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		err := s.Seal(r.Context())
+		if errors.Is(err, ErrUnsealing) {
+			jsonutil.MarshalResponse(rw, http.StatusConflict, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error sealing: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, newStatusResponse(s.Status()))
+	}
+}
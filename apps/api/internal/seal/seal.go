@@ -0,0 +1,333 @@
+// Package seal keeps the master key of the keystores out of reach until
+// operators unseal the server. The master key is split with Shamir's secret
+// sharing into shares handed out to operators once, at initialization; any
+// threshold of them recovers it. Only a check value of the master key is
+// stored, so the server starts sealed and cannot use its keys before enough
+// shares were submitted. Sealing wipes the master key from memory again.
+package seal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+	"ezzy-web-crypto/api/apps/api/internal/fileutil"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const (
+	sealVersion = 1
+	// MasterKeySize is the size of the master key in bytes.
+	MasterKeySize = 32
+	checkInfo     = "ezzy-web-crypto seal check"
+)
+
+var (
+	ErrSealed         = errors.New("seal: sealed")
+	ErrNotInitialized = errors.New("seal: not initialized")
+	ErrInitialized    = errors.New("seal: already initialized")
+	ErrWrongShares    = errors.New("seal: shares do not recover the master key")
+	ErrUnsealing      = errors.New("seal: unseal in progress")
+)
+
+// Status describes the state of a Seal.
+type Status struct {
+	Initialized bool
+	Sealed      bool
+	// Unsealing is set while Options.Unsealed runs; the seal is still sealed.
+	Unsealing bool
+	// Shares and Threshold are the number of shares handed out and needed.
+	Shares    int
+	Threshold int
+	// Progress is the number of shares submitted towards the next unseal.
+	Progress int
+}
+
+// Options configure a Seal.
+type Options struct {
+	// Path is the file recording the seal configuration.
+	Path string
+	// Unsealed is called with the master key once the seal is unsealed, e.g.
+	// to open the keystores. The seal stays sealed if it fails. The master
+	// key is zeroed when the seal is sealed again, after Sealed returned.
+	// It runs without blocking Status; Unseal and Seal fail with
+	// ErrUnsealing meanwhile.
+	Unsealed func(ctx context.Context, masterKey []byte) error
+	// Sealed is called before the master key is wiped, e.g. to close the
+	// keystores and drop their private keys from memory.
+	Sealed func(ctx context.Context) error
+	// Audit records initializing, unsealing and sealing. Optional.
+	Audit audit.Recorder
+}
+
+type sealFile struct {
+	Version   int `json:"version"`
+	Shares    int `json:"shares"`
+	Threshold int `json:"threshold"`
+	// Check is the HMAC-SHA256 of checkInfo under the master key, which
+	// tells a recovered master key from a wrong one.
+	Check []byte `json:"check"`
+}
+
+// Seal guards the master key. It is safe for concurrent use.
+type Seal struct {
+	opts Options
+
+	mu       sync.Mutex
+	config   *sealFile
+	key      []byte
+	progress [][]byte
+	// unsealing is set while Options.Unsealed runs with mu released.
+	unsealing bool
+}
+
+// Open returns a sealed Seal with the configuration recorded in opts.Path, or
+// an uninitialized one if the file does not exist.
+func Open(opts Options) (*Seal, error) {
+	s := &Seal{opts: opts}
+
+	data, err := ioutil.ReadFile(opts.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f sealFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("seal: malformed seal file: %w", err)
+	}
+	if f.Version != sealVersion {
+		return nil, fmt.Errorf("seal: unsupported seal file version %d", f.Version)
+	}
+	s.config = &f
+
+	return s, nil
+}
+
+// Status returns the current state of the seal.
+func (s *Seal) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.status()
+}
+
+func (s *Seal) status() Status {
+	st := Status{Sealed: s.key == nil, Unsealing: s.unsealing, Progress: len(s.progress)}
+	if s.config != nil {
+		st.Initialized = true
+		st.Shares = s.config.Shares
+		st.Threshold = s.config.Threshold
+	}
+
+	return st
+}
+
+// Sealed reports whether the master key is unavailable.
+func (s *Seal) Sealed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.key == nil
+}
+
+// Init generates a master key and splits it into the given number of shares,
+// any threshold of which unseal the seal. The shares are returned once and
+// never stored; the seal stays sealed.
+func (s *Seal) Init(ctx context.Context, shares, threshold int) ([][]byte, error) {
+	list, err := s.init(shares, threshold)
+	if err := s.record(ctx, audit.OpSealInit, err); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (s *Seal) init(shares, threshold int) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config != nil {
+		return nil, ErrInitialized
+	}
+
+	key := make([]byte, MasterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	defer zero(key)
+
+	list, err := Split(key, shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &sealFile{
+		Version:   sealVersion,
+		Shares:    shares,
+		Threshold: threshold,
+		Check:     checkValue(key),
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := fileutil.WriteFileAtomic(s.opts.Path, data); err != nil {
+		return nil, err
+	}
+	s.config = f
+
+	return list, nil
+}
+
+// Unseal submits a share. Once threshold distinct shares are in, the master
+// key is recovered and verified, and Options.Unsealed is called. Submitted
+// shares are discarded if they fail to recover the master key.
+func (s *Seal) Unseal(ctx context.Context, share []byte) (Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config == nil {
+		return s.status(), ErrNotInitialized
+	}
+	if s.unsealing {
+		return s.status(), ErrUnsealing
+	}
+	if s.key != nil {
+		return s.status(), nil
+	}
+
+	if len(share) != MasterKeySize+shareOverhead || share[MasterKeySize] == 0 {
+		return s.status(), ErrMalformedShare
+	}
+	for _, p := range s.progress {
+		if p[MasterKeySize] == share[MasterKeySize] {
+			return s.status(), ErrDuplicateShare
+		}
+	}
+	s.progress = append(s.progress, append([]byte(nil), share...))
+	if len(s.progress) < s.config.Threshold {
+		return s.status(), nil
+	}
+
+	key, err := s.unseal(ctx)
+	if err := s.record(ctx, audit.OpUnseal, err); err != nil {
+		// An unseal that cannot be recorded is undone.
+		if key != nil {
+			if s.opts.Sealed != nil {
+				s.opts.Sealed(ctx)
+			}
+			zero(key)
+		}
+		return s.status(), err
+	}
+	s.key = key
+
+	return s.status(), nil
+}
+
+// unseal recovers the master key from the submitted shares and hands it to
+// Options.Unsealed. The shares are discarded either way. s.mu must be held.
+func (s *Seal) unseal(ctx context.Context) ([]byte, error) {
+	key, err := Combine(s.progress)
+	for _, p := range s.progress {
+		zero(p)
+	}
+	s.progress = nil
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(checkValue(key), s.config.Check) {
+		zero(key)
+		return nil, ErrWrongShares
+	}
+
+	if s.opts.Unsealed != nil {
+		if err := s.unsealed(ctx, key); err != nil {
+			zero(key)
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// unsealed calls Options.Unsealed with s.mu released, as opening keystores
+// may take seconds. s.mu must be held and is held again on return.
+func (s *Seal) unsealed(ctx context.Context, key []byte) error {
+	s.unsealing = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.unsealing = false
+	}()
+
+	return s.opts.Unsealed(ctx, key)
+}
+
+// Seal calls Options.Sealed and wipes the master key from memory. Shares
+// submitted towards an unseal are discarded as well.
+func (s *Seal) Seal(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unsealing {
+		return ErrUnsealing
+	}
+
+	for _, p := range s.progress {
+		zero(p)
+	}
+	s.progress = nil
+
+	if s.key == nil {
+		return nil
+	}
+
+	var err error
+	if s.opts.Sealed != nil {
+		err = s.opts.Sealed(ctx)
+	}
+	// The key is wiped even if closing failed; the keystores cannot be
+	// reopened without it.
+	zero(s.key)
+	s.key = nil
+
+	return s.record(ctx, audit.OpSeal, err)
+}
+
+// record writes an audit event for the operation op, which failed with err or
+// succeeded if err is nil. It returns err, or the error writing the event.
+func (s *Seal) record(ctx context.Context, op string, err error) error {
+	if s.opts.Audit == nil {
+		return err
+	}
+
+	ev := audit.Event{Op: op, Outcome: audit.OutcomeSuccess}
+	if err != nil {
+		ev.Outcome = audit.OutcomeFailure
+		ev.Error = err.Error()
+	}
+
+	if recErr := s.opts.Audit.Record(ctx, ev); recErr != nil && err == nil {
+		return recErr
+	}
+
+	return err
+}
+
+func checkValue(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(checkInfo))
+
+	return mac.Sum(nil)
+}
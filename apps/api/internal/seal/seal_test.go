@@ -0,0 +1,185 @@
+package seal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+type testKeys struct {
+	opened []byte
+	closed int
+}
+
+func testSeal(t *testing.T, path string, keys *testKeys) *Seal {
+	t.Helper()
+
+	s, err := Open(Options{
+		Path: path,
+		Unsealed: func(ctx context.Context, masterKey []byte) error {
+			keys.opened = append([]byte(nil), masterKey...)
+			return nil
+		},
+		Sealed: func(ctx context.Context) error {
+			keys.closed++
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestSealLifecycle(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "seal.json")
+	keys := &testKeys{}
+	s := testSeal(t, path, keys)
+
+	if _, err := s.Unseal(ctx, make([]byte, MasterKeySize+1)); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("unseal before init want: %v got: %v", ErrNotInitialized, err)
+	}
+
+	shares, err := s.Init(ctx, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Init(ctx, 3, 2); !errors.Is(err, ErrInitialized) {
+		t.Errorf("second init want: %v got: %v", ErrInitialized, err)
+	}
+	if !s.Sealed() {
+		t.Fatal("seal unsealed by init")
+	}
+
+	// The configuration survives a restart, which starts sealed.
+	s = testSeal(t, path, keys)
+
+	st, err := s.Unseal(ctx, shares[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Status{Initialized: true, Sealed: true, Shares: 3, Threshold: 2, Progress: 1}); st != want {
+		t.Errorf("status want: %+v got: %+v", want, st)
+	}
+	if _, err := s.Unseal(ctx, shares[2]); !errors.Is(err, ErrDuplicateShare) {
+		t.Errorf("duplicate share want: %v got: %v", ErrDuplicateShare, err)
+	}
+
+	st, err = s.Unseal(ctx, shares[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Sealed || st.Progress != 0 {
+		t.Errorf("status after threshold want: unsealed got: %+v", st)
+	}
+	if len(keys.opened) != MasterKeySize {
+		t.Fatalf("master key handed out want: %d bytes got: %d", MasterKeySize, len(keys.opened))
+	}
+
+	if err := s.Seal(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Sealed() || keys.closed != 1 {
+		t.Errorf("after seal want: sealed, closed once got: sealed %v, closed %d", s.Sealed(), keys.closed)
+	}
+
+	// Any other pair of shares recovers the same master key.
+	first := keys.opened
+	for _, share := range [][]byte{shares[1], shares[2]} {
+		if _, err := s.Unseal(ctx, share); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(keys.opened, first) {
+		t.Error("shares recovered a different master key")
+	}
+}
+
+func TestUnsealWrongShares(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	keys := &testKeys{}
+	s := testSeal(t, filepath.Join(t.TempDir(), "seal.json"), keys)
+
+	shares, err := s.Init(ctx, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged := append([]byte(nil), shares[1]...)
+	forged[0] ^= 1
+	if _, err := s.Unseal(ctx, shares[0]); err != nil {
+		t.Fatal(err)
+	}
+	st, err := s.Unseal(ctx, forged)
+	if !errors.Is(err, ErrWrongShares) {
+		t.Fatalf("forged share want: %v got: %v", ErrWrongShares, err)
+	}
+	if !st.Sealed || st.Progress != 0 || keys.opened != nil {
+		t.Errorf("after wrong shares want: sealed without progress got: %+v", st)
+	}
+
+	if _, err := s.Unseal(ctx, []byte("short")); !errors.Is(err, ErrMalformedShare) {
+		t.Errorf("short share want: %v got: %v", ErrMalformedShare, err)
+	}
+}
+
+func TestUnsealReleasesLock(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	s, err := Open(Options{
+		Path: filepath.Join(t.TempDir(), "seal.json"),
+		Unsealed: func(ctx context.Context, masterKey []byte) error {
+			close(entered)
+			<-release
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := s.Init(ctx, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Unseal(ctx, shares[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Unseal(ctx, shares[1])
+		done <- err
+	}()
+	<-entered
+
+	// The status is served while the keystores are opened.
+	if st := s.Status(); !st.Sealed || !st.Unsealing {
+		t.Errorf("status while unsealing want: sealed, unsealing got: %+v", st)
+	}
+	if _, err := s.Unseal(ctx, shares[2]); !errors.Is(err, ErrUnsealing) {
+		t.Errorf("unseal while unsealing want: %v got: %v", ErrUnsealing, err)
+	}
+	if err := s.Seal(ctx); !errors.Is(err, ErrUnsealing) {
+		t.Errorf("seal while unsealing want: %v got: %v", ErrUnsealing, err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.Sealed || st.Unsealing {
+		t.Errorf("status after unseal want: unsealed got: %+v", st)
+	}
+}
@@ -0,0 +1,190 @@
+package seal
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+const (
+	maxShares     = 255
+	minThreshold  = 2
+	shareOverhead = 1 // x coordinate
+	// aesPolynomial is x^8 + x^4 + x^3 + x + 1 without the x^8 term.
+	aesPolynomial = 0x1b
+)
+
+var (
+	ErrInvalidShares   = errors.New("seal: invalid number of shares or threshold")
+	ErrMalformedShare  = errors.New("seal: malformed share")
+	ErrDuplicateShare  = errors.New("seal: duplicate share")
+	ErrNotEnoughShares = errors.New("seal: not enough shares")
+	errEmptySecret     = errors.New("seal: empty secret")
+)
+
+// Split divides secret into n shares of which any threshold recover it with
+// Combine, using Shamir's secret sharing over GF(2^8). Each share is the
+// secret's length plus one byte holding its x coordinate.
+func Split(secret []byte, n, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errEmptySecret
+	}
+	if threshold < minThreshold || threshold > n || n > maxShares {
+		return nil, ErrInvalidShares
+	}
+
+	xs, err := randomXs(n)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+shareOverhead)
+		shares[i][len(secret)] = xs[i]
+	}
+
+	coeffs := make([]byte, threshold)
+	for j, b := range secret {
+		// A random polynomial of degree threshold-1 through (0, b).
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i, x := range xs {
+			shares[i][j] = evaluate(coeffs, x)
+		}
+	}
+	zero(coeffs)
+
+	return shares, nil
+}
+
+// Combine recovers the secret from shares created by Split. With fewer shares
+// than the threshold it returns a wrong secret, which callers must detect.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < minThreshold {
+		return nil, ErrNotEnoughShares
+	}
+
+	size := len(shares[0])
+	if size <= shareOverhead {
+		return nil, ErrMalformedShare
+	}
+
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool, len(shares))
+	for i, s := range shares {
+		if len(s) != size {
+			return nil, ErrMalformedShare
+		}
+		x := s[size-1]
+		if x == 0 {
+			return nil, ErrMalformedShare
+		}
+		if seen[x] {
+			return nil, ErrDuplicateShare
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, size-shareOverhead)
+	ys := make([]byte, len(shares))
+	for j := range secret {
+		for i, s := range shares {
+			ys[i] = s[j]
+		}
+		secret[j] = interpolateAtZero(xs, ys)
+	}
+	zero(ys)
+
+	return secret, nil
+}
+
+// randomXs returns n distinct random non-zero x coordinates.
+func randomXs(n int) ([]byte, error) {
+	var perm [maxShares]byte
+	for i := range perm {
+		perm[i] = byte(i + 1)
+	}
+
+	// Fisher-Yates shuffle; the modulo bias of a random byte does not matter
+	// for the x coordinates, which are public.
+	r := make([]byte, maxShares)
+	if _, err := rand.Read(r); err != nil {
+		return nil, err
+	}
+	for i := maxShares - 1; i > 0; i-- {
+		j := int(r[i]) % (i + 1)
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+
+	xs := make([]byte, n)
+	copy(xs, perm[:n])
+
+	return xs, nil
+}
+
+// evaluate returns the polynomial with the given coefficients, lowest degree
+// first, at x.
+func evaluate(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coeffs[i]
+	}
+
+	return y
+}
+
+// interpolateAtZero returns the value at 0 of the polynomial through the
+// points (xs[i], ys[i]) by Lagrange interpolation.
+func interpolateAtZero(xs, ys []byte) byte {
+	var y byte
+	for i := range xs {
+		// The basis polynomial for point i at 0 is the product of
+		// x_j / (x_j - x_i); subtraction is XOR in GF(2^8).
+		basis := byte(1)
+		for j := range xs {
+			if i != j {
+				basis = mul(basis, div(xs[j], xs[j]^xs[i]))
+			}
+		}
+		y ^= mul(ys[i], basis)
+	}
+
+	return y
+}
+
+// mul multiplies in GF(2^8) with the AES polynomial, in constant time.
+func mul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		carry := -(a >> 7)
+		a = a<<1 ^ carry&aesPolynomial
+		b >>= 1
+	}
+
+	return p
+}
+
+// inverse returns the multiplicative inverse of a non-zero a, which is a^254.
+func inverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = mul(a, a)
+		result = mul(result, a)
+	}
+
+	return result
+}
+
+func div(a, b byte) byte {
+	return mul(a, inverse(b))
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
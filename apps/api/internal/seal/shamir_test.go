@@ -0,0 +1,118 @@
+package seal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("correct horse battery staple 32b")
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("shares want: %v got: %v", 5, len(shares))
+	}
+
+	// Every subset of at least three shares recovers the secret.
+	for mask := 0; mask < 1<<5; mask++ {
+		var subset [][]byte
+		for i := range shares {
+			if mask&(1<<i) != 0 {
+				subset = append(subset, shares[i])
+			}
+		}
+		if len(subset) < 2 {
+			continue
+		}
+
+		got, err := Combine(subset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recovered := bytes.Equal(got, secret); recovered != (len(subset) >= 3) {
+			t.Errorf("%d shares (mask %05b) recovered secret want: %v got: %v", len(subset), mask, len(subset) >= 3, recovered)
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		secret    []byte
+		n         int
+		threshold int
+		err       error
+	}{
+		{name: "threshold one", secret: []byte{1}, n: 3, threshold: 1, err: ErrInvalidShares},
+		{name: "threshold above shares", secret: []byte{1}, n: 3, threshold: 4, err: ErrInvalidShares},
+		{name: "too many shares", secret: []byte{1}, n: 256, threshold: 2, err: ErrInvalidShares},
+		{name: "empty secret", secret: nil, n: 3, threshold: 2, err: errEmptySecret},
+		{name: "maximum", secret: []byte{1}, n: 255, threshold: 255},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := Split(tt.secret, tt.n, tt.threshold)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("want: %v got: %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestCombineInvalid(t *testing.T) {
+	t.Parallel()
+
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		shares [][]byte
+		err    error
+	}{
+		{name: "single share", shares: shares[:1], err: ErrNotEnoughShares},
+		{name: "duplicate", shares: [][]byte{shares[0], shares[0]}, err: ErrDuplicateShare},
+		{name: "length mismatch", shares: [][]byte{shares[0], shares[1][1:]}, err: ErrMalformedShare},
+		{name: "zero x", shares: [][]byte{shares[0], append(append([]byte(nil), shares[1][:6]...), 0)}, err: ErrMalformedShare},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := Combine(tt.shares)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("want: %v got: %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestFieldArithmetic(t *testing.T) {
+	t.Parallel()
+
+	// Known product in the AES field (FIPS 197, section 4.2).
+	if got := mul(0x57, 0x83); got != 0xc1 {
+		t.Errorf("0x57 * 0x83 want: %#x got: %#x", 0xc1, got)
+	}
+
+	for a := 1; a < 256; a++ {
+		if got := mul(byte(a), inverse(byte(a))); got != 1 {
+			t.Fatalf("%#x * inverse want: 1 got: %#x", a, got)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/apihelper"
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+	"ezzy-web-crypto/api/apps/api/internal/jsonutil"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// HandlePrefixed serves /t/{tenant}/* with the handler of the tenant. The
+// request must carry the tenant's API key as bearer token.
+func HandlePrefixed(reg *Registry) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "tenant")
+
+		t, err := authenticate(reg, r)
+		if err != nil || t.ID != id {
+			unauthorized(rw)
+			return
+		}
+
+		prefix := "/t/" + id
+		r2 := r.Clone(apihelper.WithPathPrefix(asTenant(r.Context(), t), prefix))
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+		r2.URL.RawPath = ""
+		serve(t.Handler, rw, r2)
+	}
+}
+
+// HandleAdmin serves /admin/tenants/{tenant}/* with the admin handler of the
+// tenant, e.g. to revoke a compromised tenant key. The caller must already be
+// authorized as administrator.
+func HandleAdmin(reg *Registry) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "tenant")
+
+		t, err := reg.Get(id)
+		if err != nil || t.AdminHandler == nil {
+			message := fmt.Sprintf("error unknown tenant %q", id)
+			jsonutil.MarshalResponse(rw, http.StatusNotFound, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, "/admin/tenants/"+id)
+		r2.URL.RawPath = ""
+		serve(t.AdminHandler, rw, r2)
+	}
+}
+
+// HandleScoped serves requests carrying a tenant API key with the handler of
+// that tenant and all other requests with def.
+func HandleScoped(reg *Registry, def http.Handler) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if _, ok := apihelper.BearerToken(r); !ok {
+			serve(def, rw, r)
+			return
+		}
+
+		t, err := authenticate(reg, r)
+		if err != nil {
+			unauthorized(rw)
+			return
+		}
+
+		serve(t.Handler, rw, r.WithContext(asTenant(r.Context(), t)))
+	}
+}
+
+// asTenant identifies the caller as tenant t in audit events.
+func asTenant(ctx context.Context, t *Tenant) context.Context {
+	return audit.WithCallerID(ctx, "tenant:"+t.ID)
+}
+
+func authenticate(reg *Registry, r *http.Request) (*Tenant, error) {
+	apiKey, ok := apihelper.BearerToken(r)
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+
+	return reg.Authenticate(apiKey)
+}
+
+func unauthorized(rw http.ResponseWriter) {
+	jsonutil.MarshalResponse(rw, http.StatusUnauthorized, &apihelper.ErrorResponse{
+		ErrorMessage: "error missing or invalid tenant API key",
+	})
+}
+
+// serve hands a request to a handler with its own routes, dropping the
+// routing context of the router in front of it.
+func serve(h http.Handler, rw http.ResponseWriter, r *http.Request) {
+	h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, (*chi.Context)(nil))))
+}
+
+type createTenantRequest struct {
+	ID string `json:"id"`
+}
+
+type createTenantResponse struct {
+	ID string `json:"id"`
+	// APIKey authenticates the tenant. It is only shown once.
+	APIKey string `json:"api_key"`
+	Kid    string `json:"kid"`
+}
+
+func HandleCreateTenant(reg *Registry) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req createTenantRequest
+
+		code, err := jsonutil.Unmarshal(rw, r, &req)
+		if err != nil {
+			message := fmt.Sprintf("error unmarshaling API call, code: %v: %v", code, err)
+			jsonutil.MarshalResponse(rw, code, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		t, apiKey, err := reg.Create(r.Context(), req.ID)
+		if errors.Is(err, ErrInvalidID) {
+			jsonutil.MarshalResponse(rw, http.StatusBadRequest, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		if errors.Is(err, ErrExists) {
+			jsonutil.MarshalResponse(rw, http.StatusConflict, &apihelper.ErrorResponse{
+				ErrorMessage: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error creating tenant: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		res := &createTenantResponse{ID: t.ID, APIKey: apiKey}
+		if active := t.Keystore.ActiveKey(); active != nil {
+			res.Kid = active.ID
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusCreated, res)
+	}
+}
+
+type tenantState struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Kid     string    `json:"kid,omitempty"`
+	Keys    int       `json:"keys"`
+}
+
+type listTenantsResponse struct {
+	Tenants []tenantState `json:"tenants"`
+}
+
+func HandleListTenants(reg *Registry) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		tenants := reg.List()
+
+		res := listTenantsResponse{Tenants: make([]tenantState, 0, len(tenants))}
+		for _, t := range tenants {
+			state := tenantState{
+				ID:      t.ID,
+				Created: t.Created,
+				Keys:    len(t.Keystore.Keys()),
+			}
+			if active := t.Keystore.ActiveKey(); active != nil {
+				state.Kid = active.ID
+			}
+			res.Tenants = append(res.Tenants, state)
+		}
+
+		jsonutil.MarshalResponse(rw, http.StatusOK, &res)
+	}
+}
+
+// HandleDeleteTenant deletes the tenant given by the tenant URL parameter and
+// destroys all of its keys.
+func HandleDeleteTenant(reg *Registry) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "tenant")
+
+		err := reg.Delete(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			message := fmt.Sprintf("error unknown tenant %q", id)
+			jsonutil.MarshalResponse(rw, http.StatusNotFound, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+		if err != nil {
+			message := fmt.Sprintf("error deleting tenant: %v", err)
+			jsonutil.MarshalResponse(rw, http.StatusInternalServerError, &apihelper.ErrorResponse{
+				ErrorMessage: message,
+			})
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,79 @@
+package tenant
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestTenantRouting(t *testing.T) {
+	t.Parallel()
+
+	reg, err := Open(testOptions(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, acmeKey, err := reg.Create(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, globexKey, err := reg.Create(context.Background(), "globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("default " + r.URL.Path))
+	})
+	r := chi.NewRouter()
+	r.Handle("/rsa/*", HandleScoped(reg, def))
+	r.Handle("/t/{tenant}/*", HandlePrefixed(reg))
+	r.Handle("/admin/tenants/{tenant}/*", HandleAdmin(reg))
+
+	acmeBody := acme.Keystore.ActiveKey().ID + " /rsa/pub"
+	tests := []struct {
+		name     string
+		path     string
+		apiKey   string
+		code     int
+		body     string
+		location string
+	}{
+		{name: "default", path: "/rsa/pub", code: http.StatusOK, body: "default /rsa/pub"},
+		{name: "credential", path: "/rsa/pub", apiKey: acmeKey, code: http.StatusOK, body: acmeBody, location: "/rsa/jobs/1"},
+		{name: "prefix", path: "/t/acme/rsa/pub", apiKey: acmeKey, code: http.StatusOK, body: acmeBody, location: "/t/acme/rsa/jobs/1"},
+		{name: "invalid credential", path: "/rsa/pub", apiKey: "acme.guess", code: http.StatusUnauthorized},
+		{name: "prefix without credential", path: "/t/acme/rsa/pub", code: http.StatusUnauthorized},
+		{name: "other tenant's prefix", path: "/t/acme/rsa/pub", apiKey: globexKey, code: http.StatusUnauthorized},
+		{name: "unknown tenant", path: "/t/initech/rsa/pub", apiKey: acmeKey, code: http.StatusUnauthorized},
+		{name: "admin", path: "/admin/tenants/acme/keys/1/revoke", code: http.StatusOK, body: "admin " + acme.Keystore.ActiveKey().ID + " /keys/1/revoke"},
+		{name: "admin unknown tenant", path: "/admin/tenants/initech/keys/1/revoke", code: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.apiKey != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.apiKey)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.code {
+				t.Fatalf("wrong response code, want: %v got: %v", tt.code, w.Code)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body want: %q got: %q", tt.body, w.Body.String())
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("location want: %q got: %q", tt.location, got)
+			}
+		})
+	}
+}
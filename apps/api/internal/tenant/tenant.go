@@ -0,0 +1,419 @@
+// Package tenant gives every customer application its own keystore. A tenant
+// is addressed by the path prefix /t/{tenant} or by its API key alone, and its
+// API key is required either way.
+package tenant
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/audit"
+	"ezzy-web-crypto/api/apps/api/internal/fileutil"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeySecretSize is the number of random bytes of an API key. API keys have
+// the form "{tenant}.{secret}".
+const apiKeySecretSize = 32
+
+var (
+	ErrNotFound     = errors.New("tenant: not found")
+	ErrExists       = errors.New("tenant: already exists")
+	ErrInvalidID    = errors.New("tenant: invalid ID, want lowercase letters, digits and dashes")
+	ErrUnauthorized = errors.New("tenant: invalid API key")
+	ErrClosed       = errors.New("tenant: registry closed")
+)
+
+var validID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenant is a customer application with its own keystore.
+type Tenant struct {
+	ID       string
+	Created  time.Time
+	Keystore *keystore.Keystore
+	Pool     *keystore.Pool
+	// Handler serves the key endpoints of the tenant.
+	Handler http.Handler
+	// AdminHandler serves the admin endpoints of the tenant's keys, or is nil.
+	AdminHandler http.Handler
+
+	apiKeyHash []byte
+	done       chan struct{}
+}
+
+// Done is closed when the tenant is deleted.
+func (t *Tenant) Done() <-chan struct{} {
+	return t.done
+}
+
+// Options configure a Registry.
+type Options struct {
+	// Path is the file the tenants are recorded in. Tenants only live in
+	// memory if it is empty.
+	Path string
+	// OpenKeystore opens the keystore of a tenant, creating it if needed.
+	OpenKeystore func(id string) (*keystore.Keystore, error)
+	// RemoveKeystore removes the storage of a deleted tenant's keystore after
+	// all of its keys were destroyed. Optional.
+	RemoveKeystore func(id string) error
+	// Routes returns the handler serving the key endpoints of a tenant.
+	Routes func(ks *keystore.Keystore, pool *keystore.Pool) http.Handler
+	// AdminRoutes returns the handler serving the admin endpoints of a
+	// tenant's keys, e.g. to revoke them. Optional.
+	AdminRoutes func(ks *keystore.Keystore, pool *keystore.Pool) http.Handler
+	// PoolSize is the number of pre-generated keys per tenant.
+	PoolSize int
+	// Started is called for every tenant once its keystore is open, e.g. to
+	// start background maintenance until Done is closed. Optional.
+	Started func(t *Tenant)
+	// Audit records creating and deleting tenants. Optional.
+	Audit audit.Recorder
+}
+
+// Registry holds the tenants. It is safe for concurrent use.
+type Registry struct {
+	opts Options
+
+	// lifecycle serializes creating and deleting tenants. The keystore of a
+	// new tenant is opened without it, as that generates a key pair; creating
+	// holds the tenant ID meanwhile.
+	lifecycle sync.Mutex
+	creating  map[string]bool
+	closed    bool
+
+	mu      sync.RWMutex
+	tenants map[string]*Tenant
+}
+
+type registryFile struct {
+	Tenants []storedTenant `json:"tenants"`
+}
+
+type storedTenant struct {
+	ID         string    `json:"id"`
+	Created    time.Time `json:"created"`
+	APIKeyHash []byte    `json:"api_key_hash"` // SHA-256
+}
+
+// Open returns a registry with the tenants recorded in opts.Path and their
+// keystores opened.
+func Open(opts Options) (*Registry, error) {
+	reg := &Registry{opts: opts, creating: make(map[string]bool), tenants: make(map[string]*Tenant)}
+	if opts.Path == "" {
+		return reg, nil
+	}
+
+	data, err := ioutil.ReadFile(opts.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return reg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f registryFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("tenant: malformed registry file: %w", err)
+	}
+	for _, st := range f.Tenants {
+		t, err := reg.open(st)
+		if err != nil {
+			return nil, fmt.Errorf("tenant: error opening %s: %w", st.ID, err)
+		}
+		reg.tenants[t.ID] = t
+	}
+	for _, t := range reg.List() {
+		reg.started(t)
+	}
+
+	return reg, nil
+}
+
+// Create adds a tenant with a new keystore. It returns the tenant and its API
+// key, which is not stored and cannot be retrieved later.
+func (reg *Registry) Create(ctx context.Context, id string) (*Tenant, string, error) {
+	t, apiKey, err := reg.create(id)
+	if err := reg.record(ctx, audit.OpTenantCreate, id, err); err != nil {
+		return nil, "", err
+	}
+
+	return t, apiKey, nil
+}
+
+func (reg *Registry) create(id string) (*Tenant, string, error) {
+	if !validID.MatchString(id) {
+		return nil, "", ErrInvalidID
+	}
+
+	if err := reg.reserve(id); err != nil {
+		return nil, "", err
+	}
+	defer reg.release(id)
+
+	secret := make([]byte, apiKeySecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	apiKey := id + "." + base64.RawURLEncoding.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(apiKey))
+
+	t, err := reg.open(storedTenant{
+		ID:         id,
+		Created:    time.Now().UTC(),
+		APIKeyHash: hash[:],
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	reg.lifecycle.Lock()
+	defer reg.lifecycle.Unlock()
+
+	if reg.closed {
+		t.Keystore.Close()
+		return nil, "", ErrClosed
+	}
+	if err := reg.save(t, ""); err != nil {
+		t.Keystore.Close()
+		if rmErr := reg.removeKeystore(id); rmErr != nil {
+			return nil, "", fmt.Errorf("%w, error removing its keystore: %v", err, rmErr)
+		}
+		return nil, "", err
+	}
+	reg.set(t)
+	reg.started(t)
+
+	return t, apiKey, nil
+}
+
+// reserve holds id for a tenant being created. A keystore without a tenant was
+// left behind by a crash during an earlier create; its keys must not be handed
+// to the new tenant, so it is removed.
+func (reg *Registry) reserve(id string) error {
+	reg.lifecycle.Lock()
+	defer reg.lifecycle.Unlock()
+
+	if reg.closed {
+		return ErrClosed
+	}
+	if _, err := reg.Get(id); err == nil || reg.creating[id] {
+		return ErrExists
+	}
+	if err := reg.removeKeystore(id); err != nil {
+		return err
+	}
+	reg.creating[id] = true
+
+	return nil
+}
+
+func (reg *Registry) release(id string) {
+	reg.lifecycle.Lock()
+	defer reg.lifecycle.Unlock()
+
+	delete(reg.creating, id)
+}
+
+// Get returns the tenant with the given ID.
+func (reg *Registry) Get(id string) (*Tenant, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	t, ok := reg.tenants[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return t, nil
+}
+
+// List returns all tenants ordered by ID.
+func (reg *Registry) List() []*Tenant {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	list := make([]*Tenant, 0, len(reg.tenants))
+	for _, t := range reg.tenants {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return list
+}
+
+// Delete removes a tenant and destroys all of its keys.
+func (reg *Registry) Delete(ctx context.Context, id string) error {
+	return reg.record(ctx, audit.OpTenantDelete, id, reg.delete(ctx, id))
+}
+
+func (reg *Registry) delete(ctx context.Context, id string) error {
+	reg.lifecycle.Lock()
+	defer reg.lifecycle.Unlock()
+
+	t, err := reg.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := reg.save(nil, id); err != nil {
+		return err
+	}
+	reg.mu.Lock()
+	delete(reg.tenants, id)
+	reg.mu.Unlock()
+	close(t.done)
+
+	if err := t.Keystore.DestroyAll(ctx); err != nil {
+		return err
+	}
+
+	return reg.removeKeystore(id)
+}
+
+// removeKeystore removes the storage of the keystore of tenant id, if any.
+func (reg *Registry) removeKeystore(id string) error {
+	if reg.opts.RemoveKeystore == nil {
+		return nil
+	}
+
+	return reg.opts.RemoveKeystore(id)
+}
+
+// Close stops all tenants and closes their keystores, keeping their keys in
+// storage. The registry cannot be used afterwards.
+func (reg *Registry) Close() error {
+	reg.lifecycle.Lock()
+	defer reg.lifecycle.Unlock()
+
+	reg.closed = true
+	reg.mu.Lock()
+	tenants := reg.tenants
+	reg.tenants = make(map[string]*Tenant)
+	reg.mu.Unlock()
+
+	var firstErr error
+	for _, t := range tenants {
+		close(t.done)
+		if err := t.Keystore.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("tenant: error closing %s: %w", t.ID, err)
+		}
+	}
+
+	return firstErr
+}
+
+// record writes an audit event for the operation op on the tenant id, which
+// failed with err or succeeded if err is nil. It returns err, or the error
+// writing the event.
+func (reg *Registry) record(ctx context.Context, op, id string, err error) error {
+	if reg.opts.Audit == nil {
+		return err
+	}
+
+	ev := audit.Event{Op: op, Tenant: id, Outcome: audit.OutcomeSuccess}
+	if err != nil {
+		ev.Outcome = audit.OutcomeFailure
+		ev.Error = err.Error()
+	}
+
+	if recErr := reg.opts.Audit.Record(ctx, ev); recErr != nil && err == nil {
+		return recErr
+	}
+
+	return err
+}
+
+// Authenticate returns the tenant an API key belongs to.
+func (reg *Registry) Authenticate(apiKey string) (*Tenant, error) {
+	i := strings.Index(apiKey, ".")
+	if i < 0 {
+		return nil, ErrUnauthorized
+	}
+
+	t, err := reg.Get(apiKey[:i])
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	hash := sha256.Sum256([]byte(apiKey))
+	if subtle.ConstantTimeCompare(hash[:], t.apiKeyHash) != 1 {
+		return nil, ErrUnauthorized
+	}
+
+	return t, nil
+}
+
+func (reg *Registry) open(st storedTenant) (*Tenant, error) {
+	ks, err := reg.opts.OpenKeystore(st.ID)
+	if err != nil {
+		return nil, err
+	}
+	pool := keystore.NewPool(ks, reg.opts.PoolSize)
+
+	t := &Tenant{
+		ID:         st.ID,
+		Created:    st.Created,
+		Keystore:   ks,
+		Pool:       pool,
+		Handler:    reg.opts.Routes(ks, pool),
+		apiKeyHash: st.APIKeyHash,
+		done:       make(chan struct{}),
+	}
+	if reg.opts.AdminRoutes != nil {
+		t.AdminHandler = reg.opts.AdminRoutes(ks, pool)
+	}
+
+	return t, nil
+}
+
+func (reg *Registry) set(t *Tenant) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.tenants[t.ID] = t
+}
+
+func (reg *Registry) started(t *Tenant) {
+	if reg.opts.Started != nil {
+		reg.opts.Started(t)
+	}
+}
+
+// save writes the registry file with added included and removed left out.
+func (reg *Registry) save(added *Tenant, removed string) error {
+	if reg.opts.Path == "" {
+		return nil
+	}
+
+	var f registryFile
+	for _, t := range append(reg.List(), added) {
+		if t == nil || t.ID == removed {
+			continue
+		}
+		f.Tenants = append(f.Tenants, storedTenant{
+			ID:         t.ID,
+			Created:    t.Created,
+			APIKeyHash: t.apiKeyHash,
+		})
+	}
+
+	data, err := json.MarshalIndent(&f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteFileAtomic(reg.opts.Path, data)
+}
@@ -0,0 +1,193 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"ezzy-web-crypto/api/apps/api/internal/apihelper"
+	"ezzy-web-crypto/api/apps/api/internal/keystore"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testOptions(t *testing.T, path string) Options {
+	t.Helper()
+
+	return Options{
+		Path: path,
+		OpenKeystore: func(id string) (*keystore.Keystore, error) {
+			return keystore.Open(keystore.Options{Bits: 2048})
+		},
+		Routes: func(ks *keystore.Keystore, pool *keystore.Pool) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Location", apihelper.URLPath(r, "/rsa/jobs/1"))
+				rw.Write([]byte(ks.ActiveKey().ID + " " + r.URL.Path))
+			})
+		},
+		AdminRoutes: func(ks *keystore.Keystore, pool *keystore.Pool) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Write([]byte("admin " + ks.ActiveKey().ID + " " + r.URL.Path))
+			})
+		},
+		PoolSize: 1,
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	reg, err := Open(testOptions(t, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := reg.Create(context.Background(), "Not Valid"); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("create with invalid ID want: %v got: %v", ErrInvalidID, err)
+	}
+
+	acme, acmeKey, err := reg.Create(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	globex, globexKey, err := reg.Create(context.Background(), "globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reg.Create(context.Background(), "acme"); !errors.Is(err, ErrExists) {
+		t.Errorf("create twice want: %v got: %v", ErrExists, err)
+	}
+
+	if acme.Keystore.ActiveKey().ID == globex.Keystore.ActiveKey().ID {
+		t.Errorf("tenants share a key")
+	}
+	if got, err := reg.Authenticate(acmeKey); err != nil || got.ID != "acme" {
+		t.Errorf("authenticate want: acme got: %v, %v", got, err)
+	}
+	if _, err := reg.Authenticate("acme." + globexKey[len("globex."):]); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("authenticate with another tenant's secret want: %v got: %v", ErrUnauthorized, err)
+	}
+
+	// Tenants and their API keys survive a restart.
+	reopened, err := Open(testOptions(t, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.List(); len(list) != 2 || list[0].ID != "acme" || list[1].ID != "globex" {
+		t.Fatalf("reopened tenants want: [acme globex] got: %v", list)
+	}
+	if _, err := reopened.Authenticate(globexKey); err != nil {
+		t.Errorf("authenticate after restart: %v", err)
+	}
+
+	if err := reopened.Delete(context.Background(), "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Authenticate(acmeKey); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("authenticate deleted tenant want: %v got: %v", ErrUnauthorized, err)
+	}
+	if err := reopened.Delete(context.Background(), "acme"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("delete twice want: %v got: %v", ErrNotFound, err)
+	}
+}
+
+func TestCreateOpensKeystoreUnlocked(t *testing.T) {
+	t.Parallel()
+
+	opts := testOptions(t, "")
+	opening := make(chan struct{})
+	proceed := make(chan struct{})
+	openKeystore := opts.OpenKeystore
+	opts.OpenKeystore = func(id string) (*keystore.Keystore, error) {
+		if id == "slow" {
+			close(opening)
+			<-proceed
+		}
+		return openKeystore(id)
+	}
+	reg, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := make(chan error, 1)
+	go func() {
+		_, _, err := reg.Create(context.Background(), "slow")
+		created <- err
+	}()
+	<-opening
+
+	// Other tenants come and go while the key pair of slow is generated.
+	if _, _, err := reg.Create(context.Background(), "fast"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Delete(context.Background(), "fast"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reg.Create(context.Background(), "slow"); !errors.Is(err, ErrExists) {
+		t.Errorf("create during create want: %v got: %v", ErrExists, err)
+	}
+
+	close(proceed)
+	if err := <-created; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Get("slow"); err != nil {
+		t.Errorf("get created tenant: %v", err)
+	}
+}
+
+func TestCreateRemovesKeystore(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	keystorePath := func(id string) string {
+		return filepath.Join(dir, id+".keystore.json")
+	}
+	opts := testOptions(t, filepath.Join(dir, "tenants.json"))
+	opts.OpenKeystore = func(id string) (*keystore.Keystore, error) {
+		backend, err := keystore.NewFileBackend(keystorePath(id), []byte("secret"))
+		if err != nil {
+			return nil, err
+		}
+		return keystore.Open(keystore.Options{Backend: backend, Bits: 2048})
+	}
+	opts.RemoveKeystore = func(id string) error {
+		err := os.Remove(keystorePath(id))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	// A keystore left behind without a tenant is not picked up.
+	orphan, err := opts.OpenKeystore("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, _, err := reg.Create(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acme.Keystore.ActiveKey().ID == orphan.ActiveKey().ID {
+		t.Errorf("tenant picked up the orphaned key %s", orphan.ActiveKey().ID)
+	}
+
+	// A keystore whose tenant could not be saved is removed.
+	opts.Path = filepath.Join(dir, "missing", "tenants.json")
+	broken, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := broken.Create(context.Background(), "globex"); err == nil {
+		t.Fatal("create without a registry file succeeded")
+	}
+	if _, err := os.Stat(keystorePath("globex")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("keystore of unsaved tenant want: %v got: %v", os.ErrNotExist, err)
+	}
+}
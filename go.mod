@@ -1,9 +1,11 @@
 module ezzy-web-crypto/api
 
-go 1.16
+go 1.21
 
 require (
-	github.com/go-chi/chi/v5 v5.0.4 // indirect
-	github.com/go-chi/cors v1.2.0 // indirect
-	github.com/google/go-cmp v0.5.6 // indirect
+	github.com/go-chi/chi/v5 v5.0.4
+	github.com/go-chi/cors v1.2.0
+	github.com/google/go-cmp v0.5.6
+	github.com/miekg/pkcs11 v1.1.1
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )